@@ -0,0 +1,106 @@
+package freedns
+
+import (
+	"net"
+	"strings"
+)
+
+// ACL restricts the clients allowed to query a listener.
+// Deny is checked first, and an empty Allow list allows every client not denied.
+// Entries are CIDRs like "10.0.0.0/8", bare IPs match a single host.
+type ACL struct {
+	Allow []string
+	Deny  []string
+}
+
+type compiledACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func compileACL(acl *ACL) (*compiledACL, error) {
+	if acl == nil {
+		return nil, nil
+	}
+	allow, err := parseCIDRs(acl.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseCIDRs(acl.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &compiledACL{allow: allow, deny: deny}, nil
+}
+
+// allowed returns whether the client ip may query. A nil ACL allows everyone.
+func (acl *compiledACL) allowed(ip net.IP) bool {
+	if acl == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	if containsIP(acl.deny, ip) {
+		return false
+	}
+	return len(acl.allow) == 0 || containsIP(acl.allow, ip)
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		n, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseCIDR parses a CIDR, or a bare IP as a single host network.
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	cidr = strings.TrimSpace(cidr)
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, Error("Invalid CIDR: " + cidr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, Error("Invalid CIDR: " + cidr)
+	}
+	return n, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP extracts the IP of the client from the remote address of a request.
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
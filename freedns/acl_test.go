@@ -0,0 +1,138 @@
+package freedns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testResponseWriter records the message written back to the client.
+type testResponseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func newTestResponseWriter(ip string, network string) *testResponseWriter {
+	w := &testResponseWriter{}
+	if network == "tcp" {
+		w.remote = &net.TCPAddr{IP: net.ParseIP(ip), Port: 53000}
+	} else {
+		w.remote = &net.UDPAddr{IP: net.ParseIP(ip), Port: 53000}
+	}
+	return w
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *testResponseWriter) RemoteAddr() net.Addr      { return w.remote }
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *testResponseWriter) Write(b []byte) (int, error) {
+	m := &dns.Msg{}
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+func (w *testResponseWriter) Close() error        { return nil }
+func (w *testResponseWriter) TsigStatus() error   { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool) {}
+func (w *testResponseWriter) Hijack()             {}
+
+func TestACLAllowed(t *testing.T) {
+	acl, err := compileACL(&ACL{
+		Allow: []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"},
+		Deny:  []string{"10.1.0.0/16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.0.0.1", true},
+		{"10.1.2.3", false},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"fd00::1", true},
+		{"2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		if got := acl.allowed(net.ParseIP(tt.ip)); got != tt.allowed {
+			t.Errorf("allowed(%s) = %v, want %v", tt.ip, got, tt.allowed)
+		}
+	}
+
+	var none *compiledACL
+	if !none.allowed(net.ParseIP("8.8.8.8")) {
+		t.Errorf("a nil acl should allow everyone")
+	}
+
+	if _, err := compileACL(&ACL{Deny: []string{"10.0.0.0/33"}}); err == nil {
+		t.Errorf("invalid CIDRs should be rejected")
+	}
+}
+
+func TestListenerACLPrecedence(t *testing.T) {
+	global := &ACL{Deny: []string{"1.1.1.1"}}
+	cfg := Listener{
+		Addr:   "127.0.0.1:5353",
+		TCPACL: &ACL{Deny: []string{"2.2.2.2"}},
+	}
+
+	udp, err := newListener(cfg, global, "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := newListener(cfg, global, "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if udp.name != "127.0.0.1:5353" {
+		t.Errorf("listener name should default to its address, got %s", udp.name)
+	}
+	if udp.acl.allowed(net.ParseIP("1.1.1.1")) || !udp.acl.allowed(net.ParseIP("2.2.2.2")) {
+		t.Errorf("udp should use the global acl")
+	}
+	if !tcp.acl.allowed(net.ParseIP("1.1.1.1")) || tcp.acl.allowed(net.ParseIP("2.2.2.2")) {
+		t.Errorf("tcp should use its own acl")
+	}
+}
+
+func TestHandleRefusesDeniedClients(t *testing.T) {
+	s, err := NewServer(Config{
+		FastUpstream:   "127.0.0.1:1",
+		CleanUpstream:  "127.0.0.1:1",
+		PublicUpstream: "127.0.0.1:1",
+		Listen:         "127.0.0.1:0",
+		ACL:            &ACL{Allow: []string{"10.0.0.0/8"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := newListener(Listener{Name: "lan", Addr: "127.0.0.1:0"}, s.config.ACL, "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	w := newTestResponseWriter("192.0.2.1", "udp")
+	s.handle(w, req, ln)
+
+	if w.msg == nil || w.msg.Rcode != dns.RcodeRefused {
+		t.Fatalf("denied client should get REFUSED, got %v", w.msg)
+	}
+	if w.msg.Id != req.Id {
+		t.Errorf("REFUSED should reply to the request id")
+	}
+	stats := s.Stats()
+	if stats["acl_refused"] != 1 || stats["acl_refused_lan_udp"] != 1 {
+		t.Errorf("refused queries should be counted, got %v", stats)
+	}
+}
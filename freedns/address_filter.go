@@ -0,0 +1,137 @@
+package freedns
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// AddressFilter removes the addresses of a family from the answers, which become NODATA.
+// It works around the domains publishing broken AAAA records, and the networks without IPv6 (or IPv4).
+type AddressFilter string
+
+// The address filters, the empty one filters nothing (or inherits the filter of Config in a View).
+const (
+	// FilterNone filters nothing, e.g. to exempt some domains from the filter of their view.
+	FilterNone AddressFilter = "none"
+	// FilterAAAA answers the AAAA queries with NODATA.
+	FilterAAAA AddressFilter = "aaaa"
+	// FilterAAAAIfA answers the AAAA queries with NODATA when the domain has an A record.
+	FilterAAAAIfA AddressFilter = "aaaa-if-a"
+	// FilterA answers the A queries with NODATA, for the IPv6-only networks.
+	FilterA AddressFilter = "a"
+	// FilterAIfAAAA answers the A queries with NODATA when the domain has an AAAA record.
+	FilterAIfAAAA AddressFilter = "a-if-aaaa"
+)
+
+func (f AddressFilter) valid() bool {
+	switch f {
+	case "", FilterNone, FilterAAAA, FilterAAAAIfA, FilterA, FilterAIfAAAA:
+		return true
+	}
+	return false
+}
+
+// filtered returns the type of the records removed by the filter, and the type whose
+// presence is required first for the conditional filters, 0 when none is.
+func (f AddressFilter) filtered() (qtype uint16, required uint16) {
+	switch f {
+	case FilterAAAA:
+		return dns.TypeAAAA, 0
+	case FilterAAAAIfA:
+		return dns.TypeAAAA, dns.TypeA
+	case FilterA:
+		return dns.TypeA, 0
+	case FilterAIfAAAA:
+		return dns.TypeA, dns.TypeAAAA
+	}
+	return 0, 0
+}
+
+// validateAddressFilters checks the filters of the config and of its views.
+func validateAddressFilters(cfg Config) error {
+	filters := []AddressFilter{cfg.AddressFilter}
+	for _, filter := range cfg.DomainAddressFilters {
+		filters = append(filters, filter)
+	}
+	for _, v := range cfg.Views {
+		filters = append(filters, v.AddressFilter)
+	}
+	for _, filter := range filters {
+		if !filter.valid() {
+			return Error("Invalid address filter " + string(filter))
+		}
+	}
+	return nil
+}
+
+// addressFilter returns the filter of the domain: the override of its longest matching
+// suffix in Config.DomainAddressFilters, or the filter of the view of the resolver.
+func (s *Server) addressFilter(resolver *spoofingProofResolver, name string) AddressFilter {
+	name = strings.ToLower(strings.TrimRight(name, "."))
+	for {
+		if filter, ok := s.config.DomainAddressFilters[name]; ok {
+			return filter
+		}
+		i := strings.Index(name, ".")
+		if i < 0 {
+			return resolver.addressFilter
+		}
+		name = name[i+1:]
+	}
+}
+
+// filterAddresses applies the address filter of the domain to the answer `res` of `req`,
+// in place. The conditional filters look the other family up with the same resolver.
+func (s *Server) filterAddresses(ctx context.Context, resolver *spoofingProofResolver, req *dns.Msg, res *dns.Msg, net string, cached bool) {
+	q := req.Question[0]
+	qtype, required := s.addressFilter(resolver, q.Name).filtered()
+	if qtype == 0 || q.Qtype != qtype || res.Rcode != dns.RcodeSuccess || !hasRecords(res, qtype) {
+		return
+	}
+	if required != 0 {
+		probe := &dns.Msg{}
+		probe.SetQuestion(q.Name, required)
+		probe.RecursionDesired = req.RecursionDesired
+		if other, _ := s.lookupWith(ctx, resolver, probe, net, cached); !hasRecords(other, required) {
+			return
+		}
+	}
+
+	// keep the CNAME chain, so the answer is a NODATA for its target
+	kept := res.Answer[:0]
+	for _, rr := range res.Answer {
+		if rr.Header().Rrtype == qtype {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == qtype {
+			continue
+		}
+		kept = append(kept, rr)
+	}
+	res.Answer = kept
+	// the NODATA is not proven by the signed records
+	res.AuthenticatedData = false
+
+	s.stats.inc("filtered_" + strings.ToLower(dns.TypeToString[qtype]))
+	log.WithFields(logrus.Fields{
+		"op":     "filter_addresses",
+		"domain": q.Name,
+		"type":   dns.TypeToString[qtype],
+	}).Debug()
+}
+
+// hasRecords tells whether the answer has records of the type.
+func hasRecords(res *dns.Msg, rrtype uint16) bool {
+	if res == nil || res.Rcode != dns.RcodeSuccess {
+		return false
+	}
+	for _, rr := range res.Answer {
+		if rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+	return false
+}
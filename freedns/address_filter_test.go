@@ -0,0 +1,176 @@
+package freedns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/freedns/dnstest"
+)
+
+func TestAddressFilterOverrides(t *testing.T) {
+	s := &Server{config: Config{
+		DomainAddressFilters: map[string]AddressFilter{
+			"broken.example":    FilterAAAA,
+			"ok.broken.example": FilterNone,
+			"v6.example":        FilterA,
+			"dual.v6.example":   FilterAIfAAAA,
+		},
+	}}
+	resolver := &spoofingProofResolver{addressFilter: FilterAAAAIfA}
+	tests := []struct {
+		name string
+		want AddressFilter
+	}{
+		{"www.example.", FilterAAAAIfA},
+		{"broken.example.", FilterAAAA},
+		{"WWW.Broken.Example.", FilterAAAA},
+		{"www.ok.broken.example.", FilterNone},
+		{"host.dual.v6.example.", FilterAIfAAAA},
+		{"notbroken.example.", FilterAAAAIfA},
+	}
+	for _, tt := range tests {
+		if got := s.addressFilter(resolver, tt.name); got != tt.want {
+			t.Errorf("addressFilter(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInvalidAddressFilter(t *testing.T) {
+	configs := []Config{
+		{AddressFilter: "ipv6"},
+		{DomainAddressFilters: map[string]AddressFilter{"example": "AAAA"}},
+		{Views: []View{{Name: "lan", AddressFilter: "b"}}},
+	}
+	for _, cfg := range configs {
+		cfg.Listen = "127.0.0.1:0"
+		if _, err := NewServer(cfg); err == nil {
+			t.Errorf("Should not create server with the address filters of %+v", cfg)
+		}
+	}
+}
+
+func TestFilterAddresses(t *testing.T) {
+	upstream := dnstest.NewServer(dnstest.Records(
+		"example. 3600 IN SOA ns.example. admin.example. 1 7200 900 1209600 60",
+		"dual.example. 300 IN A 10.0.0.1",
+		"dual.example. 300 IN AAAA 2001:db8::1",
+		"v6only.example. 300 IN AAAA 2001:db8::2",
+		"v4only.example. 300 IN A 10.0.0.3",
+		"alias.example. 300 IN CNAME dual.example.",
+	))
+	defer upstream.Close()
+
+	tests := []struct {
+		filter AddressFilter
+		name   string
+		qtype  uint16
+		// kept is the number of records of the qtype left in the answer
+		kept int
+	}{
+		{"", "dual.example.", dns.TypeAAAA, 1},
+		{FilterNone, "dual.example.", dns.TypeAAAA, 1},
+		{FilterAAAA, "dual.example.", dns.TypeAAAA, 0},
+		{FilterAAAA, "v6only.example.", dns.TypeAAAA, 0},
+		{FilterAAAA, "dual.example.", dns.TypeA, 1},
+		{FilterAAAAIfA, "dual.example.", dns.TypeAAAA, 0},
+		{FilterAAAAIfA, "alias.example.", dns.TypeAAAA, 0},
+		{FilterAAAAIfA, "v6only.example.", dns.TypeAAAA, 1},
+		{FilterA, "dual.example.", dns.TypeA, 0},
+		{FilterA, "dual.example.", dns.TypeAAAA, 1},
+		{FilterAIfAAAA, "dual.example.", dns.TypeA, 0},
+		{FilterAIfAAAA, "v4only.example.", dns.TypeA, 1},
+	}
+	for _, tt := range tests {
+		for _, cache := range []bool{false, true} {
+			r, err := NewResolver(Config{
+				FastUpstream:   upstream.Addr,
+				CleanUpstream:  upstream.Addr,
+				PublicUpstream: upstream.Addr,
+				Listen:         "127.0.0.1:0",
+				Cache:          cache,
+				AddressFilter:  tt.filter,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				req := &dns.Msg{}
+				req.SetQuestion(tt.name, tt.qtype)
+				res, _, err := r.Resolve(context.Background(), req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				kept := 0
+				for _, rr := range res.Answer {
+					if rr.Header().Rrtype == tt.qtype {
+						kept++
+					}
+				}
+				if res.Rcode != dns.RcodeSuccess || kept != tt.kept {
+					t.Errorf("%q %s %s (cache %v): got %d records in %v, want %d",
+						tt.filter, tt.name, dns.TypeToString[tt.qtype], cache, kept, res, tt.kept)
+				}
+				if tt.name == "alias.example." && (len(res.Answer) != 1 || res.Answer[0].Header().Rrtype != dns.TypeCNAME) {
+					t.Errorf("the CNAME chain should be kept, got %v", res.Answer)
+				}
+			}
+			r.Close()
+		}
+	}
+}
+
+func TestViewAddressFilter(t *testing.T) {
+	upstream := dnstest.NewServer(dnstest.Records(
+		"example. 3600 IN SOA ns.example. admin.example. 1 7200 900 1209600 60",
+		"www.example. 300 IN A 10.0.0.1",
+		"www.example. 300 IN AAAA 2001:db8::1",
+		"www.exempt.example. 300 IN AAAA 2001:db8::2",
+	))
+	defer upstream.Close()
+
+	s, err := NewServer(Config{
+		FastUpstream:   upstream.Addr,
+		CleanUpstream:  upstream.Addr,
+		PublicUpstream: upstream.Addr,
+		Listen:         "127.0.0.1:0",
+		AddressFilter:  FilterAAAAIfA,
+		DomainAddressFilters: map[string]AddressFilter{
+			"exempt.example": FilterNone,
+		},
+		Views: []View{
+			{Name: "v4only", ClientCIDRs: []string{"10.0.0.0/8"}, AddressFilter: FilterAAAA},
+			{Name: "inherit", ClientCIDRs: []string{"192.168.0.0/16"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	if s.views[0].resolver.addressFilter != FilterAAAA || s.views[1].resolver.addressFilter != FilterAAAAIfA {
+		t.Errorf("unexpected filters of the views %q, %q", s.views[0].resolver.addressFilter, s.views[1].resolver.addressFilter)
+	}
+
+	tests := []struct {
+		resolver *spoofingProofResolver
+		name     string
+		answers  int
+	}{
+		{s.resolver, "www.example.", 0},
+		{s.views[0].resolver, "www.example.", 0},
+		{s.views[0].resolver, "www.exempt.example.", 1},
+		{s.views[1].resolver, "www.example.", 0},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(tt.name, dns.TypeAAAA)
+		res, _ := s.lookup(tt.resolver, req, "udp")
+		if res.Rcode != dns.RcodeSuccess || len(res.Answer) != tt.answers {
+			t.Errorf("%s: got %v, want %d answers", tt.name, res, tt.answers)
+		}
+	}
+	if s.stats.snapshot()["filtered_aaaa"] != 3 {
+		t.Errorf("the filtered answers should be counted, got %v", s.stats.snapshot())
+	}
+}
@@ -0,0 +1,249 @@
+package freedns
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// cacheFileMagic starts the cache snapshot files, it changes with the format.
+const cacheFileMagic = "FREEDNS-CACHE-2\n"
+
+// The snapshot is the magic followed by records of
+//
+//	crc32 (uint32) | length of the rest (uint32) | view | key | putin (unix nano, int64) | ttl (uint32) | reply (wire format)
+//
+// where view, key and reply are prefixed by their uint16/uint16/uint32 length.
+
+// saveCaches writes the entries of the caches, keyed by view name, to the file.
+// The file is replaced atomically so a crash never leaves a half written snapshot.
+func saveCaches(filename string, caches map[string]*dnsCache) (int, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	w.WriteString(cacheFileMagic)
+	saved := 0
+	for view, cache := range caches {
+		for key, entry := range cache.entries() {
+			if entry.reply.Rcode == dns.RcodeServerFailure {
+				// failures are only cached briefly, they are not worth keeping
+				continue
+			}
+			wire, err := entry.reply.Pack()
+			if err != nil {
+				continue
+			}
+			if err := writeCacheRecord(w, view, key, entry, wire); err != nil {
+				tmp.Close()
+				return 0, err
+			}
+			saved++
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return saved, os.Rename(tmp.Name(), filename)
+}
+
+func writeCacheRecord(w io.Writer, view string, key string, entry cacheEntry, wire []byte) error {
+	body := make([]byte, 0, 2+len(view)+2+len(key)+8+4+4+len(wire))
+	body = appendUint16(body, uint16(len(view)))
+	body = append(body, view...)
+	body = appendUint16(body, uint16(len(key)))
+	body = append(body, key...)
+	body = appendUint64(body, uint64(entry.putin.UnixNano()))
+	body = appendUint32(body, entry.ttl)
+	body = appendUint32(body, uint32(len(wire)))
+	body = append(body, wire...)
+
+	header := make([]byte, 0, 8)
+	header = appendUint32(header, crc32.ChecksumIEEE(body))
+	header = appendUint32(header, uint32(len(body)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// loadCaches restores the snapshot into the caches, skipping the entries which
+// expired more than keepExpired ago, belong to unknown views or are corrupted.
+func loadCaches(filename string, caches map[string]*dnsCache, keepExpired time.Duration) (loaded int, skipped int, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(cacheFileMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != cacheFileMagic {
+		return 0, 0, Error("Invalid cache file " + filename)
+	}
+
+	now := time.Now()
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			// EOF, or a snapshot truncated by a crash: keep what we have
+			break
+		}
+		sum := binary.BigEndian.Uint32(header[0:4])
+		length := binary.BigEndian.Uint32(header[4:8])
+		if length > dns.MaxMsgSize*4 {
+			skipped++
+			break
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			skipped++
+			break
+		}
+		if crc32.ChecksumIEEE(body) != sum {
+			skipped++
+			continue
+		}
+
+		view, key, entry, ok := parseCacheRecord(body)
+		cache := caches[view]
+		if !ok || cache == nil {
+			skipped++
+			continue
+		}
+		if cacheEntryExpired(entry, int(now.Sub(entry.putin.Add(keepExpired)).Seconds())) {
+			skipped++
+			continue
+		}
+		cache.put(key, entry)
+		loaded++
+	}
+	return loaded, skipped, nil
+}
+
+func parseCacheRecord(body []byte) (view string, key string, entry cacheEntry, ok bool) {
+	var b []byte
+	if b, body, ok = readChunk(body, 2); !ok {
+		return
+	}
+	view = string(b)
+	if b, body, ok = readChunk(body, 2); !ok {
+		return
+	}
+	key = string(b)
+	if len(body) < 12 {
+		return "", "", cacheEntry{}, false
+	}
+	entry.putin = time.Unix(0, int64(binary.BigEndian.Uint64(body[:8])))
+	entry.ttl = binary.BigEndian.Uint32(body[8:12])
+	if b, body, ok = readChunk(body[12:], 4); !ok || len(body) != 0 {
+		return "", "", cacheEntry{}, false
+	}
+	entry.reply = &dns.Msg{}
+	if err := entry.reply.Unpack(b); err != nil || len(entry.reply.Question) == 0 {
+		return "", "", cacheEntry{}, false
+	}
+	return view, key, entry, true
+}
+
+// readChunk reads a length prefixed chunk, the length being sized bytes long.
+func readChunk(data []byte, sized int) ([]byte, []byte, bool) {
+	if len(data) < sized {
+		return nil, nil, false
+	}
+	var length int
+	if sized == 2 {
+		length = int(binary.BigEndian.Uint16(data))
+	} else {
+		length = int(binary.BigEndian.Uint32(data))
+	}
+	data = data[sized:]
+	if len(data) < length {
+		return nil, nil, false
+	}
+	return data[:length], data[length:], true
+}
+
+// cacheEntryExpired returns true if the entry outlived its TTL after delta seconds.
+// The TTLs of the entries still alive are adjusted by subTTL when they are looked up.
+func cacheEntryExpired(entry cacheEntry, delta int) bool {
+	ttl, ok := entry.lifetime()
+	return !ok || int(ttl) <= delta
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+// saveCachePeriodically snapshots the caches until done is closed.
+func (s *Server) saveCachePeriodically(interval time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.saveCache()
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *Server) saveCache() {
+	l := log.WithFields(logrus.Fields{
+		"op":   "save_cache",
+		"file": s.config.CacheFile,
+	})
+	saved, err := saveCaches(s.config.CacheFile, s.caches())
+	if err != nil {
+		l.Error(err)
+		return
+	}
+	l.WithField("entries", saved).Info()
+}
+
+func (s *Server) loadCache() {
+	l := log.WithFields(logrus.Fields{
+		"op":   "load_cache",
+		"file": s.config.CacheFile,
+	})
+	var keepExpired time.Duration
+	if s.config.ServeStale {
+		keepExpired = s.config.StaleWindow
+	}
+	loaded, skipped, err := loadCaches(s.config.CacheFile, s.caches(), keepExpired)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			l.Warn(err)
+		}
+		return
+	}
+	l.WithFields(logrus.Fields{
+		"entries": loaded,
+		"skipped": skipped,
+	}).Info()
+}
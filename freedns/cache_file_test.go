@@ -0,0 +1,110 @@
+package freedns
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newCachedReply(t *testing.T, name string, ttl string) *dns.Msg {
+	res := &dns.Msg{}
+	res.SetQuestion(name, dns.TypeA)
+	res.Response = true
+	res.Answer = append(res.Answer, mustRR(t, name+" "+ttl+" IN A 1.2.3.4"))
+	return res
+}
+
+func TestCacheFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cache_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cache")
+
+	office := newDNSCache(10)
+	guest := newDNSCache(10)
+	office.set(newCachedReply(t, "fresh.example.", "300"), "udp")
+	office.put(requestToString(dns.Question{Name: "old.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, true, "udp"), cacheEntry{
+		putin: time.Now().Add(-100 * time.Second),
+		reply: newCachedReply(t, "old.example.", "300"),
+	})
+	office.put(requestToString(dns.Question{Name: "expired.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, true, "udp"), cacheEntry{
+		putin: time.Now().Add(-time.Hour),
+		reply: newCachedReply(t, "expired.example.", "300"),
+	})
+	guest.set(newCachedReply(t, "guest.example.", "300"), "tcp")
+
+	saved, err := saveCaches(filename, map[string]*dnsCache{"office": office, "guest": guest})
+	if err != nil || saved != 4 {
+		t.Fatalf("saveCaches() = %d, %v", saved, err)
+	}
+
+	restored := newDNSCache(10)
+	loaded, skipped, err := loadCaches(filename, map[string]*dnsCache{"office": restored}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the expired entry and the entry of the removed guest view are skipped
+	if loaded != 2 || skipped != 2 {
+		t.Errorf("loadCaches() loaded %d and skipped %d entries, want 2 and 2", loaded, skipped)
+	}
+
+	q := dns.Question{Name: "old.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	res, _ := restored.lookup(q, true, "udp")
+	if res == nil {
+		t.Fatalf("old.example. should be restored")
+	}
+	if ttl := res.Answer[0].Header().Ttl; ttl > 200 || ttl < 190 {
+		t.Errorf("the TTL should account for the time spent in the cache, got %d", ttl)
+	}
+	q.Name = "expired.example."
+	if res, _ := restored.lookup(q, true, "udp"); res != nil {
+		t.Errorf("expired entries should not be restored")
+	}
+}
+
+func TestCacheFileCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cache_file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cache")
+
+	c := newDNSCache(10)
+	c.set(newCachedReply(t, "a.example.", "300"), "udp")
+	if _, err := saveCaches(filename, map[string]*dnsCache{"default": c}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a record with a flipped bit, followed by a valid one and a truncated one
+	corrupted := append([]byte{}, data...)
+	corrupted[len(cacheFileMagic)+20] ^= 0xff
+	corrupted = append(corrupted, data[len(cacheFileMagic):]...)
+	corrupted = append(corrupted, data[len(cacheFileMagic):len(data)-5]...)
+	if err := ioutil.WriteFile(filename, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newDNSCache(10)
+	loaded, skipped, err := loadCaches(filename, map[string]*dnsCache{"default": restored}, 0)
+	if err != nil || loaded != 1 || skipped != 2 {
+		t.Errorf("loadCaches() = %d, %d, %v, want 1 loaded and 2 skipped", loaded, skipped, err)
+	}
+
+	if err := ioutil.WriteFile(filename, []byte("not a cache file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadCaches(filename, map[string]*dnsCache{"default": restored}, 0); err == nil {
+		t.Errorf("files without the magic should be rejected")
+	}
+}
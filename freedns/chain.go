@@ -0,0 +1,277 @@
+package freedns
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Request is a query going through the plugin chain.
+type Request struct {
+	Msg *dns.Msg
+	// ClientIP and Net ("udp" or "tcp") tell where the query comes from.
+	ClientIP net.IP
+	Net      string
+	// Listener is the name of the listener which received the query, empty for Resolver.Resolve.
+	Listener string
+	// View is the name of the view resolving the query, set by the "view" stage.
+	View string
+	// Upstream tells who answered, set by the stage answering the query.
+	Upstream string
+
+	w        dns.ResponseWriter
+	listener *listener
+	resolver *spoofingProofResolver
+	// cached is set by the "cache" stage, the "resolve" stage stores its answers to the cache then.
+	cached bool
+}
+
+// Handler is a stage of the plugin chain: it answers the request, or calls next to let
+// the following stages answer it. A nil response is not sent to the client at all.
+type Handler interface {
+	ServeDNS(ctx context.Context, req *Request, next Next) *dns.Msg
+}
+
+// Next runs the rest of the chain.
+type Next func(ctx context.Context, req *Request) *dns.Msg
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(ctx context.Context, req *Request, next Next) *dns.Msg
+
+func (f HandlerFunc) ServeDNS(ctx context.Context, req *Request, next Next) *dns.Msg {
+	return f(ctx, req, next)
+}
+
+// DefaultChain is the chain used when Config.Chain is empty, its stages are:
+//
+//	ignore:    drops the responses sent to the server
+//	acl:       refuses the clients denied by the ACL of the listener
+//	ratelimit: throttles the clients flooding the server
+//	check:     rejects the malformed requests, forwards NOTIFY and UPDATE
+//	view:      selects the view of the client
+//	log:       logs the answers
+//	rrl:       limits the identical udp responses
+//	ipset:     adds the answered addresses to the sets of Config.IPSets
+//	geoip:     sorts the answered addresses by the location of the client
+//	cache:     answers from the cache of the view
+//	resolve:   answers from the upstreams of the view
+//
+// Without the cache stage, the cache of the view is neither read nor filled.
+var DefaultChain = []string{"ignore", "acl", "ratelimit", "check", "view", "log", "rrl", "ipset", "geoip", "cache", "resolve"}
+
+// listenerStages need a client and a listener, they are skipped by Resolver.Resolve.
+var listenerStages = map[string]bool{
+	"acl":       true,
+	"ratelimit": true,
+	"view":      true,
+	"rrl":       true,
+}
+
+// inProcessStages returns the stages of the chain used by Resolver.Resolve.
+func inProcessStages(names []string) []string {
+	var stages []string
+	for _, name := range names {
+		if !listenerStages[name] {
+			stages = append(stages, name)
+		}
+	}
+	return stages
+}
+
+// buildChain returns the stages of the chain in order, looking up the names
+// in the built-in stages and in the plugins supplied by the embedders.
+func (s *Server) buildChain(names []string, plugins map[string]Handler) (Next, error) {
+	builtins := map[string]HandlerFunc{
+		"ignore":    s.serveIgnore,
+		"acl":       s.serveACL,
+		"ratelimit": s.serveRateLimit,
+		"check":     s.serveCheck,
+		"view":      s.serveView,
+		"log":       s.serveLog,
+		"rrl":       s.serveRRL,
+		"ipset":     s.serveIPSet,
+		"geoip":     s.serveGeoIP,
+		"cache":     s.serveCache,
+		"resolve":   s.serveResolve,
+	}
+	for name := range plugins {
+		if _, ok := builtins[name]; ok {
+			return nil, Error("Plugin " + name + " conflicts with the built-in stage")
+		}
+	}
+	handlers := make([]Handler, len(names))
+	for i, name := range names {
+		if h, ok := builtins[name]; ok {
+			handlers[i] = h
+		} else if h, ok := plugins[name]; ok && h != nil {
+			handlers[i] = h
+		} else {
+			return nil, Error("Unknown plugin " + name)
+		}
+	}
+
+	// the end of the chain is reached when no stage answered
+	next := Next(func(ctx context.Context, req *Request) *dns.Msg {
+		res := &dns.Msg{}
+		res.SetRcode(req.Msg, dns.RcodeServerFailure)
+		return res
+	})
+	for i := len(handlers) - 1; i >= 0; i-- {
+		h, rest := handlers[i], next
+		next = func(ctx context.Context, req *Request) *dns.Msg {
+			return h.ServeDNS(ctx, req, rest)
+		}
+	}
+	return next, nil
+}
+
+func (s *Server) serveIgnore(ctx context.Context, req *Request, next Next) *dns.Msg {
+	// never answer responses, it could start a loop between two servers
+	if req.Msg.Response {
+		s.stats.inc("ignored_responses")
+		return nil
+	}
+	return next(ctx, req)
+}
+
+func (s *Server) serveACL(ctx context.Context, req *Request, next Next) *dns.Msg {
+	if req.listener.acl.allowed(req.ClientIP) {
+		return next(ctx, req)
+	}
+	s.stats.inc("acl_refused")
+	s.stats.inc("acl_refused_" + req.Listener + "_" + req.Net)
+	log.WithFields(logrus.Fields{
+		"op":       "handle",
+		"msg":      "client refused by acl",
+		"client":   req.ClientIP,
+		"listener": req.Listener,
+		"net":      req.Net,
+	}).Warn()
+	res := &dns.Msg{}
+	res.SetRcode(req.Msg, dns.RcodeRefused)
+	return res
+}
+
+func (s *Server) serveRateLimit(ctx context.Context, req *Request, next Next) *dns.Msg {
+	if s.limiter.allowQuery(req.ClientIP) {
+		return next(ctx, req)
+	}
+	s.stats.inc("ratelimit_queries")
+	log.WithFields(logrus.Fields{
+		"op":     "handle",
+		"msg":    "query rate limited",
+		"client": req.ClientIP,
+		"net":    req.Net,
+	}).Debug()
+	// dropping is cheaper, but tcp clients can't be spoofed and deserve an answer
+	if req.Net != "tcp" {
+		return nil
+	}
+	res := &dns.Msg{}
+	res.SetRcode(req.Msg, dns.RcodeRefused)
+	return res
+}
+
+func (s *Server) serveCheck(ctx context.Context, req *Request, next Next) *dns.Msg {
+	action, rcode, forwardTo := s.checkRequest(req.Msg)
+	switch action {
+	case requestIgnore:
+		s.stats.inc("ignored_responses")
+		return nil
+	case requestReject:
+		log.WithFields(logrus.Fields{
+			"op":        "handle",
+			"msg":       "invalid request",
+			"opcode":    dns.OpcodeToString[req.Msg.Opcode],
+			"questions": len(req.Msg.Question),
+			"status":    dns.RcodeToString[rcode],
+		}).Warn()
+		res := &dns.Msg{}
+		res.SetRcode(req.Msg, rcode)
+		return res
+	case requestForward:
+		res := forward(req.Msg, req.Net, forwardTo)
+		log.WithFields(logrus.Fields{
+			"op":       "handle",
+			"opcode":   dns.OpcodeToString[req.Msg.Opcode],
+			"upstream": forwardTo,
+			"status":   dns.RcodeToString[res.Rcode],
+		}).Info()
+		return res
+	}
+	return next(ctx, req)
+}
+
+func (s *Server) serveView(ctx context.Context, req *Request, next Next) *dns.Msg {
+	if v := s.selectView(req.w, req.listener); v != nil {
+		req.resolver, req.View = v.resolver, v.name
+	}
+	return next(ctx, req)
+}
+
+func (s *Server) serveLog(ctx context.Context, req *Request, next Next) *dns.Msg {
+	res := next(ctx, req)
+	if res == nil || len(req.Msg.Question) == 0 {
+		return res
+	}
+	l := log.WithFields(logrus.Fields{
+		"op":       "handle",
+		"view":     req.View,
+		"domain":   req.Msg.Question[0].Name,
+		"type":     dns.TypeToString[req.Msg.Question[0].Qtype],
+		"upstream": req.Upstream,
+		"status":   dns.RcodeToString[res.Rcode],
+	})
+	if res.Rcode == dns.RcodeSuccess {
+		l.Info()
+	} else {
+		l.Warn()
+	}
+	return res
+}
+
+func (s *Server) serveRRL(ctx context.Context, req *Request, next Next) *dns.Msg {
+	res := next(ctx, req)
+	if res == nil || req.Net != "udp" || len(req.Msg.Question) == 0 {
+		return res
+	}
+	allowed, slip := s.limiter.allowResponse(req.ClientIP, req.Msg.Question[0].Name)
+	if allowed {
+		return res
+	}
+	if !slip {
+		s.stats.inc("ratelimit_responses_dropped")
+		return nil
+	}
+	s.stats.inc("ratelimit_responses_slipped")
+	tc := &dns.Msg{}
+	tc.SetReply(req.Msg)
+	tc.Truncated = true
+	return tc
+}
+
+func (s *Server) serveCache(ctx context.Context, req *Request, next Next) *dns.Msg {
+	req.cached = true
+	if req.resolver.cache == nil || len(req.Msg.Question) != 1 {
+		return next(ctx, req)
+	}
+	res, upstream := s.answerFromCache(ctx, req.resolver, req.Msg, req.Net)
+	if res == nil {
+		return next(ctx, req)
+	}
+	req.Upstream = upstream
+	return res
+}
+
+func (s *Server) serveResolve(ctx context.Context, req *Request, next Next) *dns.Msg {
+	if len(req.Msg.Question) != 1 {
+		res := &dns.Msg{}
+		res.SetRcode(req.Msg, dns.RcodeFormatError)
+		return res
+	}
+	res, upstream := s.resolveRequest(ctx, req.resolver, req.Msg, req.Net, req.cached)
+	req.Upstream = upstream
+	return res
+}
@@ -0,0 +1,161 @@
+package freedns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/freedns/dnstest"
+)
+
+// localRecords answers the names it knows, and passes the others to the next stages.
+type localRecords map[string]string
+
+func (records localRecords) ServeDNS(ctx context.Context, req *Request, next Next) *dns.Msg {
+	q := req.Msg.Question[0]
+	ip, ok := records[q.Name]
+	if !ok || q.Qtype != dns.TypeA {
+		return next(ctx, req)
+	}
+	res := &dns.Msg{}
+	res.SetReply(req.Msg)
+	rr, _ := dns.NewRR(q.Name + " 60 IN A " + ip)
+	res.Answer = append(res.Answer, rr)
+	req.Upstream = "local"
+	return res
+}
+
+func TestChainPlugins(t *testing.T) {
+	upstream := dnstest.NewServer(dnstest.A("5.6.7.8"))
+	defer upstream.Close()
+
+	var seen []string
+	s, err := NewServer(Config{
+		FastUpstream:   upstream.Addr,
+		CleanUpstream:  upstream.Addr,
+		PublicUpstream: upstream.Addr,
+		Listen:         "127.0.0.1:0",
+		ACL:            &ACL{Deny: []string{"192.0.2.0/24"}},
+		Chain:          []string{"audit", "ignore", "acl", "check", "view", "local", "log", "resolve"},
+		Plugins: map[string]Handler{
+			"local": localRecords{"printer.lan.": "192.168.1.9"},
+			"audit": HandlerFunc(func(ctx context.Context, req *Request, next Next) *dns.Msg {
+				seen = append(seen, req.ClientIP.String())
+				return next(ctx, req)
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, _ := newListener(Listener{Addr: "127.0.0.1:0"}, s.config.ACL, "udp")
+	query := func(client, name string) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		w := newTestResponseWriter(client, "udp")
+		s.handle(w, req, ln)
+		return w.msg
+	}
+
+	if res := query("127.0.0.1", "printer.lan."); len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "192.168.1.9" {
+		t.Errorf("the local plugin should answer, got %v", res)
+	}
+	if upstream.Queries() != 0 {
+		t.Errorf("the local answers should not reach the upstreams")
+	}
+	if res := query("127.0.0.1", "www.example."); len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "5.6.7.8" {
+		t.Errorf("the other names should be resolved, got %v", res)
+	}
+	if res := query("192.0.2.1", "printer.lan."); res.Rcode != dns.RcodeRefused {
+		t.Errorf("the acl stage should run before the local plugin, got %v", res)
+	}
+	if len(seen) != 3 || seen[2] != "192.0.2.1" {
+		t.Errorf("the audit plugin should see every query, got %v", seen)
+	}
+}
+
+func TestInvalidChain(t *testing.T) {
+	cases := []Config{
+		{Chain: []string{"acl", "nonexistent", "resolve"}},
+		{Plugins: map[string]Handler{"acl": localRecords{}}},
+	}
+	for _, cfg := range cases {
+		cfg.FastUpstream, cfg.CleanUpstream, cfg.PublicUpstream = "127.0.0.1", "127.0.0.1", "127.0.0.1"
+		if _, err := NewServer(cfg); err == nil {
+			t.Errorf("Should not create server with chain %v and plugins %v", cfg.Chain, cfg.Plugins)
+		}
+	}
+}
+
+func TestChainEnd(t *testing.T) {
+	s, err := NewServer(Config{
+		FastUpstream:   "127.0.0.1:1",
+		CleanUpstream:  "127.0.0.1:1",
+		PublicUpstream: "127.0.0.1:1",
+		Chain:          []string{"ignore", "check"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, _ := newListener(Listener{Addr: "127.0.0.1:0"}, nil, "udp")
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.", dns.TypeA)
+	w := newTestResponseWriter("127.0.0.1", "udp")
+	s.handle(w, req, ln)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("queries no stage answered should get SERVFAIL, got %v", w.msg)
+	}
+}
+
+func TestChainCacheStage(t *testing.T) {
+	upstream := dnstest.NewServer(dnstest.A("5.6.7.8"))
+	defer upstream.Close()
+
+	tests := []struct {
+		chain   []string
+		queries int
+		passed  int
+	}{
+		{nil, 1, 0},
+		{[]string{"check", "view", "resolve"}, 2, 0},
+		// the stages after the cache only see the misses
+		{[]string{"check", "view", "cache", "local", "resolve"}, 1, 1},
+	}
+	for _, tt := range tests {
+		before := upstream.Queries()
+		var passed int
+		s, err := NewServer(Config{
+			FastUpstream:   upstream.Addr,
+			CleanUpstream:  upstream.Addr,
+			PublicUpstream: upstream.Addr,
+			Listen:         "127.0.0.1:0",
+			Cache:          true,
+			Chain:          tt.chain,
+			Plugins: map[string]Handler{
+				"local": HandlerFunc(func(ctx context.Context, req *Request, next Next) *dns.Msg {
+					passed++
+					return next(ctx, req)
+				}),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, _ := newListener(Listener{Addr: "127.0.0.1:0"}, nil, "udp")
+		for i := 0; i < 2; i++ {
+			req := &dns.Msg{}
+			req.SetQuestion("www.example.", dns.TypeA)
+			w := newTestResponseWriter("127.0.0.1", "udp")
+			s.handle(w, req, ln)
+			if len(w.msg.Answer) != 1 {
+				t.Errorf("chain %v: unexpected answer %v", tt.chain, w.msg)
+			}
+		}
+		if got := upstream.Queries() - before; got != tt.queries {
+			t.Errorf("chain %v: %d upstream queries, want %d", tt.chain, got, tt.queries)
+		}
+		if passed != tt.passed {
+			t.Errorf("chain %v: the local stage saw %d queries, want %d", tt.chain, passed, tt.passed)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package freedns
+
+import (
+	"context"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// The limits of the routing on the CNAME targets.
+const (
+	// maxCNAMEReroutes is how many times the rest of a chain can be resolved again.
+	maxCNAMEReroutes = 4
+	// maxCNAMEChain is how many CNAMEs of an answer are followed.
+	maxCNAMEChain = 16
+)
+
+// resolveChain resolves the question with the upstreams of its route, then follows the CNAME chain
+// of the answer: when a target routes to other upstreams, e.g. a public name aliasing a white CDN
+// domain, the rest of the chain is resolved again by them and spliced into the answer.
+func (resolver *spoofingProofResolver) resolveChain(ctx context.Context, q dns.Question, recursion bool, net string) (*dns.Msg, string) {
+	res, upstream := resolver.resolveUpstreams(ctx, q, recursion, net)
+	if q.Qtype == dns.TypeCNAME {
+		return res, upstream
+	}
+
+	route := resolver.route(q)
+	seen := map[string]bool{strings.ToLower(q.Name): true}
+	// chain are the spliced CNAMEs, up to `name`
+	var chain []dns.RR
+	name := q.Name
+	for i := 0; i < maxCNAMEReroutes; i++ {
+		if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+			break
+		}
+		links, target := resolver.splitChain(res, name, q, route)
+		if target == "" {
+			break
+		}
+		if seen[strings.ToLower(target)] {
+			log.WithFields(logrus.Fields{
+				"op":     "cname_route",
+				"domain": q.Name,
+				"target": target,
+			}).Warn("CNAME loop")
+			break
+		}
+		seen[strings.ToLower(target)] = true
+
+		tq := dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}
+		tres, tupstream := resolver.resolveUpstreams(ctx, tq, recursion, net)
+		if tres.Rcode != dns.RcodeSuccess && tres.Rcode != dns.RcodeNameError {
+			// the answer of the first upstreams for the target can't be trusted, it may be poisoned
+			log.WithFields(logrus.Fields{
+				"op":       "cname_route",
+				"domain":   q.Name,
+				"target":   target,
+				"upstream": tupstream,
+			}).Warn("Failed to resolve the CNAME target")
+			res.Answer, res.Ns, res.Extra = nil, nil, nil
+			res.Rcode = dns.RcodeServerFailure
+			res.AuthenticatedData = false
+			return res, upstream + "," + tupstream
+		}
+		log.WithFields(logrus.Fields{
+			"op":       "cname_route",
+			"domain":   q.Name,
+			"target":   target,
+			"upstream": tupstream,
+		}).Debug()
+
+		chain = append(chain, links...)
+		res.Answer = append(append([]dns.RR{}, chain...), tres.Answer...)
+		res.Ns = tres.Ns
+		res.Extra = nil
+		res.Rcode = tres.Rcode
+		res.AuthenticatedData = res.AuthenticatedData && tres.AuthenticatedData
+		upstream += "," + tupstream
+		name, route = target, resolver.route(tq)
+	}
+	return res, upstream
+}
+
+// splitChain follows the CNAME chain of the answer from `name`, and returns the records of
+// the chain up to the first target routed to other upstreams than `route`, with that target.
+// The target is empty when the whole chain stays on the same route.
+func (resolver *spoofingProofResolver) splitChain(res *dns.Msg, name string, q dns.Question, route string) ([]dns.RR, string) {
+	var names []string
+	for i := 0; i < maxCNAMEChain; i++ {
+		var target string
+		for _, rr := range res.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target = cname.Target
+				break
+			}
+		}
+		if target == "" {
+			return nil, ""
+		}
+		names = append(names, name)
+		if resolver.route(dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}) != route {
+			return chainRecords(res, names), target
+		}
+		name = target
+	}
+	return nil, ""
+}
+
+// chainRecords returns the CNAMEs of the names, and their signatures.
+func chainRecords(res *dns.Msg, names []string) []dns.RR {
+	var chain []dns.RR
+	for _, rr := range res.Answer {
+		covered := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			covered = sig.TypeCovered
+		}
+		if covered != dns.TypeCNAME {
+			continue
+		}
+		for _, name := range names {
+			if strings.EqualFold(rr.Header().Name, name) {
+				chain = append(chain, rr)
+				break
+			}
+		}
+	}
+	return chain
+}
@@ -0,0 +1,93 @@
+package freedns
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/freedns/dnstest"
+	"github.com/xiangyu123/cosp_dns/whitedomain"
+)
+
+func TestResolveCNAMERoutes(t *testing.T) {
+	fastRRs := []string{
+		"corp.example. 3600 IN SOA ns.corp.example. admin.corp.example. 1 7200 900 1209600 60",
+		"partner.corp.example. 300 IN A 10.0.0.7",
+		"cdn.corp.example. 300 IN CNAME edge.corp.example.",
+		"edge.corp.example. 300 IN A 10.0.0.8",
+		"www.corp.example. 300 IN CNAME www.public.example.",
+		"back.corp.example. 300 IN CNAME loop.example.",
+	}
+	publicRRs := []string{
+		"example. 3600 IN SOA ns.example. admin.example. 1 7200 900 1209600 60",
+		// the public upstream has a poisoned answer for the white domain
+		"www.partner.example. 300 IN CNAME partner.corp.example.",
+		"partner.corp.example. 300 IN A 6.6.6.6",
+		"static.example. 300 IN CNAME assets.example.",
+		"assets.example. 300 IN CNAME cdn.corp.example.",
+		"www.public.example. 300 IN A 8.8.8.8",
+		"loop.example. 300 IN CNAME back.corp.example.",
+		"missing.example. 300 IN CNAME missing.corp.example.",
+	}
+	// a chain bouncing between the routes more than maxCNAMEReroutes times
+	for i := 0; i < 2*maxCNAMEReroutes; i++ {
+		n := strconv.Itoa(i)
+		publicRRs = append(publicRRs, "a"+n+".example. 300 IN CNAME b"+n+".corp.example.")
+		fastRRs = append(fastRRs, "b"+n+".corp.example. 300 IN CNAME a"+strconv.Itoa(i+1)+".example.")
+	}
+	fast := dnstest.NewServer(dnstest.Records(fastRRs...))
+	defer fast.Close()
+	clean := dnstest.NewServer(dnstest.Servfail())
+	defer clean.Close()
+	public := dnstest.NewServer(dnstest.Records(publicRRs...))
+	defer public.Close()
+
+	resolver := newSpoofingProofResolver(&staticUpstreamProvider{fast.Addr}, &staticUpstreamProvider{clean.Addr}, &staticUpstreamProvider{public.Addr})
+	resolver.whiteDomains = whitedomain.MustCompile([]string{"corp.example"})
+
+	tests := []struct {
+		name     string
+		qtype    uint16
+		rcode    int
+		cnames   int
+		ip       string
+		upstream string
+	}{
+		{"www.partner.example.", dns.TypeA, dns.RcodeSuccess, 1, "10.0.0.7", public.Addr + "," + fast.Addr},
+		{"static.example.", dns.TypeA, dns.RcodeSuccess, 3, "10.0.0.8", public.Addr + "," + fast.Addr},
+		{"www.corp.example.", dns.TypeA, dns.RcodeSuccess, 1, "8.8.8.8", fast.Addr + "," + public.Addr},
+		{"edge.corp.example.", dns.TypeA, dns.RcodeSuccess, 0, "10.0.0.8", fast.Addr},
+		{"www.public.example.", dns.TypeA, dns.RcodeSuccess, 0, "8.8.8.8", public.Addr},
+		// the CNAME queries are not followed
+		{"www.partner.example.", dns.TypeCNAME, dns.RcodeSuccess, 1, "", public.Addr},
+		// the loop ends when a target comes back
+		{"loop.example.", dns.TypeA, dns.RcodeSuccess, 2, "", public.Addr + "," + fast.Addr},
+		// the white upstreams tell the target doesn't exist
+		{"missing.example.", dns.TypeA, dns.RcodeNameError, 1, "", public.Addr + "," + fast.Addr},
+		// the chain is only rerouted maxCNAMEReroutes times
+		{"a0.example.", dns.TypeA, dns.RcodeSuccess, maxCNAMEReroutes + 1, "", ""},
+	}
+	for _, tt := range tests {
+		res, upstream := resolver.resolve(context.Background(), dns.Question{Name: tt.name, Qtype: tt.qtype, Qclass: dns.ClassINET}, true, "udp")
+		cnames, ip := 0, ""
+		for _, rr := range res.Answer {
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				cnames++
+			case *dns.A:
+				ip = rr.A.String()
+			}
+		}
+		if res.Rcode != tt.rcode || cnames != tt.cnames || ip != tt.ip || (tt.upstream != "" && upstream != tt.upstream) {
+			t.Errorf("%s %s: got %v from %s", tt.name, dns.TypeToString[tt.qtype], res, upstream)
+		}
+	}
+
+	// the poisoned answer of the first upstreams is not served when the others fail
+	fast.SetHandler(dnstest.Servfail())
+	res, upstream := resolver.resolve(context.Background(), dns.Question{Name: "www.partner.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, true, "udp")
+	if res.Rcode != dns.RcodeServerFailure || len(res.Answer) != 0 || upstream != public.Addr+","+fast.Addr+","+clean.Addr {
+		t.Errorf("unexpected answer %v from %s", res, upstream)
+	}
+}
@@ -0,0 +1,51 @@
+package freedns
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// dialTimeout is the dial timeout of dns.Client, kept by the dialers of the upstreams.
+const dialTimeout = 2 * time.Second
+
+// upstreamDialer returns the dialer of the upstream for the network ("udp" or "tcp"),
+// configured by the options of the upstream:
+//
+//	src=IP      the source address of the queries
+//	iface=NAME  binds the sockets to the interface (SO_BINDTODEVICE, linux only)
+//	mark=N      marks the packets for policy routing (SO_MARK, linux only)
+func upstreamDialer(options url.Values, network string) (*net.Dialer, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+
+	if src := options.Get("src"); src != "" {
+		ip := net.ParseIP(src)
+		if ip == nil {
+			return nil, Error("Invalid source address " + src)
+		}
+		if network == "tcp" {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		} else {
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		}
+	}
+
+	iface := options.Get("iface")
+	var mark uint32
+	if s := options.Get("mark"); s != "" {
+		m, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			return nil, Error("Invalid fwmark " + s)
+		}
+		mark = uint32(m)
+	}
+	if iface != "" || mark != 0 {
+		control, err := bindControl(iface, mark)
+		if err != nil {
+			return nil, err
+		}
+		d.Control = control
+	}
+	return d, nil
+}
@@ -0,0 +1,27 @@
+//go:build linux
+// +build linux
+
+package freedns
+
+import (
+	"syscall"
+)
+
+// bindControl sets SO_BINDTODEVICE and SO_MARK on the sockets of the dialer.
+func bindControl(iface string, mark uint32) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		controlErr := c.Control(func(fd uintptr) {
+			if iface != "" {
+				err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+			}
+			if err == nil && mark != 0 {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+			}
+		})
+		if controlErr != nil {
+			return controlErr
+		}
+		return err
+	}, nil
+}
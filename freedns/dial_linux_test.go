@@ -0,0 +1,33 @@
+package freedns
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/freedns/dnstest"
+)
+
+func TestExchangeBoundToInterface(t *testing.T) {
+	upstream := dnstest.NewServer(dnstest.A("1.2.3.4"))
+	defer upstream.Close()
+
+	q := dns.Question{Name: "www.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	for _, options := range []string{"iface=lo", "mark=0x10", "iface=lo&mark=16"} {
+		for _, network := range []string{"udp", "tcp"} {
+			res, err := naiveResolve(q, true, network, upstream.Addr+"?"+options)
+			if errors.Is(err, os.ErrPermission) {
+				t.Skipf("%s needs more privileges: %v", options, err)
+			}
+			if err != nil || len(res.Answer) != 1 {
+				t.Errorf("%s over %s: unexpected answer %v, %v", options, network, res, err)
+			}
+		}
+	}
+
+	// the upstream can't be reached through a missing interface
+	if _, err := naiveResolve(q, true, "udp", upstream.Addr+"?iface=nonexistent0"); err == nil {
+		t.Errorf("binding to a missing interface should fail")
+	}
+}
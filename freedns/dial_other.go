@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package freedns
+
+import (
+	"syscall"
+)
+
+func bindControl(iface string, mark uint32) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, Error("Binding the upstreams to an interface or a fwmark is only supported on linux")
+}
@@ -0,0 +1,72 @@
+package freedns
+
+import (
+	"net"
+	"net/url"
+	"runtime"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/freedns/dnstest"
+)
+
+func TestUpstreamDialer(t *testing.T) {
+	tests := []struct {
+		options string
+		network string
+		ok      bool
+	}{
+		{"", "udp", true},
+		{"src=127.0.0.1", "udp", true},
+		{"src=::1", "tcp", true},
+		{"src=localhost", "udp", false},
+		{"mark=0x10", "udp", runtime.GOOS == "linux"},
+		{"mark=-1", "udp", false},
+		{"iface=lo", "tcp", runtime.GOOS == "linux"},
+	}
+	for _, tt := range tests {
+		options, _ := url.ParseQuery(tt.options)
+		d, err := upstreamDialer(options, tt.network)
+		if (err == nil) != tt.ok {
+			t.Errorf("upstreamDialer(%q) error = %v, want ok = %v", tt.options, err, tt.ok)
+			continue
+		}
+		if err == nil && d.Timeout != dialTimeout {
+			t.Errorf("upstreamDialer(%q) should keep the dial timeout", tt.options)
+		}
+	}
+
+	d, _ := upstreamDialer(url.Values{"src": {"127.0.0.1"}}, "tcp")
+	if addr, ok := d.LocalAddr.(*net.TCPAddr); !ok || addr.IP.String() != "127.0.0.1" {
+		t.Errorf("the source address of tcp should be a TCPAddr, got %v", d.LocalAddr)
+	}
+}
+
+func TestExchangeFromSourceAddress(t *testing.T) {
+	clients := make(chan net.Addr, 2)
+	upstream := dnstest.NewServer(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		clients <- w.RemoteAddr()
+		dnstest.A("1.2.3.4")(w, req)
+	}))
+	defer upstream.Close()
+
+	provider, err := newUpstreamProvider(upstream.Addr + "?src=127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := dns.Question{Name: "www.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	for _, network := range []string{"udp", "tcp"} {
+		res, err := naiveResolve(q, true, network, provider.GetUpstream())
+		if err != nil || len(res.Answer) != 1 {
+			t.Fatalf("%s: unexpected answer %v, %v", network, res, err)
+		}
+		client := <-clients
+		if host, _, _ := net.SplitHostPort(client.String()); host != "127.0.0.1" {
+			t.Errorf("%s: the query should come from 127.0.0.1, got %v", network, client)
+		}
+	}
+
+	if _, err := newUpstreamProvider(upstream.Addr + "?src=nowhere"); err == nil {
+		t.Errorf("Should not create provider with an invalid source address")
+	}
+}
@@ -0,0 +1,275 @@
+package freedns
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// DNS64 synthesizes AAAA records from the A records for the IPv6-only clients behind NAT64 (RFC 6147).
+type DNS64 struct {
+	// Prefix is the NAT64 prefix embedding the IPv4 addresses (RFC 6052), its length
+	// is 32, 40, 48, 56, 64 or 96 bits. Defaults to the well-known prefix 64:ff9b::/96.
+	Prefix string
+	// ExcludeDomains are never synthesized, nor the domains under them.
+	ExcludeDomains []string
+	// ExcludeIPv4 are the A records not synthesized, e.g. the private networks NAT64 can't reach.
+	ExcludeIPv4 []string
+	// ExcludeIPv6 are the AAAA records handled as if they didn't exist, so the
+	// A records are synthesized instead. Defaults to the IPv4-mapped addresses ::ffff:0:0/96.
+	ExcludeIPv6 []string
+}
+
+// dns64NoSOATTL caps the TTL of the synthesized records when the AAAA answer has no SOA (RFC 6147 5.1.7).
+const dns64NoSOATTL = 600 * time.Second
+
+type dns64 struct {
+	prefix         *net.IPNet
+	excludeDomains []string
+	excludeIPv4    []*net.IPNet
+	excludeIPv6    []*net.IPNet
+}
+
+func newDNS64(cfg *DNS64) (*dns64, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	prefix := cfg.Prefix
+	if prefix == "" {
+		prefix = "64:ff9b::/96"
+	}
+	_, n, err := net.ParseCIDR(prefix)
+	if err != nil || n.IP.To4() != nil {
+		return nil, Error("Invalid NAT64 prefix " + prefix)
+	}
+	switch ones, _ := n.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, Error("Invalid NAT64 prefix " + prefix + ": the length should be 32, 40, 48, 56, 64 or 96")
+	}
+	// the bits 64 to 71 of the synthesized addresses must be zero (RFC 6052 2.2)
+	if n.IP[8] != 0 {
+		return nil, Error("Invalid NAT64 prefix " + prefix + ": the bits 64 to 71 should be zero")
+	}
+
+	d := &dns64{prefix: n}
+	for _, domain := range cfg.ExcludeDomains {
+		d.excludeDomains = append(d.excludeDomains, dns.Fqdn(domain))
+	}
+	if d.excludeIPv4, err = parseCIDRs(cfg.ExcludeIPv4); err != nil {
+		return nil, err
+	}
+	excludeIPv6 := cfg.ExcludeIPv6
+	if excludeIPv6 == nil {
+		excludeIPv6 = []string{"::ffff:0:0/96"}
+	}
+	if d.excludeIPv6, err = parseCIDRs(excludeIPv6); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// synthesize embeds the IPv4 address in the prefix (RFC 6052 2.2), skipping the bits 64 to 71.
+func (d *dns64) synthesize(ip4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, d.prefix.IP)
+	ones, _ := d.prefix.Mask.Size()
+	i := ones / 8
+	for _, b := range ip4.To4() {
+		if i == 8 {
+			i++
+		}
+		ip[i] = b
+		i++
+	}
+	return ip
+}
+
+// extract returns the IPv4 address embedded in a synthesized address, nil for the others.
+func (d *dns64) extract(ip net.IP) net.IP {
+	if !d.prefix.Contains(ip) {
+		return nil
+	}
+	ones, _ := d.prefix.Mask.Size()
+	ip4 := make(net.IP, 0, net.IPv4len)
+	for i := ones / 8; len(ip4) < net.IPv4len; i++ {
+		if i != 8 {
+			ip4 = append(ip4, ip[i])
+		}
+	}
+	return ip4
+}
+
+func (d *dns64) excludedDomain(name string) bool {
+	for _, domain := range d.excludeDomains {
+		if dns.IsSubDomain(domain, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// keptAAAA removes the excluded AAAA records of the answer, and tells whether any is left.
+func (d *dns64) keptAAAA(res *dns.Msg) bool {
+	kept := res.Answer[:0]
+	found := false
+	for _, rr := range res.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok {
+			if containsIP(d.excludeIPv6, aaaa.AAAA) {
+				continue
+			}
+			found = true
+		}
+		kept = append(kept, rr)
+	}
+	res.Answer = kept
+	return found
+}
+
+// synthesizeDNS64 replaces the answer `res` of an AAAA query without AAAA records by the
+// records synthesized from the A records of the domain, in place. The A records are looked up
+// with the same resolver, so the white domains are still resolved by the fast and clean upstreams.
+func (s *Server) synthesizeDNS64(ctx context.Context, resolver *spoofingProofResolver, req *dns.Msg, res *dns.Msg, net string, cached bool) {
+	d := resolver.dns64
+	q := req.Question[0]
+	if d == nil || q.Qtype != dns.TypeAAAA || q.Qclass != dns.ClassINET || d.excludedDomain(q.Name) {
+		return
+	}
+	// the validating clients synthesize themselves (RFC 6147 5.5)
+	if opt := req.IsEdns0(); opt != nil && opt.Do() && req.CheckingDisabled {
+		return
+	}
+	// any error but NXDOMAIN is handled as an empty answer (RFC 6147 5.1.2)
+	if res.Rcode == dns.RcodeNameError || (res.Rcode == dns.RcodeSuccess && d.keptAAAA(res)) {
+		return
+	}
+
+	// the A records as answered, the address filter of an IPv6-only network would remove them
+	a, _ := s.fetch(ctx, resolver, dns.Question{Name: q.Name, Qtype: dns.TypeA, Qclass: dns.ClassINET}, req.RecursionDesired, net, cached)
+	if a.Rcode != dns.RcodeSuccess {
+		return
+	}
+
+	maxTTL := uint32(dns64NoSOATTL.Seconds())
+	if ttl, ok := negativeTTL(res, 24*time.Hour); ok && res.Rcode == dns.RcodeSuccess {
+		maxTTL = ttl
+	}
+	var answer []dns.RR
+	synthesized := 0
+	for _, rr := range a.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			answer = append(answer, rr)
+		case *dns.A:
+			if containsIP(d.excludeIPv4, rr.A) {
+				continue
+			}
+			ttl := rr.Hdr.Ttl
+			if ttl > maxTTL {
+				ttl = maxTTL
+			}
+			answer = append(answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: rr.Hdr.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+				AAAA: d.synthesize(rr.A),
+			})
+			synthesized++
+		}
+	}
+	if synthesized == 0 {
+		return
+	}
+
+	res.Rcode = dns.RcodeSuccess
+	res.Answer = answer
+	res.Ns = nil
+	// keep the OPT record of the client only
+	var extra []dns.RR
+	for _, rr := range res.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	res.Extra = extra
+	// the synthesized records can't be validated
+	res.AuthenticatedData = false
+
+	s.stats.inc("dns64_synthesized")
+	log.WithFields(logrus.Fields{
+		"op":      "dns64",
+		"domain":  q.Name,
+		"records": synthesized,
+	}).Debug()
+}
+
+// lookupDNS64PTR answers the reverse lookups of the synthesized addresses with a CNAME to
+// the reverse name of the embedded IPv4 address, followed by its answer (RFC 6147 5.3.1).
+// It returns nil for the other questions.
+func (s *Server) lookupDNS64PTR(ctx context.Context, resolver *spoofingProofResolver, req *dns.Msg, net string, cached bool) (*dns.Msg, string) {
+	q := req.Question[0]
+	if resolver.dns64 == nil || q.Qtype != dns.TypePTR {
+		return nil, ""
+	}
+	ip := reverseIPv6(q.Name)
+	if ip == nil {
+		return nil, ""
+	}
+	ip4 := resolver.dns64.extract(ip)
+	if ip4 == nil {
+		return nil, ""
+	}
+	target, err := dns.ReverseAddr(ip4.String())
+	if err != nil {
+		return nil, ""
+	}
+
+	probe := &dns.Msg{}
+	probe.SetQuestion(target, dns.TypePTR)
+	probe.RecursionDesired = req.RecursionDesired
+	ptr, upstream := s.lookupWith(ctx, resolver, probe, net, cached)
+
+	res := &dns.Msg{}
+	res.SetRcode(req, ptr.Rcode)
+	if ptr.Rcode == dns.RcodeSuccess || ptr.Rcode == dns.RcodeNameError {
+		ttl := uint32(dns64NoSOATTL.Seconds())
+		for _, rr := range ptr.Answer {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		res.Answer = append([]dns.RR{&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+			Target: target,
+		}}, ptr.Answer...)
+		res.Ns = ptr.Ns
+	}
+	s.stats.inc("dns64_ptr")
+	return res, upstream
+}
+
+// reverseIPv6 parses the full reverse name of an IPv6 address, e.g. "1.0.0.0.[...].ip6.arpa.".
+func reverseIPv6(name string) net.IP {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".ip6.arpa.") {
+		return nil
+	}
+	labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+	if len(labels) != 2*net.IPv6len {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	for i, label := range labels {
+		nibble, err := strconv.ParseUint(label, 16, 8)
+		if err != nil || len(label) != 1 {
+			return nil
+		}
+		// the labels start with the lowest nibble
+		j := len(labels) - 1 - i
+		ip[j/2] |= byte(nibble) << (4 * uint(1-j%2))
+	}
+	return ip
+}
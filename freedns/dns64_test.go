@@ -0,0 +1,248 @@
+package freedns
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/freedns/dnstest"
+	"github.com/xiangyu123/cosp_dns/whitedomain"
+)
+
+func TestDNS64Synthesize(t *testing.T) {
+	// the examples of RFC 6052 2.4
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+	}
+	for _, tt := range tests {
+		d, err := newDNS64(&DNS64{Prefix: tt.prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := d.synthesize(net.ParseIP("192.0.2.33"))
+		if !ip.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("synthesize with %s = %s, want %s", tt.prefix, ip, tt.want)
+		}
+		if ip4 := d.extract(ip); !ip4.Equal(net.ParseIP("192.0.2.33")) {
+			t.Errorf("extract(%s) = %s", ip, ip4)
+		}
+	}
+
+	d, _ := newDNS64(&DNS64{})
+	if ip := d.synthesize(net.ParseIP("192.0.2.33")); !ip.Equal(net.ParseIP("64:ff9b::192.0.2.33")) {
+		t.Errorf("the default prefix should be 64:ff9b::/96, got %s", ip)
+	}
+	if ip4 := d.extract(net.ParseIP("2001:db8::1")); ip4 != nil {
+		t.Errorf("the addresses out of the prefix should not be extracted, got %s", ip4)
+	}
+}
+
+func TestInvalidDNS64(t *testing.T) {
+	configs := []*DNS64{
+		{Prefix: "64:ff9b::"},
+		{Prefix: "64:ff9b::/80"},
+		{Prefix: "10.0.0.0/8"},
+		{Prefix: "2001:db8:122:344:ff00::/96"},
+		{ExcludeIPv4: []string{"10.0.0.0/33"}},
+	}
+	for _, cfg := range configs {
+		if _, err := newDNS64(cfg); err == nil {
+			t.Errorf("Should not enable DNS64 with %+v", cfg)
+		}
+	}
+}
+
+func TestReverseIPv6(t *testing.T) {
+	name, _ := dns.ReverseAddr("64:ff9b::c000:221")
+	if ip := reverseIPv6(name); !ip.Equal(net.ParseIP("64:ff9b::c000:221")) {
+		t.Errorf("reverseIPv6(%s) = %s", name, ip)
+	}
+	for _, name := range []string{"1.0.0.ip6.arpa.", "33.2.0.192.in-addr.arpa.", "www.example."} {
+		if ip := reverseIPv6(name); ip != nil {
+			t.Errorf("reverseIPv6(%s) = %s, want nil", name, ip)
+		}
+	}
+}
+
+func TestDNS64(t *testing.T) {
+	fast := dnstest.NewServer(dnstest.Records(
+		"corp.example. 3600 IN SOA ns.corp.example. admin.corp.example. 1 7200 900 1209600 60",
+		"intranet.corp.example. 300 IN A 192.0.2.10",
+		// the reverse lookups are resolved by the fast upstream
+		"33.2.0.192.in-addr.arpa. 300 IN PTR v4only.example.",
+	))
+	defer fast.Close()
+	public := dnstest.NewServer(dnstest.Records(
+		"example. 3600 IN SOA ns.example. admin.example. 1 7200 900 1209600 60",
+		"v4only.example. 300 IN A 192.0.2.33",
+		"v4only.example. 300 IN A 192.0.2.34",
+		"dual.example. 300 IN A 192.0.2.1",
+		"dual.example. 300 IN AAAA 2001:db8::1",
+		"mapped.example. 300 IN A 192.0.2.2",
+		"mapped.example. 300 IN AAAA ::ffff:192.0.2.2",
+		"private.example. 300 IN A 10.0.0.1",
+		"local.example. 300 IN A 192.0.2.3",
+		"alias.example. 300 IN CNAME v4only.example.",
+		"long.example. 86400 IN A 192.0.2.4",
+	))
+	defer public.Close()
+
+	s, err := NewServer(Config{
+		FastUpstream:   fast.Addr,
+		CleanUpstream:  fast.Addr,
+		PublicUpstream: public.Addr,
+		Listen:         "127.0.0.1:0",
+		DNS64: &DNS64{
+			ExcludeDomains: []string{"local.example"},
+			ExcludeIPv4:    []string{"10.0.0.0/8"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	s.resolver.whiteDomains = whitedomain.MustCompile([]string{"corp.example"})
+
+	tests := []struct {
+		name  string
+		rcode int
+		want  []string
+	}{
+		{"v4only.example.", dns.RcodeSuccess, []string{"64:ff9b::c000:221", "64:ff9b::c000:222"}},
+		{"dual.example.", dns.RcodeSuccess, []string{"2001:db8::1"}},
+		{"mapped.example.", dns.RcodeSuccess, []string{"64:ff9b::c000:202"}},
+		{"private.example.", dns.RcodeSuccess, nil},
+		{"local.example.", dns.RcodeSuccess, nil},
+		{"nx.example.", dns.RcodeNameError, nil},
+		{"alias.example.", dns.RcodeSuccess, []string{"64:ff9b::c000:221", "64:ff9b::c000:222"}},
+		// the white domains are resolved by the fast upstream
+		{"intranet.corp.example.", dns.RcodeSuccess, []string{"64:ff9b::c000:20a"}},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(tt.name, dns.TypeAAAA)
+		res, _ := s.lookup(s.resolver, req, "udp")
+		var got []string
+		for _, rr := range res.Answer {
+			if aaaa, ok := rr.(*dns.AAAA); ok {
+				got = append(got, aaaa.AAAA.String())
+			}
+		}
+		if res.Rcode != tt.rcode || len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, res, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	}
+
+	// the TTL of the synthesized records is capped by the negative TTL of the AAAA answer
+	req := &dns.Msg{}
+	req.SetQuestion("long.example.", dns.TypeAAAA)
+	if res, _ := s.lookup(s.resolver, req, "udp"); len(res.Answer) != 1 || res.Answer[0].Header().Ttl != 60 {
+		t.Errorf("unexpected TTL in %v", res)
+	}
+
+	// the validating clients synthesize themselves
+	req = &dns.Msg{}
+	req.SetQuestion("v4only.example.", dns.TypeAAAA)
+	req.SetEdns0(4096, true)
+	req.CheckingDisabled = true
+	if res, _ := s.lookup(s.resolver, req, "udp"); len(res.Answer) != 0 {
+		t.Errorf("should not synthesize for the validating clients, got %v", res)
+	}
+
+	name, _ := dns.ReverseAddr("64:ff9b::c000:221")
+	req = &dns.Msg{}
+	req.SetQuestion(name, dns.TypePTR)
+	res, _ := s.lookup(s.resolver, req, "udp")
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 2 {
+		t.Fatalf("unexpected reverse answer %v", res)
+	}
+	if cname, ok := res.Answer[0].(*dns.CNAME); !ok || cname.Hdr.Name != name || cname.Target != "33.2.0.192.in-addr.arpa." {
+		t.Errorf("the reverse lookup should be a CNAME to the IPv4 reverse name, got %v", res.Answer[0])
+	}
+	if ptr, ok := res.Answer[1].(*dns.PTR); !ok || ptr.Ptr != "v4only.example." {
+		t.Errorf("unexpected PTR %v", res.Answer[1])
+	}
+	if res.Question[0].Name != name {
+		t.Errorf("the question should be kept, got %v", res.Question)
+	}
+
+	stats := s.stats.snapshot()
+	if stats["dns64_synthesized"] != 5 || stats["dns64_ptr"] != 1 {
+		t.Errorf("unexpected stats %v", stats)
+	}
+
+	// the A filter of the IPv6-only networks doesn't hide the A records from the synthesis
+	s.resolver.addressFilter = FilterA
+	req = &dns.Msg{}
+	req.SetQuestion("v4only.example.", dns.TypeAAAA)
+	if res, _ := s.lookup(s.resolver, req, "udp"); len(res.Answer) != 2 {
+		t.Errorf("should synthesize with the A filter, got %v", res)
+	}
+	req.Question[0].Qtype = dns.TypeA
+	if res, _ := s.lookup(s.resolver, req, "udp"); len(res.Answer) != 0 {
+		t.Errorf("the A records should still be filtered, got %v", res)
+	}
+
+	// the OPT record of the client is kept
+	req = &dns.Msg{}
+	req.SetQuestion("v4only.example.", dns.TypeAAAA)
+	res = &dns.Msg{}
+	res.SetReply(req)
+	res.SetEdns0(1232, false)
+	res.Extra = append(res.Extra, mustRR(t, "ns.example. 300 IN A 192.0.2.53"))
+	s.synthesizeDNS64(context.Background(), s.resolver, req, res, "udp", true)
+	if len(res.Answer) != 2 || len(res.Extra) != 1 || res.IsEdns0() == nil {
+		t.Errorf("the synthesized answer should keep the OPT record only, got %v", res)
+	}
+}
+
+func TestViewDNS64(t *testing.T) {
+	upstream := dnstest.NewServer(dnstest.Records(
+		"example. 3600 IN SOA ns.example. admin.example. 1 7200 900 1209600 60",
+		"www.example. 300 IN A 192.0.2.33",
+	))
+	defer upstream.Close()
+
+	s, err := NewServer(Config{
+		FastUpstream:   upstream.Addr,
+		CleanUpstream:  upstream.Addr,
+		PublicUpstream: upstream.Addr,
+		Listen:         "127.0.0.1:0",
+		Views: []View{
+			{Name: "v6only", ClientCIDRs: []string{"2001:db8::/32"}, DNS64: &DNS64{Prefix: "2001:db8:64::/96"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	for _, tt := range []struct {
+		resolver *spoofingProofResolver
+		answers  int
+	}{
+		{s.resolver, 0},
+		{s.views[0].resolver, 1},
+	} {
+		req := &dns.Msg{}
+		req.SetQuestion("www.example.", dns.TypeAAAA)
+		if res, _ := s.lookup(tt.resolver, req, "udp"); len(res.Answer) != tt.answers {
+			t.Errorf("got %v, want %d answers", res, tt.answers)
+		}
+	}
+}
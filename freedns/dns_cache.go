@@ -1,6 +1,7 @@
 package freedns
 
 import (
+	"sync"
 	"time"
 
 	goc "github.com/louchenyao/golang-cache"
@@ -10,40 +11,168 @@ import (
 type cacheEntry struct {
 	putin time.Time
 	reply *dns.Msg
+	// ttl overrides the lifetime given by the records of the reply, e.g. for SERVFAIL
+	// or when the TTL policy keeps the entry longer than the TTL the clients see.
+	ttl uint32
+}
+
+// lifetime returns the TTL of the entry.
+func (entry cacheEntry) lifetime() (uint32, bool) {
+	if entry.ttl > 0 {
+		return entry.ttl, true
+	}
+	return minTTL(entry.reply)
 }
 
 type dnsCache struct {
 	backend *goc.Cache
+	maxCap  int
+
+	// keys tracks what may be in the backend, which can't be iterated,
+	// with the number of hits since the entry was set.
+	// Keys evicted by the backend are pruned lazily.
+	keys      map[string]uint32
+	keysMutex sync.Mutex
 }
 
 func newDNSCache(maxCap int) *dnsCache {
 	c, _ := goc.NewCache("lru", maxCap)
 	return &dnsCache{
 		backend: c,
+		maxCap:  maxCap,
+		keys:    make(map[string]uint32),
 	}
 }
 
 func (c *dnsCache) set(res *dns.Msg, net string) {
 	key := requestToString(res.Question[0], res.RecursionDesired, net)
 
-	c.backend.Set(key, cacheEntry{
+	c.put(key, cacheEntry{
 		putin: time.Now(),
 		reply: res.Copy(), // .Copy() is mandatory
 	})
 }
 
+func (c *dnsCache) put(key string, entry cacheEntry) {
+	c.backend.Set(key, entry)
+
+	c.keysMutex.Lock()
+	c.keys[key] = 0
+	tooMany := len(c.keys) > 2*c.maxCap
+	c.keysMutex.Unlock()
+
+	if tooMany {
+		c.entries()
+	}
+}
+
+// entries returns all the entries still in the cache, keyed by request.
+func (c *dnsCache) entries() map[string]cacheEntry {
+	c.keysMutex.Lock()
+	keys := make([]string, 0, len(c.keys))
+	for key := range c.keys {
+		keys = append(keys, key)
+	}
+	c.keysMutex.Unlock()
+
+	entries := make(map[string]cacheEntry, len(keys))
+	var evicted []string
+	for _, key := range keys {
+		if ci, ok := c.backend.Get(key); ok {
+			entries[key] = ci.(cacheEntry)
+		} else {
+			evicted = append(evicted, key)
+		}
+	}
+
+	c.keysMutex.Lock()
+	for _, key := range evicted {
+		delete(c.keys, key)
+	}
+	c.keysMutex.Unlock()
+
+	return entries
+}
+
 func (c *dnsCache) lookup(q dns.Question, recursion bool, net string) (*dns.Msg, bool) {
+	res, needUpdate, _ := c.lookupStale(q, recursion, net)
+	return res, needUpdate
+}
+
+// lookupStale is lookup, which also returns for how long the entry has been expired.
+func (c *dnsCache) lookupStale(q dns.Question, recursion bool, net string) (*dns.Msg, bool, time.Duration) {
 	key := requestToString(q, recursion, net)
 	ci, ok := c.backend.Get(key)
 	if ok {
+		c.keysMutex.Lock()
+		c.keys[key]++
+		c.keysMutex.Unlock()
+
 		entry := ci.(cacheEntry)
 		res := entry.reply.Copy() // .Copy() is mandatory
-		delta := time.Now().Sub(entry.putin).Seconds()
-		needUpdate := subTTL(res, int(delta))
+		age := time.Now().Sub(entry.putin)
+		needUpdate := subTTL(res, int(age.Seconds()))
+
+		var staleFor time.Duration
+		if ttl, ok := entry.lifetime(); ok {
+			staleFor = age - time.Duration(ttl)*time.Second
+		}
+		if entry.ttl > 0 {
+			// the same 3 seconds as subTTL, but on the lifetime of the entry
+			needUpdate = staleFor > -3*time.Second
+		}
+		return res, needUpdate, staleFor
+	}
+	return nil, true, 0
+}
+
+// hot returns the keys looked up at least minHits times since they were set.
+func (c *dnsCache) hot(minHits uint32) []string {
+	c.keysMutex.Lock()
+	defer c.keysMutex.Unlock()
+	var keys []string
+	for key, hits := range c.keys {
+		if hits >= minHits {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
 
-		return res, needUpdate
+// resetHits forgets the hits of the key, it has to earn its popularity again.
+func (c *dnsCache) resetHits(key string) {
+	c.keysMutex.Lock()
+	if _, ok := c.keys[key]; ok {
+		c.keys[key] = 0
+	}
+	c.keysMutex.Unlock()
+}
+
+func (c *dnsCache) get(key string) (cacheEntry, bool) {
+	ci, ok := c.backend.Get(key)
+	if !ok {
+		return cacheEntry{}, false
+	}
+	return ci.(cacheEntry), true
+}
+
+// minTTL returns the smallest TTL of the answer section, or of the authority
+// section for answers without records.
+func minTTL(res *dns.Msg) (uint32, bool) {
+	rrs := res.Answer
+	if len(rrs) == 0 {
+		rrs = res.Ns
+	}
+	if len(rrs) == 0 {
+		return 0, false
+	}
+	ttl := rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
 	}
-	return nil, true
+	return ttl, true
 }
 
 // requestToString generates a string that uniquely identifies the request.
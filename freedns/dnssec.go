@@ -0,0 +1,564 @@
+package freedns
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// rootTrustAnchor is the DS record of the root zone KSK-2017 (key tag 20326).
+const rootTrustAnchor = ". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+// maxKeysCacheTTL bounds how long a validated DNSKEY set or an insecure
+// delegation is trusted without being fetched again.
+const maxKeysCacheTTL = 3600
+
+type dnssecStatus int
+
+const (
+	// dnssecInsecure means the answer comes from a zone which is provably unsigned.
+	dnssecInsecure dnssecStatus = iota
+	// dnssecSecure means every RRset of the answer is signed by a key chained to the trust anchor.
+	dnssecSecure
+	// dnssecBogus means the answer should have been signed but the signatures don't validate.
+	dnssecBogus
+)
+
+func (status dnssecStatus) String() string {
+	switch status {
+	case dnssecSecure:
+		return "secure"
+	case dnssecBogus:
+		return "bogus"
+	default:
+		return "insecure"
+	}
+}
+
+type validatedKeys struct {
+	keys   []*dns.DNSKEY
+	expire time.Time
+}
+
+// dnssecValidator validates the answers returned by the upstreams, starting from the
+// trust anchors and fetching the DNSKEY and DS records along the way through the upstreams.
+type dnssecValidator struct {
+	anchors   []*dns.DS
+	providers []upstreamProvider
+
+	mutex    sync.Mutex
+	keys     map[string]validatedKeys
+	insecure map[string]time.Time
+
+	// recorder saves the exchanges of the validator, nil disables recording.
+	recorder *recorder
+}
+
+func rootTrustAnchors() []*dns.DS {
+	rr, err := dns.NewRR(rootTrustAnchor)
+	if err != nil {
+		panic(err)
+	}
+	return []*dns.DS{rr.(*dns.DS)}
+}
+
+// newDNSSECValidator creates a validator which fetches the chain of trust
+// from the providers, the first one responding wins.
+func newDNSSECValidator(anchors []*dns.DS, providers ...upstreamProvider) *dnssecValidator {
+	return &dnssecValidator{
+		anchors:   anchors,
+		providers: providers,
+		keys:      make(map[string]validatedKeys),
+		insecure:  make(map[string]time.Time),
+	}
+}
+
+// resolve is naiveResolve with DNSSEC validation. Bogus answers are turned into SERVFAIL,
+// secure ones get the AD bit set.
+func (v *dnssecValidator) resolve(ctx context.Context, q dns.Question, recursion bool, net string, upstream string) (*dns.Msg, error) {
+	r := newDNSSECRequest(q, recursion)
+	res, err := v.recorder.exchange(ctx, r, net, upstream)
+	if err != nil || res == nil {
+		return res, err
+	}
+
+	status, err := v.validate(res)
+	l := log.WithFields(logrus.Fields{
+		"op":       "dnssec_validate",
+		"upstream": redactUpstream(upstream),
+		"domain":   q.Name,
+		"type":     dns.TypeToString[q.Qtype],
+		"status":   status.String(),
+	})
+	switch status {
+	case dnssecSecure:
+		l.Debug()
+		res.AuthenticatedData = true
+	case dnssecInsecure:
+		l.Debug()
+		res.AuthenticatedData = false
+	default:
+		l.Warn(err)
+		fail := &dns.Msg{}
+		fail.SetRcode(r, dns.RcodeServerFailure)
+		return fail, err
+	}
+	return res, nil
+}
+
+func newDNSSECRequest(q dns.Question, recursion bool) *dns.Msg {
+	r := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:               dns.Id(),
+			RecursionDesired: recursion,
+			// we validate ourselves, ask the upstream to hand us bogus data as well
+			CheckingDisabled: true,
+		},
+		Question: []dns.Question{q},
+	}
+	r.SetEdns0(4096, true)
+	return r
+}
+
+// query fetches the records needed by validation from the upstreams.
+// The keys are cached for all the clients, so one of them giving up doesn't cancel the query.
+func (v *dnssecValidator) query(name string, qtype uint16) (*dns.Msg, error) {
+	q := dns.Question{Name: dns.Fqdn(name), Qtype: qtype, Qclass: dns.ClassINET}
+	var lastErr error = Error("dnssec: no upstream to query " + name)
+	for _, provider := range v.providers {
+		upstream := provider.GetUpstream()
+		res, err := v.recorder.exchange(context.Background(), newDNSSECRequest(q, true), "udp", upstream)
+		if err == nil && res != nil && res.Truncated {
+			res, err = v.recorder.exchange(context.Background(), newDNSSECRequest(q, true), "tcp", upstream)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if res == nil || (res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError) {
+			lastErr = Error("dnssec: failed to query " + dns.TypeToString[qtype] + " " + name)
+			continue
+		}
+		return res, nil
+	}
+	return nil, lastErr
+}
+
+// validate returns the DNSSEC status of the upstream response `res`.
+func (v *dnssecValidator) validate(res *dns.Msg) (dnssecStatus, error) {
+	q := res.Question[0]
+
+	section := res.Answer
+	if !containsType(res.Answer, q.Qtype) && !containsType(res.Answer, dns.TypeCNAME) {
+		// NXDOMAIN or NODATA, the proof of non-existence lives in the authority section
+		section = append(append([]dns.RR{}, res.Answer...), res.Ns...)
+	}
+	rrsets, sigs := splitRRsets(section)
+
+	if len(sigs) == 0 {
+		if v.provablyInsecure(q.Name) {
+			return dnssecInsecure, nil
+		}
+		return dnssecBogus, Error("dnssec: missing signatures for " + q.Name)
+	}
+
+	status := dnssecSecure
+	for _, rrset := range rrsets {
+		name := rrset[0].Header().Name
+		covering := sigs[rrsetKey(name, rrset[0].Header().Rrtype)]
+		if len(covering) == 0 {
+			if v.provablyInsecure(name) {
+				status = dnssecInsecure
+				continue
+			}
+			return dnssecBogus, Error("dnssec: missing signatures for " + name)
+		}
+		if err := v.verifyRRset(rrset, covering); err != nil {
+			return dnssecBogus, err
+		}
+	}
+
+	if status == dnssecSecure && len(res.Answer) == 0 {
+		if err := checkDenial(res, section); err != nil {
+			return dnssecBogus, err
+		}
+	}
+	return status, nil
+}
+
+// verifyRRset succeeds if any of the signatures validates the rrset with a trusted key.
+func (v *dnssecValidator) verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG) error {
+	if len(sigs) == 0 {
+		return Error("dnssec: missing signatures for " + rrset[0].Header().Name)
+	}
+	var lastErr error
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, rrset[0].Header().Name) {
+			lastErr = Error("dnssec: " + sig.SignerName + " cannot sign " + rrset[0].Header().Name)
+			continue
+		}
+		keys, err := v.zoneKeys(sig.SignerName)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := verifyWithKeys(rrset, sig, keys); err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+func verifyWithKeys(rrset []dns.RR, sig *dns.RRSIG, keys []*dns.DNSKEY) error {
+	if !sig.ValidityPeriod(time.Now()) {
+		return Error("dnssec: signature of " + sig.Hdr.Name + " expired")
+	}
+	var lastErr error = Error("dnssec: no key of " + sig.SignerName + " signed " + sig.Hdr.Name)
+	for _, key := range keys {
+		if key.Algorithm != sig.Algorithm || key.KeyTag() != sig.KeyTag {
+			continue
+		}
+		if err := sig.Verify(key, rrset); err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// zoneKeys returns the DNSKEY set of the zone after validating it
+// against the trust anchors, or against the DS records of the parent zone.
+func (v *dnssecValidator) zoneKeys(zone string) ([]*dns.DNSKEY, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+
+	v.mutex.Lock()
+	cached, ok := v.keys[zone]
+	v.mutex.Unlock()
+	if ok && time.Now().Before(cached.expire) {
+		return cached.keys, nil
+	}
+
+	dss, ttl, err := v.trustedDS(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	rrsets, sigs := splitRRsets(res.Answer)
+	var keySet []dns.RR
+	for _, rrset := range rrsets {
+		if rrset[0].Header().Rrtype == dns.TypeDNSKEY && strings.EqualFold(rrset[0].Header().Name, zone) {
+			keySet = rrset
+		}
+	}
+	if len(keySet) == 0 {
+		return nil, Error("dnssec: no DNSKEY for " + zone)
+	}
+
+	// the key set must be signed by one of the keys the DS records point to
+	var anchored []*dns.DNSKEY
+	for _, rr := range keySet {
+		key := rr.(*dns.DNSKEY)
+		for _, ds := range dss {
+			if matchDS(key, ds) {
+				anchored = append(anchored, key)
+				break
+			}
+		}
+	}
+	if len(anchored) == 0 {
+		return nil, Error("dnssec: no DNSKEY of " + zone + " matches its DS")
+	}
+	verified := false
+	for _, sig := range sigs[rrsetKey(zone, dns.TypeDNSKEY)] {
+		if verifyWithKeys(keySet, sig, anchored) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, Error("dnssec: DNSKEY of " + zone + " is not self-signed")
+	}
+
+	keys := make([]*dns.DNSKEY, 0, len(keySet))
+	for _, rr := range keySet {
+		if ttl > rr.Header().Ttl {
+			ttl = rr.Header().Ttl
+		}
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	v.mutex.Lock()
+	v.keys[zone] = validatedKeys{keys: keys, expire: time.Now().Add(time.Duration(ttl) * time.Second)}
+	v.mutex.Unlock()
+
+	return keys, nil
+}
+
+// trustedDS returns the validated DS records of the zone and their ttl.
+func (v *dnssecValidator) trustedDS(zone string) ([]*dns.DS, uint32, error) {
+	var anchors []*dns.DS
+	for _, ds := range v.anchors {
+		if strings.EqualFold(ds.Hdr.Name, zone) {
+			anchors = append(anchors, ds)
+		}
+	}
+	if len(anchors) > 0 {
+		return anchors, maxKeysCacheTTL, nil
+	}
+	if zone == "." {
+		return nil, 0, Error("dnssec: no trust anchor for the root zone")
+	}
+
+	res, err := v.query(zone, dns.TypeDS)
+	if err != nil {
+		return nil, 0, err
+	}
+	rrsets, sigs := splitRRsets(res.Answer)
+	for _, rrset := range rrsets {
+		if rrset[0].Header().Rrtype != dns.TypeDS || !strings.EqualFold(rrset[0].Header().Name, zone) {
+			continue
+		}
+		covering := sigs[rrsetKey(zone, dns.TypeDS)]
+		for _, sig := range covering {
+			// DS records live in the parent zone
+			if dns.CountLabel(sig.SignerName) >= dns.CountLabel(zone) {
+				return nil, 0, Error("dnssec: DS of " + zone + " not signed by its parent")
+			}
+		}
+		if err := v.verifyRRset(rrset, covering); err != nil {
+			return nil, 0, err
+		}
+		dss := make([]*dns.DS, 0, len(rrset))
+		ttl := uint32(maxKeysCacheTTL)
+		for _, rr := range rrset {
+			dss = append(dss, rr.(*dns.DS))
+			if ttl > rr.Header().Ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		return dss, ttl, nil
+	}
+	return nil, 0, Error("dnssec: no DS for " + zone)
+}
+
+func matchDS(key *dns.DNSKEY, ds *dns.DS) bool {
+	if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+		return false
+	}
+	computed := key.ToDS(ds.DigestType)
+	return computed != nil && strings.EqualFold(computed.Digest, ds.Digest)
+}
+
+// provablyInsecure walks down from the root and returns true if a signed
+// zone on the way proves that `name` belongs to an unsigned delegation,
+// or that it doesn't exist in the public namespace at all (e.g. internal names).
+func (v *dnssecValidator) provablyInsecure(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	v.mutex.Lock()
+	expire, ok := v.insecure[name]
+	v.mutex.Unlock()
+	if ok && time.Now().Before(expire) {
+		return true
+	}
+
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child := dns.Fqdn(strings.Join(labels[i:], "."))
+		res, err := v.query(child, dns.TypeDS)
+		if err != nil {
+			return false
+		}
+		if containsType(res.Answer, dns.TypeDS) {
+			// a signed delegation, its DS records are validated by zoneKeys later on
+			continue
+		}
+
+		// every rrset must be signed, an unsigned NSEC could claim any delegation is insecure
+		rrsets, sigs := splitRRsets(res.Ns)
+		for _, rrset := range rrsets {
+			covering := sigs[rrsetKey(rrset[0].Header().Name, rrset[0].Header().Rrtype)]
+			if len(covering) == 0 {
+				return false
+			}
+			if err := v.verifyRRset(rrset, covering); err != nil {
+				return false
+			}
+		}
+
+		insecure := false
+		if res.Rcode == dns.RcodeNameError {
+			insecure = checkDenial(res, res.Ns) == nil
+		} else {
+			insecure = isInsecureDelegation(child, res.Ns)
+		}
+		if insecure {
+			v.mutex.Lock()
+			v.insecure[name] = time.Now().Add(maxKeysCacheTTL * time.Second)
+			v.mutex.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// isInsecureDelegation checks whether the (validated) denial records prove
+// that `name` is a zone cut without DS records.
+func isInsecureDelegation(name string, ns []dns.RR) bool {
+	for _, rr := range ns {
+		switch denial := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(denial.Hdr.Name, name) {
+				return hasType(denial.TypeBitMap, dns.TypeNS) && !hasType(denial.TypeBitMap, dns.TypeDS)
+			}
+		case *dns.NSEC3:
+			if denial.Match(name) {
+				return hasType(denial.TypeBitMap, dns.TypeNS) && !hasType(denial.TypeBitMap, dns.TypeDS)
+			}
+			// opt-out spans may contain unsigned delegations
+			if denial.Cover(name) && denial.Flags&1 == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkDenial checks that the NSEC/NSEC3 records of a negative response
+// actually deny the question, and are not replayed from another name.
+func checkDenial(res *dns.Msg, section []dns.RR) error {
+	q := res.Question[0]
+	for _, rr := range section {
+		switch denial := rr.(type) {
+		case *dns.NSEC:
+			if res.Rcode == dns.RcodeNameError && canonicalCover(denial.Hdr.Name, denial.NextDomain, q.Name) {
+				return nil
+			}
+			if res.Rcode == dns.RcodeSuccess && strings.EqualFold(denial.Hdr.Name, q.Name) && !hasType(denial.TypeBitMap, q.Qtype) {
+				return nil
+			}
+		case *dns.NSEC3:
+			if res.Rcode == dns.RcodeNameError && denial.Cover(q.Name) {
+				return nil
+			}
+			if res.Rcode == dns.RcodeSuccess && denial.Match(q.Name) && !hasType(denial.TypeBitMap, q.Qtype) {
+				return nil
+			}
+		}
+	}
+	return Error("dnssec: no proof of non-existence for " + q.Name)
+}
+
+// canonicalCover returns true if name sorts between owner and next in the canonical DNS order.
+func canonicalCover(owner, next, name string) bool {
+	if canonicalCompare(owner, next) >= 0 {
+		// the last NSEC of the zone wraps around to the apex
+		return canonicalCompare(owner, name) < 0
+	}
+	return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+}
+
+// canonicalCompare compares two names label by label from the right, case insensitive (RFC 4034 6.1).
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func rrsetKey(name string, rrtype uint16) string {
+	return strings.ToLower(name) + "_" + dns.TypeToString[rrtype]
+}
+
+// splitRRsets groups the records by owner and type, and indexes the signatures by the rrset they cover.
+func splitRRsets(rrs []dns.RR) ([][]dns.RR, map[string][]*dns.RRSIG) {
+	var rrsets [][]dns.RR
+	index := make(map[string]int)
+	sigs := make(map[string][]*dns.RRSIG)
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey(sig.Hdr.Name, sig.TypeCovered)
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		key := rrsetKey(rr.Header().Name, rr.Header().Rrtype)
+		if i, ok := index[key]; ok {
+			rrsets[i] = append(rrsets[i], rr)
+		} else {
+			index[key] = len(rrsets)
+			rrsets = append(rrsets, []dns.RR{rr})
+		}
+	}
+	return rrsets, sigs
+}
+
+func containsType(rrs []dns.RR, rrtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+func hasType(bitmap []uint16, rrtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// stripDNSSEC removes the DNSSEC records a client didn't ask for (RFC 4035 3.2.1).
+func stripDNSSEC(res *dns.Msg, qtype uint16) {
+	S := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if rr.Header().Rrtype != qtype {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	res.Answer = S(res.Answer)
+	res.Ns = S(res.Ns)
+	res.Extra = S(res.Extra)
+}
+
+// setClientOPT replaces the OPT record of the upstream, which has the DO bit and the UDP size
+// of the validator, with the EDNS of the client: no OPT record without EDNS.
+func setClientOPT(res *dns.Msg, opt *dns.OPT) {
+	extra := res.Extra[:0]
+	for _, rr := range res.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	res.Extra = extra
+	if opt != nil {
+		res.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+}
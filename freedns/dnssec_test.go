@@ -0,0 +1,357 @@
+package freedns
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/freedns/dnstest"
+)
+
+// testZone is a DNSSEC signed zone, signed by a single ECDSA P-256 key.
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+	rrs  []dns.RR
+}
+
+func newTestZone(t *testing.T, name string, records ...string) *testZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := &testZone{name: name, key: key, priv: priv.(crypto.Signer)}
+	z.rrs = append(z.rrs, key)
+	for _, s := range records {
+		z.add(t, s)
+	}
+	return z
+}
+
+func (z *testZone) add(t *testing.T, s string) {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z.rrs = append(z.rrs, rr)
+}
+
+func (z *testZone) delegate(child *testZone) {
+	z.rrs = append(z.rrs, child.key.ToDS(dns.SHA256))
+}
+
+func (z *testZone) sign(rrset []dns.RR) dns.RR {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+func (z *testZone) lookup(name string, qtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range z.rrs {
+		if strings.EqualFold(rr.Header().Name, name) && rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// testUpstream plays a validating-free recursive resolver serving signed zones.
+type testUpstream struct {
+	zones []*testZone
+	// overrides are returned as is for "name_TYPE" questions, they must be set before serving
+	overrides map[string]*dns.Msg
+}
+
+// zoneFor returns the deepest zone containing name. DS records are served by the parent zone.
+func (u *testUpstream) zoneFor(name string, qtype uint16) *testZone {
+	var best *testZone
+	for _, z := range u.zones {
+		if !dns.IsSubDomain(z.name, name) {
+			continue
+		}
+		if qtype == dns.TypeDS && strings.EqualFold(z.name, name) && z.name != "." {
+			continue
+		}
+		if best == nil || dns.CountLabel(z.name) > dns.CountLabel(best.name) {
+			best = z
+		}
+	}
+	return best
+}
+
+func (u *testUpstream) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	q := req.Question[0]
+	if res, ok := u.overrides[rrsetKey(q.Name, q.Qtype)]; ok {
+		res = res.Copy()
+		res.SetReply(req)
+		w.WriteMsg(res)
+		return
+	}
+
+	res := &dns.Msg{}
+	res.SetReply(req)
+	z := u.zoneFor(q.Name, q.Qtype)
+	if z == nil {
+		res.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(res)
+		return
+	}
+
+	if rrs := z.lookup(q.Name, q.Qtype); len(rrs) > 0 {
+		res.Answer = append(rrs, z.sign(rrs))
+		w.WriteMsg(res)
+		return
+	}
+
+	exists := false
+	for _, rr := range z.rrs {
+		if strings.EqualFold(rr.Header().Name, q.Name) {
+			exists = true
+		}
+	}
+	if !exists {
+		res.Rcode = dns.RcodeNameError
+	}
+	for _, rr := range z.rrs {
+		nsec, ok := rr.(*dns.NSEC)
+		if !ok {
+			continue
+		}
+		if strings.EqualFold(nsec.Hdr.Name, q.Name) || canonicalCover(nsec.Hdr.Name, nsec.NextDomain, q.Name) {
+			res.Ns = append(res.Ns, nsec, z.sign([]dns.RR{nsec}))
+		}
+	}
+	w.WriteMsg(res)
+}
+
+func startTestUpstream(t *testing.T, handler dns.Handler) (string, func()) {
+	s := dnstest.NewServer(handler)
+	return s.Addr, s.Close
+}
+
+// newTestChain builds the zones ". -> com. -> baidu.com." plus the unsigned delegation "insecure.".
+func newTestChain(t *testing.T) (*testUpstream, []*dns.DS) {
+	root := newTestZone(t, ".",
+		". 3600 IN NSEC com. NS SOA RRSIG NSEC DNSKEY",
+		"com. 3600 IN NSEC insecure. NS DS RRSIG NSEC",
+		"insecure. 3600 IN NSEC . NS RRSIG NSEC",
+	)
+	com := newTestZone(t, "com.",
+		"com. 3600 IN NSEC baidu.com. NS SOA RRSIG NSEC DNSKEY",
+		"baidu.com. 3600 IN NSEC com. NS DS RRSIG NSEC",
+	)
+	baidu := newTestZone(t, "baidu.com.",
+		"www.baidu.com. 300 IN A 1.2.3.4",
+		"baidu.com. 3600 IN NSEC www.baidu.com. SOA RRSIG NSEC DNSKEY",
+		"www.baidu.com. 3600 IN NSEC baidu.com. A RRSIG NSEC",
+	)
+	root.delegate(com)
+	com.delegate(baidu)
+
+	upstream := &testUpstream{
+		zones:     []*testZone{root, com, baidu},
+		overrides: make(map[string]*dns.Msg),
+	}
+	return upstream, []*dns.DS{root.key.ToDS(dns.SHA256)}
+}
+
+func TestDNSSECValidate(t *testing.T) {
+	upstream, anchors := newTestChain(t)
+	// an unsigned answer for the insecure delegation, set before the upstream serves
+	insecure := &dns.Msg{}
+	insecure.Answer = []dns.RR{mustRR(t, "www.insecure. 300 IN A 5.6.7.8")}
+	upstream.overrides[rrsetKey("www.insecure.", dns.TypeA)] = insecure
+
+	addr, shutdown := startTestUpstream(t, upstream)
+	defer shutdown()
+
+	tests := []struct {
+		name   string
+		qtype  uint16
+		tamper func(res *dns.Msg)
+		status dnssecStatus
+	}{
+		{"www.baidu.com.", dns.TypeA, nil, dnssecSecure},
+		{"www.baidu.com.", dns.TypeAAAA, nil, dnssecSecure},
+		{"nx.baidu.com.", dns.TypeA, nil, dnssecSecure},
+		{"www.insecure.", dns.TypeA, nil, dnssecInsecure},
+		{"www.baidu.com.", dns.TypeA, func(res *dns.Msg) {
+			res.Answer[0].(*dns.A).A = net.ParseIP("6.6.6.6")
+		}, dnssecBogus},
+		{"www.baidu.com.", dns.TypeA, func(res *dns.Msg) {
+			res.Answer = res.Answer[:1]
+		}, dnssecBogus},
+		{"www.baidu.com.", dns.TypeAAAA, func(res *dns.Msg) {
+			// replay the NXDOMAIN proof of another name
+			res.Rcode = dns.RcodeNameError
+			res.Ns = res.Ns[:0]
+		}, dnssecBogus},
+	}
+
+	v := newDNSSECValidator(anchors, &staticUpstreamProvider{addr})
+	for _, tt := range tests {
+		q := dns.Question{Name: tt.name, Qtype: tt.qtype, Qclass: dns.ClassINET}
+		res, err := exchange(context.Background(), newDNSSECRequest(q, true), "udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.tamper != nil {
+			tt.tamper(res)
+		}
+		status, err := v.validate(res)
+		if status != tt.status {
+			t.Errorf("validate(%s %s) = %v (%v), want %v", tt.name, dns.TypeToString[tt.qtype], status, err, tt.status)
+		}
+	}
+
+	// the DS of com. is genuine, but not signed by the root zone
+	upstream, anchors = newTestChain(t)
+	unsigned := &dns.Msg{}
+	unsigned.Answer = []dns.RR{upstream.zones[1].key.ToDS(dns.SHA256)}
+	upstream.overrides[rrsetKey("com.", dns.TypeDS)] = unsigned
+	addr, shutdownUnsigned := startTestUpstream(t, upstream)
+	defer shutdownUnsigned()
+
+	v = newDNSSECValidator(anchors, &staticUpstreamProvider{addr})
+	q := dns.Question{Name: "www.baidu.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	res, err := exchange(context.Background(), newDNSSECRequest(q, true), "udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := v.validate(res); status != dnssecBogus {
+		t.Errorf("validate() = %v (%v) with an unsigned DS, want %v", status, err, dnssecBogus)
+	}
+}
+
+func TestDNSSECUnsignedInsecureDelegation(t *testing.T) {
+	upstream, anchors := newTestChain(t)
+	com := upstream.zones[1]
+	// an unsigned NSEC claims baidu.com. has no DS, next to a genuine signed one
+	signed := mustRR(t, "com. 3600 IN NSEC baidu.com. NS SOA RRSIG NSEC DNSKEY")
+	noDS := &dns.Msg{}
+	noDS.Ns = []dns.RR{
+		signed, com.sign([]dns.RR{signed}),
+		mustRR(t, "baidu.com. 3600 IN NSEC com. NS RRSIG NSEC"),
+	}
+	upstream.overrides[rrsetKey("baidu.com.", dns.TypeDS)] = noDS
+	addr, shutdown := startTestUpstream(t, upstream)
+	defer shutdown()
+
+	v := newDNSSECValidator(anchors, &staticUpstreamProvider{addr})
+	forged := &dns.Msg{}
+	forged.SetQuestion("www.baidu.com.", dns.TypeA)
+	forged.Response = true
+	forged.Answer = []dns.RR{mustRR(t, "www.baidu.com. 300 IN A 6.6.6.6")}
+	if status, err := v.validate(forged); status != dnssecBogus {
+		t.Errorf("validate() = %v (%v) with an unsigned proof of insecurity, want %v", status, err, dnssecBogus)
+	}
+}
+
+func TestDNSSECRejectsPoisonedFastUpstream(t *testing.T) {
+	upstream, anchors := newTestChain(t)
+	cleanAddr, shutdownClean := startTestUpstream(t, upstream)
+	defer shutdownClean()
+
+	poisoned := &dns.Msg{}
+	poisoned.Answer = []dns.RR{mustRR(t, "www.baidu.com. 300 IN A 6.6.6.6")}
+	fast := &testUpstream{
+		zones:     upstream.zones,
+		overrides: map[string]*dns.Msg{rrsetKey("www.baidu.com.", dns.TypeA): poisoned},
+	}
+	fastAddr, shutdownFast := startTestUpstream(t, fast)
+	defer shutdownFast()
+
+	resolver := newSpoofingProofResolver(&staticUpstreamProvider{fastAddr}, &staticUpstreamProvider{cleanAddr}, &staticUpstreamProvider{cleanAddr})
+	resolver.validator = newDNSSECValidator(anchors, &staticUpstreamProvider{cleanAddr})
+
+	q := dns.Question{Name: "www.baidu.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	res, upstreamUsed := resolver.resolve(context.Background(), q, true, "udp")
+	if upstreamUsed != cleanAddr {
+		t.Errorf("resolve() used %s, want the clean upstream %s", upstreamUsed, cleanAddr)
+	}
+	if !res.AuthenticatedData {
+		t.Errorf("resolve() should set the AD bit on validated answers")
+	}
+	if a, ok := res.Answer[0].(*dns.A); !ok || a.A.String() != "1.2.3.4" {
+		t.Errorf("resolve() returned the poisoned answer %v", res.Answer)
+	}
+}
+
+func TestDNSSECClientEDNS(t *testing.T) {
+	upstream, anchors := newTestChain(t)
+	addr, shutdown := startTestUpstream(t, upstream)
+	defer shutdown()
+
+	s, err := NewServer(Config{
+		FastUpstream:   addr,
+		CleanUpstream:  addr,
+		PublicUpstream: addr,
+		Listen:         "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	s.resolver.validator = newDNSSECValidator(anchors, &staticUpstreamProvider{addr})
+
+	tests := []struct {
+		edns   bool
+		do     bool
+		opt    bool
+		rrsigs bool
+	}{
+		{false, false, false, false},
+		{true, false, true, false},
+		{true, true, true, true},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion("www.baidu.com.", dns.TypeA)
+		if tt.edns {
+			req.SetEdns0(1232, tt.do)
+		}
+		res, _ := s.lookup(s.resolver, req, "udp")
+		if len(res.Answer) == 0 {
+			t.Fatalf("edns %v, do %v: unexpected answer %v", tt.edns, tt.do, res)
+		}
+		opt := res.IsEdns0()
+		if (opt != nil) != tt.opt {
+			t.Errorf("edns %v, do %v: the answer has the OPT record %v", tt.edns, tt.do, opt)
+		}
+		if opt != nil && (opt.Do() != tt.do || opt.UDPSize() != 1232) {
+			t.Errorf("edns %v, do %v: the OPT record should follow the client, got %v", tt.edns, tt.do, opt)
+		}
+		if containsType(res.Answer, dns.TypeRRSIG) != tt.rrsigs {
+			t.Errorf("edns %v, do %v: unexpected signatures in %v", tt.edns, tt.do, res.Answer)
+		}
+	}
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
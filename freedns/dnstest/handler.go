@@ -0,0 +1,150 @@
+package dnstest
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Records answers with the matching records of the zone, given in the presentation
+// format, e.g. "www.example. 300 IN A 1.2.3.4", following the CNAMEs within the zone.
+// Names without any record are NXDOMAIN, with the SOA of the zone in the authority
+// section when there is one.
+// It panics when a record can't be parsed.
+func Records(rrs ...string) dns.HandlerFunc {
+	var zone []dns.RR
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic("dnstest: " + err.Error())
+		}
+		zone = append(zone, rr)
+	}
+
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		res := &dns.Msg{}
+		res.SetReply(req)
+		known := false
+		// follow the CNAMEs within the zone, like an authoritative server
+		name := q.Name
+		for i := 0; i < 8 && name != ""; i++ {
+			target := ""
+			for _, rr := range zone {
+				if !strings.EqualFold(rr.Header().Name, name) {
+					continue
+				}
+				known = true
+				if rr.Header().Rrtype == q.Qtype {
+					res.Answer = append(res.Answer, dns.Copy(rr))
+				} else if cname, ok := rr.(*dns.CNAME); ok {
+					res.Answer = append(res.Answer, dns.Copy(rr))
+					target = cname.Target
+				}
+			}
+			name = target
+		}
+		if len(res.Answer) == 0 {
+			if !known {
+				res.Rcode = dns.RcodeNameError
+			}
+			for _, rr := range zone {
+				if rr.Header().Rrtype == dns.TypeSOA && dns.IsSubDomain(rr.Header().Name, q.Name) {
+					res.Ns = append(res.Ns, dns.Copy(rr))
+				}
+			}
+		}
+		w.WriteMsg(res)
+	}
+}
+
+// A answers the A queries of any name with `ip` and a TTL of 300, and the other types with NODATA.
+func A(ip string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		q := req.Question[0]
+		if q.Qtype == dns.TypeA {
+			res.Answer = append(res.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.ParseIP(ip),
+			})
+		}
+		w.WriteMsg(res)
+	}
+}
+
+// Rcode answers every query with `rcode` and no records.
+func Rcode(rcode int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetRcode(req, rcode)
+		w.WriteMsg(res)
+	}
+}
+
+// Servfail answers every query with SERVFAIL.
+func Servfail() dns.HandlerFunc {
+	return Rcode(dns.RcodeServerFailure)
+}
+
+// Drop never answers, the clients time out.
+func Drop() dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {}
+}
+
+// Delay answers with `next` after `d`.
+func Delay(d time.Duration, next dns.Handler) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(d)
+		next.ServeDNS(w, req)
+	}
+}
+
+// Truncate answers the udp queries with an empty truncated response,
+// so the clients have to retry over tcp, which is answered by `next`.
+func Truncate(next dns.Handler) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		if isTCP(w) {
+			next.ServeDNS(w, req)
+			return
+		}
+		res := &dns.Msg{}
+		res.SetReply(req)
+		res.Truncated = true
+		w.WriteMsg(res)
+	}
+}
+
+// Poison behaves like an on-path injector: a forged A record pointing to `ip` is sent to
+// the udp queries before the genuine answer of `next`. The tcp queries are not affected.
+func Poison(ip string, next dns.Handler) dns.HandlerFunc {
+	forged := A(ip)
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		if !isTCP(w) {
+			forged(w, req)
+		}
+		next.ServeDNS(w, req)
+	}
+}
+
+// Sequence answers the n-th query with the n-th handler, and the later
+// queries with the last one, e.g. to make an upstream fail then recover.
+func Sequence(handlers ...dns.Handler) dns.HandlerFunc {
+	var n int64
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		i := int(atomic.AddInt64(&n, 1)) - 1
+		if i >= len(handlers) {
+			i = len(handlers) - 1
+		}
+		handlers[i].ServeDNS(w, req)
+	}
+}
+
+func isTCP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.TCPAddr)
+	return ok
+}
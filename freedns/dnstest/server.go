@@ -0,0 +1,62 @@
+// Package dnstest provides fake upstream DNS servers on loopback, to test
+// the resolution offline and deterministically, like net/http/httptest.
+package dnstest
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/freedns/internal/loopback"
+)
+
+// Server is a fake upstream serving both udp and tcp on the same loopback address.
+type Server struct {
+	// Addr is the ip:port of the server.
+	Addr string
+
+	queries int64
+
+	mutex   sync.RWMutex
+	handler dns.Handler
+
+	server *loopback.Server
+}
+
+// NewServer starts a server answering with `handler`, the caller should Close it.
+// It panics when no loopback port is available.
+func NewServer(handler dns.Handler) *Server {
+	s := &Server{handler: handler}
+	server, err := loopback.Start(s)
+	if err != nil {
+		panic("dnstest: failed to listen on loopback: " + err.Error())
+	}
+	s.Addr, s.server = server.Addr, server
+	return s
+}
+
+// ServeDNS counts the query and passes it to the current handler.
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	atomic.AddInt64(&s.queries, 1)
+	s.mutex.RLock()
+	handler := s.handler
+	s.mutex.RUnlock()
+	handler.ServeDNS(w, req)
+}
+
+// SetHandler changes how the server answers the next queries.
+func (s *Server) SetHandler(handler dns.Handler) {
+	s.mutex.Lock()
+	s.handler = handler
+	s.mutex.Unlock()
+}
+
+// Queries returns the number of queries received, including the dropped ones.
+func (s *Server) Queries() int {
+	return int(atomic.LoadInt64(&s.queries))
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.server.Close()
+}
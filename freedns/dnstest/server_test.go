@@ -0,0 +1,102 @@
+package dnstest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func query(t *testing.T, s *Server, name string, qtype uint16, net string) *dns.Msg {
+	t.Helper()
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	c := &dns.Client{Net: net, Timeout: 300 * time.Millisecond}
+	res, _, err := c.Exchange(req, s.Addr)
+	if err != nil {
+		t.Fatalf("%s %s over %s: %v", name, dns.TypeToString[qtype], net, err)
+	}
+	return res
+}
+
+func TestRecords(t *testing.T) {
+	s := NewServer(Records(
+		"example. 3600 IN SOA ns.example. admin.example. 1 7200 900 1209600 60",
+		"www.example. 300 IN A 1.2.3.4",
+		"alias.example. 300 IN CNAME www.example.",
+	))
+	defer s.Close()
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers int
+		ns      int
+	}{
+		{"www.example.", dns.TypeA, dns.RcodeSuccess, 1, 0},
+		{"WWW.Example.", dns.TypeA, dns.RcodeSuccess, 1, 0},
+		{"alias.example.", dns.TypeA, dns.RcodeSuccess, 2, 0},
+		{"alias.example.", dns.TypeAAAA, dns.RcodeSuccess, 1, 0},
+		{"www.example.", dns.TypeAAAA, dns.RcodeSuccess, 0, 1},
+		{"nx.example.", dns.TypeA, dns.RcodeNameError, 0, 1},
+	}
+	for _, tt := range tests {
+		for _, net := range []string{"udp", "tcp"} {
+			res := query(t, s, tt.name, tt.qtype, net)
+			if res.Rcode != tt.rcode || len(res.Answer) != tt.answers || len(res.Ns) != tt.ns {
+				t.Errorf("%s %s over %s: unexpected response %v", tt.name, dns.TypeToString[tt.qtype], net, res)
+			}
+		}
+	}
+	if n := s.Queries(); n != 2*len(tests) {
+		t.Errorf("Queries() = %d, want %d", n, 2*len(tests))
+	}
+}
+
+func TestBehaviors(t *testing.T) {
+	s := NewServer(Servfail())
+	defer s.Close()
+
+	if res := query(t, s, "www.example.", dns.TypeA, "udp"); res.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %v", res)
+	}
+
+	s.SetHandler(Truncate(A("1.2.3.4")))
+	if res := query(t, s, "www.example.", dns.TypeA, "udp"); !res.Truncated || len(res.Answer) != 0 {
+		t.Errorf("udp answers should be truncated, got %v", res)
+	}
+	if res := query(t, s, "www.example.", dns.TypeA, "tcp"); res.Truncated || len(res.Answer) != 1 {
+		t.Errorf("tcp answers should be complete, got %v", res)
+	}
+
+	s.SetHandler(Poison("6.6.6.6", A("1.2.3.4")))
+	if res := query(t, s, "www.example.", dns.TypeA, "udp"); res.Answer[0].(*dns.A).A.String() != "6.6.6.6" {
+		t.Errorf("the forged answer should arrive first over udp, got %v", res)
+	}
+	if res := query(t, s, "www.example.", dns.TypeA, "tcp"); res.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		t.Errorf("tcp should not be poisoned, got %v", res)
+	}
+
+	s.SetHandler(Sequence(Servfail(), A("1.2.3.4")))
+	for i, rcode := range []int{dns.RcodeServerFailure, dns.RcodeSuccess, dns.RcodeSuccess} {
+		if res := query(t, s, "www.example.", dns.TypeA, "udp"); res.Rcode != rcode {
+			t.Errorf("query %d: rcode = %s, want %s", i, dns.RcodeToString[res.Rcode], dns.RcodeToString[rcode])
+		}
+	}
+
+	s.SetHandler(Delay(100*time.Millisecond, A("1.2.3.4")))
+	start := time.Now()
+	query(t, s, "www.example.", dns.TypeA, "udp")
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("the answer should be delayed, took %v", elapsed)
+	}
+
+	s.SetHandler(Drop())
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.", dns.TypeA)
+	c := &dns.Client{Timeout: 100 * time.Millisecond}
+	if _, _, err := c.Exchange(req, s.Addr); err == nil {
+		t.Errorf("dropped queries should time out")
+	}
+}
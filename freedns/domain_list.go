@@ -0,0 +1,64 @@
+package freedns
+
+import (
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xiangyu123/cosp_dns/whitedomain"
+)
+
+// domainList routes the domains of the lists of Config.DomainLists, it maps
+// the domain suffixes to true for the white ones and false for the blocked ones.
+type domainList map[string]bool
+
+// loadDomainLists parses the lists in order, the exceptions of gfwlist win over its blocked domains.
+func loadDomainLists(files []string, stats *counters) (domainList, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	l := make(domainList)
+	for _, file := range files {
+		list, err := whitedomain.LoadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, domain := range list.Blocked {
+			if _, ok := l[domain]; !ok {
+				l[domain] = false
+			}
+		}
+		for _, domain := range list.White {
+			l[domain] = true
+		}
+		stats.add("domain_list_parsed", uint64(list.Parsed))
+		stats.add("domain_list_skipped", uint64(list.Skipped))
+		log.WithFields(logrus.Fields{
+			"op":      "load_domain_list",
+			"file":    file,
+			"format":  list.Format,
+			"white":   len(list.White),
+			"blocked": len(list.Blocked),
+			"parsed":  list.Parsed,
+			"skipped": list.Skipped,
+		}).Info()
+	}
+	return l, nil
+}
+
+// match looks the longest suffix of the domain up, and tells whether it is white.
+func (l domainList) match(name string) (white bool, found bool) {
+	if len(l) == 0 {
+		return false, false
+	}
+	name = strings.ToLower(strings.TrimRight(name, "."))
+	for {
+		if white, ok := l[name]; ok {
+			return white, true
+		}
+		i := strings.Index(name, ".")
+		if i < 0 {
+			return false, false
+		}
+		name = name[i+1:]
+	}
+}
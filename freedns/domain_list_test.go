@@ -0,0 +1,60 @@
+package freedns
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDomainLists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freedns_domain_list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	china := filepath.Join(dir, "accelerated-domains.china.conf")
+	ioutil.WriteFile(china, []byte("server=/qq.com/114.114.114.114\nserver=/google.cn/114.114.114.114\nipset=/qq.com/china\n"), 0644)
+	gfw := filepath.Join(dir, "gfwlist.txt")
+	ioutil.WriteFile(gfw, []byte("[AutoProxy 0.2.9]\n||google.cn\n||baidu.com\n@@||www.baidu.com\n/regexp/\n"), 0644)
+
+	stats := newCounters()
+	l, err := loadDomainLists([]string{china, gfw}, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDomainLists([]string{filepath.Join(dir, "missing")}, stats); err == nil {
+		t.Errorf("should not load a missing list")
+	}
+	if got := stats.snapshot(); got["domain_list_parsed"] != 5 || got["domain_list_skipped"] != 2 {
+		t.Errorf("unexpected counters %v", got)
+	}
+
+	resolver := newSpoofingProofResolver(nil, nil, nil)
+	resolver.domainList = l
+	tests := []struct {
+		name  string
+		route string
+	}{
+		{"qq.com.", routeWhite},
+		{"WWW.QQ.COM.", routeWhite},
+		// the white domains of dnsmasq-china-list win over the blocked ones
+		{"www.google.cn.", routeWhite},
+		// the blocked domains override the built-in list, except the exceptions
+		{"baidu.com.", routePublic},
+		{"www.baidu.com.", routeWhite},
+		{"img.www.baidu.com.", routeWhite},
+		{"example.com.", routePublic},
+	}
+	for _, tt := range tests {
+		if got := resolver.route(dns.Question{Name: tt.name, Qtype: dns.TypeA, Qclass: dns.ClassINET}); got != tt.route {
+			t.Errorf("%s is routed to %s, want %s", tt.name, got, tt.route)
+		}
+	}
+
+	if l, err := loadDomainLists(nil, stats); l != nil || err != nil {
+		t.Errorf("no list should be loaded, got %v, %v", l, err)
+	}
+}
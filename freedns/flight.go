@@ -0,0 +1,74 @@
+package freedns
+
+import (
+	"context"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// flightGroup coalesces concurrent identical queries into one upstream exchange.
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done     chan struct{}
+	res      *dns.Msg
+	upstream string
+	// waiters are the callers still waiting for the result, the exchange is cancelled when all of them gave up.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		calls: make(map[string]*flight),
+	}
+}
+
+// do runs fn once for all the concurrent callers of the same key,
+// shared is true for the callers which waited for another one.
+// The context of fn is cancelled when the contexts of all the callers are done,
+// a caller whose context is done returns a nil response without waiting for fn.
+// The result is shared, callers must copy it before modifying it.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(ctx context.Context) (*dns.Msg, string)) (res *dns.Msg, upstream string, shared bool) {
+	g.mutex.Lock()
+	f, shared := g.calls[key]
+	if !shared {
+		fctx, cancel := context.WithCancel(context.Background())
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = f
+		go func() {
+			res, upstream := fn(fctx)
+			g.mutex.Lock()
+			if g.calls[key] == f {
+				delete(g.calls, key)
+			}
+			g.mutex.Unlock()
+			cancel()
+			f.res, f.upstream = res, upstream
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	g.mutex.Unlock()
+
+	select {
+	case <-f.done:
+		return f.res, f.upstream, shared
+	case <-ctx.Done():
+		g.mutex.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// the next callers start a new exchange instead of joining the cancelled one
+			if g.calls[key] == f {
+				delete(g.calls, key)
+			}
+			f.cancel()
+		}
+		g.mutex.Unlock()
+		return nil, "", shared
+	}
+}
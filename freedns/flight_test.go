@@ -0,0 +1,89 @@
+package freedns
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolveCoalescesIdenticalQueries(t *testing.T) {
+	var queries int32
+	addr, shutdown := startTestUpstream(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		time.Sleep(200 * time.Millisecond)
+		answerA("1.2.3.4")(w, req)
+	}))
+	defer shutdown()
+
+	provider := &staticUpstreamProvider{addr}
+	resolver := newSpoofingProofResolver(provider, provider, provider)
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	const clients = 10
+	results := make([]*dns.Msg, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = resolver.resolve(context.Background(), q, true, "udp")
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("identical concurrent queries should reach the upstream once, got %d", n)
+	}
+	for i, res := range results {
+		if len(res.Answer) != 1 {
+			t.Fatalf("client %d got %v", i, res)
+		}
+		for j := 0; j < i; j++ {
+			if results[j] == res {
+				t.Errorf("clients %d and %d share the same message", i, j)
+			}
+		}
+	}
+
+	// a different RD bit is a different query
+	resolver.resolve(context.Background(), q, false, "udp")
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("queries after the flight landed should reach the upstream, got %d", n)
+	}
+}
+
+func TestResolveCancelledFlight(t *testing.T) {
+	var queries int32
+	addr, shutdown := startTestUpstream(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		time.Sleep(200 * time.Millisecond)
+		answerA("1.2.3.4")(w, req)
+	}))
+	defer shutdown()
+
+	provider := &staticUpstreamProvider{addr}
+	resolver := newSpoofingProofResolver(provider, provider, provider)
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	// the client giving up doesn't fail the others waiting for the same exchange
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ch := make(chan *dns.Msg, 1)
+	go func() {
+		res, _ := resolver.resolve(context.Background(), q, true, "udp")
+		ch <- res
+	}()
+	if res, _ := resolver.resolve(ctx, q, true, "udp"); res.Rcode != dns.RcodeServerFailure {
+		t.Errorf("the cancelled client should fail, got %v", res)
+	}
+	if res := <-ch; len(res.Answer) != 1 {
+		t.Errorf("the other client should get the answer, got %v", res)
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("the clients should share the exchange, got %d queries", n)
+	}
+}
@@ -1,6 +1,10 @@
 package freedns
 
 import (
+	"context"
+	"sync"
+	"time"
+
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
@@ -12,16 +16,127 @@ type Config struct {
 	PublicUpstream string
 	Listen         string
 	LogLevel       string
+
+	// DNSSEC enables validating the answers against the root trust anchor.
+	// Bogus answers of the fast upstream make the resolver fall back to the clean one.
+	DNSSEC bool
+
+	// Listeners replaces Listen when not empty, each of them serves both udp and tcp.
+	Listeners []Listener
+	// ACL is the access control of the listeners which don't have their own.
+	ACL *ACL
+
+	// Views route the queries of some clients differently, the others use the settings above.
+	Views []View
+
+	// RateLimit throttles the clients flooding the server, nil disables it.
+	RateLimit *RateLimit
+
+	// NotifyUpstream and UpdateUpstream receive the NOTIFY and UPDATE requests,
+	// which are answered with NOTIMP when empty.
+	NotifyUpstream string
+	UpdateUpstream string
+
+	// Chain names the stages handling the queries in order, defaults to DefaultChain.
+	// Plugins are the stages supplied by the embedders, to be named in Chain.
+	// Resolver.Resolve runs the chain without the stages of the listeners: acl, ratelimit, view and rrl.
+	Chain   []string
+	Plugins map[string]Handler
+
+	// IPSets adds the addresses answered for the domains under the suffixes to the sets, like the
+	// ipset and nftset options of dnsmasq, WhiteIPSets for the white domains and the domains of the
+	// rule sets routed to the fast upstream. See SetRef for the names
+	// of the sets, which are updated with netlink unless IPSetBackend is set.
+	IPSets       map[string][]string
+	WhiteIPSets  []string
+	IPSetBackend IPSet
+
+	// RecordFile records the upstream exchanges, with their latency, to reproduce them
+	// offline with the "replay:RecordFile#upstream" upstreams.
+	RecordFile string
+
+	// Cache enables the lazy cache: expiring records are still served while updated in the background.
+	Cache bool
+	// CacheSize is the number of entries cached for each view, defaults to 4096.
+	CacheSize int
+	// CacheFile keeps the cache across restarts, it is saved every CacheSaveInterval
+	// (defaults to 5 minutes) and on shutdown.
+	CacheFile         string
+	CacheSaveInterval time.Duration
+
+	// Prefetch refreshes the cached answers looked up at least PrefetchMinHits times
+	// (defaults to 3) shortly before they expire, with at most PrefetchConcurrency
+	// (defaults to 4) refreshes at once.
+	Prefetch            bool
+	PrefetchMinHits     int
+	PrefetchConcurrency int
+
+	// ServeStale keeps the expired cache entries for StaleWindow (defaults to 1 day),
+	// and answers with them when the upstreams fail or don't answer within
+	// StaleAnswerTimeout (defaults to 1.8 seconds) (RFC 8767).
+	ServeStale         bool
+	StaleWindow        time.Duration
+	StaleAnswerTimeout time.Duration
+
+	// MaxNegativeTTL caps how long NXDOMAIN and NODATA answers are cached, defaults to 3 hours.
+	MaxNegativeTTL time.Duration
+	// ServfailTTL caches the failures of the upstreams so they are not hammered, defaults to 5 seconds.
+	ServfailTTL time.Duration
+
+	// TTLPolicy clamps the TTLs of the positive answers, DomainTTLPolicies overrides it
+	// for the domains under the given suffixes, the longest suffix wins.
+	TTLPolicy         TTLPolicy
+	DomainTTLPolicies map[string]TTLPolicy
+
+	// AddressFilter removes the A or AAAA records from the answers, Views may replace it,
+	// and DomainAddressFilters overrides both for the domains under the given suffixes.
+	AddressFilter        AddressFilter
+	DomainAddressFilters map[string]AddressFilter
+
+	// DNS64 synthesizes the AAAA records of the domains which only have A records, nil disables it.
+	// Views may enable it for their clients only.
+	DNS64 *DNS64
+
+	// GeoIP sorts the addresses of the answers by the location of the clients, nil disables it.
+	GeoIP *GeoIP
+
+	// DomainLists are gfwlist, dnsmasq-china-list or plain domain list files, their white domains
+	// are added to the built-in list, and the blocked domains of gfwlist go to the public upstream.
+	DomainLists []string
+
+	// RuleSets are Clash or Surge rule sets routing their domains before the domain lists and
+	// the white domains, by the upstreams of RulePolicies, e.g. to keep the DNS routing consistent
+	// with the proxy routing. The first rule matching a domain wins, like in Clash and Surge.
+	RuleSets []RuleSet
+	// RulePolicies maps the policies of the rules to the upstreams: "fast", "clean", "white" for
+	// the fast and clean upstreams like the white domains, or "public". Defaults to DefaultRulePolicies.
+	RulePolicies map[string]string
 }
 
 // Server is type of the freedns server instance
 type Server struct {
 	config Config
 
-	udpServer *dns.Server
-	tcpServer *dns.Server
+	servers []*dns.Server
 
 	resolver *spoofingProofResolver
+	views    []*view
+	limiter  *rateLimiter
+	stats    *counters
+
+	staleFailures *staleFailures
+
+	// chain handles the queries, see DefaultChain.
+	chain Next
+	// inProcessChain handles the queries of Resolver.Resolve, see inProcessStages.
+	inProcessChain Next
+	// ipsets updates the sets with the answers, nil when there is none.
+	ipsets *ipsetUpdater
+	// geoip sorts the answers by the location of the clients, nil when disabled.
+	geoip *geoIP
+
+	done     chan struct{}
+	doneOnce sync.Once
 }
 
 var log = logrus.New()
@@ -35,7 +150,11 @@ func (e Error) Error() string {
 
 // NewServer creates a new freedns server instance.
 func NewServer(cfg Config) (*Server, error) {
-	s := &Server{}
+	s := &Server{
+		stats:         newCounters(),
+		staleFailures: newStaleFailures(),
+		done:          make(chan struct{}),
+	}
 
 	// set log level
 	if level, parseError := logrus.ParseLevel(cfg.LogLevel); parseError == nil {
@@ -50,6 +169,19 @@ func NewServer(cfg Config) (*Server, error) {
 	if cfg.Listen, err = normalizeDnsAddress(cfg.Listen); err != nil {
 		return nil, err
 	}
+	if cfg.NotifyUpstream != "" {
+		if cfg.NotifyUpstream, err = normalizeDnsAddress(cfg.NotifyUpstream); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.UpdateUpstream != "" {
+		if cfg.UpdateUpstream, err = normalizeDnsAddress(cfg.UpdateUpstream); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Listeners) == 0 {
+		cfg.Listeners = []Listener{{Addr: cfg.Listen}}
+	}
 
 	s.config = cfg
 
@@ -67,94 +199,281 @@ func NewServer(cfg Config) (*Server, error) {
 		return nil, err
 	}
 
-	s.config = cfg
-	s.udpServer = &dns.Server{
-		Addr: s.config.Listen,
-		Net:  "udp",
-		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
-			s.handle(w, req, "udp")
-		}),
+	if s.limiter, err = newRateLimiter(cfg.RateLimit); err != nil {
+		return nil, err
 	}
 
-	s.tcpServer = &dns.Server{
-		Addr: s.config.Listen,
-		Net:  "tcp",
-		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
-			s.handle(w, req, "tcp")
-		}),
+	s.config = cfg
+	for _, lc := range cfg.Listeners {
+		for _, net := range []string{"udp", "tcp"} {
+			ln, err := newListener(lc, cfg.ACL, net)
+			if err != nil {
+				return nil, err
+			}
+			s.servers = append(s.servers, &dns.Server{
+				Addr: ln.addr,
+				Net:  net,
+				Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+					s.handle(w, req, ln)
+				}),
+				MsgAcceptFunc: acceptMsg,
+			})
+		}
 	}
 
+	if err = validateAddressFilters(cfg); err != nil {
+		return nil, err
+	}
 	s.resolver = newSpoofingProofResolver(fastUpstreamProvider, cleanUpstreamProvider, publicUpstreamProvider)
+	s.resolver.addressFilter = cfg.AddressFilter
+	if s.resolver.dns64, err = newDNS64(cfg.DNS64); err != nil {
+		return nil, err
+	}
+	if s.resolver.domainList, err = loadDomainLists(cfg.DomainLists, s.stats); err != nil {
+		return nil, err
+	}
+	if s.resolver.ruleSets, err = loadRuleSets(cfg, s.stats); err != nil {
+		return nil, err
+	}
+	if cfg.DNSSEC {
+		// the chain of trust is fetched through the upstreams which are not poisoned
+		s.resolver.validator = newDNSSECValidator(rootTrustAnchors(), cleanUpstreamProvider, publicUpstreamProvider)
+	}
+
+	chain := cfg.Chain
+	if len(chain) == 0 {
+		chain = DefaultChain
+	}
+	if s.chain, err = s.buildChain(chain, cfg.Plugins); err != nil {
+		return nil, err
+	}
+	if s.inProcessChain, err = s.buildChain(inProcessStages(chain), cfg.Plugins); err != nil {
+		return nil, err
+	}
+	if s.ipsets, err = newIPSetUpdater(cfg, s.stats); err != nil {
+		return nil, err
+	}
+	if s.geoip, err = newGeoIP(cfg.GeoIP, s.stats); err != nil {
+		return nil, err
+	}
+
+	if cfg.RecordFile != "" {
+		if s.resolver.recorder, err = newRecorder(cfg.RecordFile); err != nil {
+			return nil, err
+		}
+		if s.resolver.validator != nil {
+			s.resolver.validator.recorder = s.resolver.recorder
+		}
+	}
+
+	names := map[string]bool{"default": true}
+	for _, vc := range cfg.Views {
+		if names[vc.Name] {
+			return nil, Error("Duplicated view name " + vc.Name)
+		}
+		names[vc.Name] = true
 
+		v, err := newView(vc, cfg)
+		if err != nil {
+			return nil, err
+		}
+		v.resolver.validator = s.resolver.validator
+		v.resolver.recorder = s.resolver.recorder
+		s.views = append(s.views, v)
+	}
+
+	if cfg.Cache {
+		if cfg.CacheSize <= 0 {
+			cfg.CacheSize = 4096
+		}
+		if cfg.CacheSaveInterval <= 0 {
+			cfg.CacheSaveInterval = 5 * time.Minute
+		}
+		if cfg.StaleWindow <= 0 {
+			cfg.StaleWindow = 24 * time.Hour
+		}
+		if cfg.StaleAnswerTimeout <= 0 {
+			cfg.StaleAnswerTimeout = 1800 * time.Millisecond
+		}
+		if cfg.MaxNegativeTTL <= 0 {
+			cfg.MaxNegativeTTL = 3 * time.Hour
+		}
+		if cfg.ServfailTTL <= 0 {
+			cfg.ServfailTTL = 5 * time.Second
+		}
+		s.config = cfg
+		s.resolver.cache = newDNSCache(cfg.CacheSize)
+		for _, v := range s.views {
+			v.resolver.cache = newDNSCache(cfg.CacheSize)
+		}
+		if cfg.CacheFile != "" {
+			s.loadCache()
+		}
+	}
+
+	if s.ipsets != nil {
+		go s.ipsets.run(s.done)
+	}
+	if s.geoip != nil {
+		if err := s.geoip.watch(s.done); err != nil {
+			return nil, err
+		}
+	}
 	return s, nil
 }
 
+// caches returns the cache of every view, keyed by view name.
+func (s *Server) caches() map[string]*dnsCache {
+	caches := make(map[string]*dnsCache)
+	if s.resolver.cache != nil {
+		caches["default"] = s.resolver.cache
+	}
+	for _, v := range s.views {
+		if v.resolver.cache != nil {
+			caches[v.name] = v.resolver.cache
+		}
+	}
+	return caches
+}
+
 // Run tcp and udp server.
 func (s *Server) Run() error {
-	errChan := make(chan error, 2)
+	errChan := make(chan error, len(s.servers))
 
-	go func() {
-		err := s.tcpServer.ListenAndServe()
-		errChan <- err
-	}()
+	if s.config.Cache && s.config.CacheFile != "" {
+		go s.saveCachePeriodically(s.config.CacheSaveInterval, s.done)
+	}
+	if s.config.Cache && s.config.Prefetch {
+		go s.prefetchPeriodically(newPrefetcher(s.config.PrefetchMinHits, s.config.PrefetchConcurrency), s.done)
+	}
 
-	go func() {
-		err := s.udpServer.ListenAndServe()
-		errChan <- err
-	}()
+	for _, server := range s.servers {
+		go func(server *dns.Server) {
+			err := server.ListenAndServe()
+			errChan <- err
+		}(server)
+	}
 
 	select {
 	case err := <-errChan:
-		s.tcpServer.Shutdown()
-		s.udpServer.Shutdown()
+		s.Shutdown()
 		return err
 	}
 }
 
 // Shutdown shuts down the freedns server
 func (s *Server) Shutdown() {
-	s.tcpServer.Shutdown()
-	s.udpServer.Shutdown()
+	for _, server := range s.servers {
+		server.Shutdown()
+	}
+	s.doneOnce.Do(func() {
+		close(s.done)
+		if s.config.Cache && s.config.CacheFile != "" {
+			s.saveCache()
+		}
+		if s.resolver.recorder != nil {
+			s.resolver.recorder.close()
+		}
+	})
+}
+
+// Stats returns a snapshot of the server counters, e.g. the refused queries.
+func (s *Server) Stats() map[string]uint64 {
+	return s.stats.snapshot()
 }
 
-func (s *Server) handle(w dns.ResponseWriter, req *dns.Msg, net string) {
-	res := &dns.Msg{}
+// RateLimited returns how many queries and responses were limited for each client prefix.
+func (s *Server) RateLimited() map[string]uint64 {
+	return s.limiter.limited()
+}
 
-	if len(req.Question) < 1 {
-		res.SetRcode(req, dns.RcodeBadName)
+func (s *Server) handle(w dns.ResponseWriter, req *dns.Msg, ln *listener) {
+	res := s.chain(context.Background(), &Request{
+		Msg:      req,
+		ClientIP: clientIP(w.RemoteAddr()),
+		Net:      ln.net,
+		Listener: ln.name,
+		View:     "default",
+		w:        w,
+		listener: ln,
+		resolver: s.resolver,
+	})
+	if res != nil {
 		w.WriteMsg(res)
-		log.WithFields(logrus.Fields{
-			"op":  "handle",
-			"msg": "request without questions",
-		}).Warn()
-		return
 	}
+}
 
-	res, upstream := s.lookup(req, net)
-	w.WriteMsg(res)
+// lookup queries the dns request `q` on all of the resolvers, through the cache of the resolver,
+// and returns the result and which upstream is used.
+func (s *Server) lookup(resolver *spoofingProofResolver, req *dns.Msg, net string) (*dns.Msg, string) {
+	return s.lookupWith(context.Background(), resolver, req, net, true)
+}
 
-	// logging
-	l := log.WithFields(logrus.Fields{
-		"op":       "handle",
-		"domain":   req.Question[0].Name,
-		"type":     dns.TypeToString[req.Question[0].Qtype],
-		"upstream": upstream,
-		"status":   dns.RcodeToString[res.Rcode],
-	})
-	if res.Rcode == dns.RcodeSuccess {
-		l.Info()
-	} else {
-		l.Warn()
+// lookupWith is lookup, the cache of the resolver is skipped when `cached` is false.
+// The upstream exchanges are aborted when ctx is done.
+func (s *Server) lookupWith(ctx context.Context, resolver *spoofingProofResolver, req *dns.Msg, net string, cached bool) (*dns.Msg, string) {
+	if cached && resolver.cache != nil {
+		if res, upstream := s.answerFromCache(ctx, resolver, req, net); res != nil {
+			return res, upstream
+		}
 	}
+	return s.resolveRequest(ctx, resolver, req, net, cached)
 }
 
-// lookup queries the dns request `q` on all of the resolvers,
-// and returns the result and which upstream is used.
-func (s *Server) lookup(req *dns.Msg, net string) (*dns.Msg, string) {
+// answerFromCache answers the request from the cache of the resolver, it returns nil on a miss.
+func (s *Server) answerFromCache(ctx context.Context, resolver *spoofingProofResolver, req *dns.Msg, net string) (*dns.Msg, string) {
+	res, upstream := s.lookupCache(resolver, req.Question[0], req.RecursionDesired, net)
+	if res == nil {
+		return nil, ""
+	}
+	return s.reply(ctx, resolver, req, res, upstream, net, true), upstream
+}
+
+// resolveRequest queries the request on the upstreams of the resolver, the answer is
+// stored to the cache of the resolver when `cached` is true.
+func (s *Server) resolveRequest(ctx context.Context, resolver *spoofingProofResolver, req *dns.Msg, net string, cached bool) (*dns.Msg, string) {
 	log.Println("start to debug.....")
-	// dns.Msg.SetReply() always set the Rcode to RcodeSuccess  which we do not want
-	res, upstream := s.resolver.resolve(req.Question[0], req.RecursionDesired, net)
+	q := req.Question[0]
+	if res, upstream := s.lookupDNS64PTR(ctx, resolver, req, net, cached); res != nil {
+		return res, upstream
+	}
 
+	res, upstream := s.resolveAndStore(ctx, resolver, q, req.RecursionDesired, net, cached)
+	return s.reply(ctx, resolver, req, res, upstream, net, cached), upstream
+}
+
+// fetch returns the answer of the resolver to the question as is, before reply:
+// from the cache of the resolver when `cached` is true, or from its upstreams.
+func (s *Server) fetch(ctx context.Context, resolver *spoofingProofResolver, q dns.Question, recursion bool, net string, cached bool) (*dns.Msg, string) {
+	if cached && resolver.cache != nil {
+		if res, upstream := s.lookupCache(resolver, q, recursion, net); res != nil {
+			return res, upstream
+		}
+	}
+	return s.resolveAndStore(ctx, resolver, q, recursion, net, cached)
+}
+
+// resolveAndStore queries the upstreams of the resolver, the answer is stored to the cache
+// of the resolver when `cached` is true, or its TTLs are clamped by the TTL policy.
+// The failures caused by ctx are not stored, the other clients may still get an answer.
+func (s *Server) resolveAndStore(ctx context.Context, resolver *spoofingProofResolver, q dns.Question, recursion bool, net string, cached bool) (*dns.Msg, string) {
+	res, upstream := resolver.resolve(ctx, q, recursion, net)
+	if ctx.Err() != nil {
+		return res, upstream
+	}
+	if cached && resolver.cache != nil {
+		s.store(resolver.cache, q, recursion, res, net)
+	} else if res.Rcode == dns.RcodeSuccess && !isNegative(res) {
+		if policy := s.ttlPolicy(q.Name); policy.RewriteClientTTL {
+			policy.clampTTLs(res)
+		}
+	}
+	return res, upstream
+}
+
+// reply turns the answer `res` of the resolver into the reply to `req`: the DNSSEC records
+// follow the client, and DNS64 and the address filters are applied.
+func (s *Server) reply(ctx context.Context, resolver *spoofingProofResolver, req *dns.Msg, res *dns.Msg, upstream string, net string, cached bool) *dns.Msg {
 	log.Println("res.Rcode is", res.Rcode)
 
 	if res.Rcode == dns.RcodeSuccess {
@@ -166,8 +485,35 @@ func (s *Server) lookup(req *dns.Msg, net string) (*dns.Msg, string) {
 		}).Info()
 	}
 
+	if resolver.validator != nil {
+		opt := req.IsEdns0()
+		if opt == nil || !opt.Do() {
+			stripDNSSEC(res, req.Question[0].Qtype)
+			res.AuthenticatedData = res.AuthenticatedData && req.AuthenticatedData
+		}
+		setClientOPT(res, opt)
+	}
+	s.synthesizeDNS64(ctx, resolver, req, res, net, cached)
+	s.filterAddresses(ctx, resolver, req, res, net, cached)
+
+	// dns.Msg.SetReply() always set the Rcode to RcodeSuccess  which we do not want
 	rcode := res.Rcode
 	res.SetReply(req)
 	res.Rcode = rcode
-	return res, upstream
+	return res
+}
+
+// refresh updates the cached answer of the question in the background.
+func (s *Server) refresh(resolver *spoofingProofResolver, q dns.Question, recursion bool, net string) {
+	res, upstream := resolver.resolve(context.Background(), q, recursion, net)
+	if res.Rcode != dns.RcodeServerFailure {
+		s.store(resolver.cache, q, recursion, res, net)
+	}
+	log.WithFields(logrus.Fields{
+		"op":       "refresh",
+		"domain":   q.Name,
+		"type":     dns.TypeToString[q.Qtype],
+		"upstream": upstream,
+		"status":   dns.RcodeToString[res.Rcode],
+	}).Debug()
 }
@@ -2,31 +2,43 @@ package freedns
 
 import (
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/freedns/dnstest"
+	"github.com/xiangyu123/cosp_dns/whitedomain"
 )
 
 func TestSmokingNewRunAndShutdown(t *testing.T) {
+	fast := dnstest.NewServer(dnstest.A("10.0.0.1"))
+	defer fast.Close()
+	clean := dnstest.NewServer(dnstest.A("10.0.0.2"))
+	defer clean.Close()
+	public := dnstest.NewServer(dnstest.Records(
+		"example. 3600 IN SOA ns.example. admin.example. 1 7200 900 1209600 60",
+		"www.example. 300 IN A 8.8.8.8",
+		"www.example. 300 IN MX 10 mail.example.",
+	))
+	defer public.Close()
+
 	// new the server
 	s, err := NewServer(Config{
-		FastUpstream:  "114.114.114.114",
-		CleanUpstream: "8.8.8.8",
-		Listen:        "127.0.0.1:52345",
+		FastUpstream:   fast.Addr,
+		CleanUpstream:  clean.Addr,
+		PublicUpstream: public.Addr,
+		Listen:         "127.0.0.1:52345",
 	})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	s.resolver.whiteDomains = whitedomain.MustCompile([]string{"corp.example"})
 
 	// run the server
-	shut := make(chan bool, 2)
+	done := make(chan error, 1)
 	go func() {
-		err := s.Run()
-		if err != nil {
-			t.Error(err)
-		}
-		_ = <-shut
-		s.Shutdown()
+		done <- s.Run()
 	}()
+	time.Sleep(100 * time.Millisecond)
 
 	tests := []struct {
 		domain           string
@@ -34,14 +46,11 @@ func TestSmokingNewRunAndShutdown(t *testing.T) {
 		net              string
 		expectedUpstream string
 	}{
-		{"ustc.edu.cn.", dns.TypeMX, "udp", "8.8.8.8:53"},
-		{"ustc.edu.cn.", dns.TypeA, "udp", "114.114.114.114:53"},
-		{"ustc.edu.cn.", dns.TypeMX, "udp", "114.114.114.114:53"},
-		{"google.com.", dns.TypeA, "udp", "8.8.8.8:53"},
-		{"mi.cn.", dns.TypeA, "udp", "114.114.114.114:53"},
-		{"xiaomi.com.", dns.TypeA, "udp", "114.114.114.114:53"},
-		{"youtube.com.", dns.TypeA, "udp", "8.8.8.8:53"},
-		{"twitter.com.", dns.TypeA, "tcp", "8.8.8.8:53"},
+		{"www.corp.example.", dns.TypeA, "udp", fast.Addr},
+		{"www.corp.example.", dns.TypeA, "tcp", fast.Addr},
+		{"www.example.", dns.TypeA, "udp", public.Addr},
+		{"www.example.", dns.TypeMX, "udp", public.Addr},
+		{"nx.example.", dns.TypeA, "tcp", public.Addr},
 	}
 
 	for _, tt := range tests {
@@ -67,10 +76,15 @@ func TestSmokingNewRunAndShutdown(t *testing.T) {
 			continue
 		}
 
-		if len(want.Answer) != len(got.Answer) || len(want.Question) != len(got.Question) || len(want.Extra) != len(got.Extra) {
+		if want.Rcode != got.Rcode || len(want.Answer) != len(got.Answer) || len(want.Question) != len(got.Question) || len(want.Extra) != len(got.Extra) {
 			t.Errorf("got different resolve results from expectedUpstream and freedns")
 		}
 	}
 
-	shut <- true
+	s.Shutdown()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Run should return after Shutdown")
+	}
 }
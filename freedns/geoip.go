@@ -0,0 +1,270 @@
+package freedns
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// GeoIP sorts the addresses of the answers by the location of the client, using local MaxMind databases.
+// The addresses in the same ASN as the client come first, then those in the same country.
+type GeoIP struct {
+	// Files are the MaxMind DB files, e.g. GeoLite2-Country.mmdb and GeoLite2-ASN.mmdb,
+	// looked up in order. They are reloaded when they change.
+	Files []string
+	// Filter removes the addresses farther from the client than the closest ones, instead of sorting them last.
+	Filter bool
+	// ClientIP locates the clients which are not in the databases, e.g. the public address of a LAN.
+	ClientIP string
+}
+
+// geoLocation is where an address is, the zero value when it is unknown.
+type geoLocation struct {
+	// country is the ISO 3166-1 code of the country, e.g. "CN".
+	country string
+	asn     uint64
+}
+
+// closeness scores how close the location is to the client: 2 for the same ASN, 1 for the same country.
+func (l geoLocation) closeness(client geoLocation) int {
+	switch {
+	case l.asn != 0 && l.asn == client.asn:
+		return 2
+	case l.country != "" && l.country == client.country:
+		return 1
+	}
+	return 0
+}
+
+// locationOf reads the location of the record of a GeoLite2 or GeoIP2 database.
+func locationOf(record interface{}) geoLocation {
+	var l geoLocation
+	m, _ := record.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := m[key].(map[string]interface{}); ok && l.country == "" {
+			l.country, _ = country["iso_code"].(string)
+		}
+	}
+	l.asn, _ = m["autonomous_system_number"].(uint64)
+	return l
+}
+
+type geoIP struct {
+	files    []string
+	filter   bool
+	clientIP net.IP
+	stats    *counters
+
+	mutex   sync.RWMutex
+	readers []*mmdbReader
+}
+
+func newGeoIP(cfg *GeoIP, stats *counters) (*geoIP, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if len(cfg.Files) == 0 {
+		return nil, Error("No MaxMind DB file for GeoIP")
+	}
+	g := &geoIP{
+		files:   cfg.Files,
+		filter:  cfg.Filter,
+		stats:   stats,
+		readers: make([]*mmdbReader, len(cfg.Files)),
+	}
+	if cfg.ClientIP != "" {
+		if g.clientIP = net.ParseIP(cfg.ClientIP); g.clientIP == nil {
+			return nil, Error("Invalid GeoIP client address " + cfg.ClientIP)
+		}
+	}
+	for i, file := range cfg.Files {
+		r, err := openMMDB(file)
+		if err != nil {
+			return nil, err
+		}
+		g.readers[i] = r
+	}
+	return g, nil
+}
+
+// locate merges the locations of the address in the databases, the first ones win.
+func (g *geoIP) locate(ip net.IP) geoLocation {
+	g.mutex.RLock()
+	readers := g.readers
+	g.mutex.RUnlock()
+
+	var l geoLocation
+	for _, r := range readers {
+		record, err := r.lookup(ip)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"op": "geoip",
+				"ip": ip,
+			}).Warn(err)
+			continue
+		}
+		found := locationOf(record)
+		if l.country == "" {
+			l.country = found.country
+		}
+		if l.asn == 0 {
+			l.asn = found.asn
+		}
+	}
+	return l
+}
+
+// reload reopens the database file, keeping the loaded one when the new one is invalid.
+func (g *geoIP) reload(file string) {
+	for i, name := range g.files {
+		if filepath.Clean(name) != filepath.Clean(file) {
+			continue
+		}
+		r, err := openMMDB(name)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"op":   "geoip_reload",
+				"file": name,
+			}).Warn(err)
+			continue
+		}
+		g.mutex.Lock()
+		readers := append([]*mmdbReader(nil), g.readers...)
+		readers[i] = r
+		g.readers = readers
+		g.mutex.Unlock()
+		g.stats.inc("geoip_reloads")
+		log.WithFields(logrus.Fields{
+			"op":   "geoip_reload",
+			"file": name,
+		}).Info()
+	}
+}
+
+// watch reloads the files when they change until done is closed. The directories are watched,
+// so the files replaced by a rename, like geoipupdate does, are reloaded too.
+func (g *geoIP) watch(done chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	for _, file := range g.files {
+		dir := filepath.Dir(file)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+					g.reload(event.Name)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.WithField("op", "geoip_watch").Warn(err)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// sortAnswer sorts the addresses of the answer by their closeness to the client, in place,
+// or only keeps the closest ones with Filter. The other records keep their order, the
+// addresses are moved where the first one was.
+func (g *geoIP) sortAnswer(res *dns.Msg, client net.IP) {
+	var addrs []dns.RR
+	for _, rr := range res.Answer {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			addrs = append(addrs, rr)
+		}
+	}
+	if len(addrs) < 2 {
+		return
+	}
+
+	location := g.locate(client)
+	if location == (geoLocation{}) && g.clientIP != nil {
+		location = g.locate(g.clientIP)
+	}
+	if location == (geoLocation{}) {
+		return
+	}
+
+	closeness := make(map[dns.RR]int, len(addrs))
+	best := 0
+	for _, rr := range addrs {
+		var ip net.IP
+		if a, ok := rr.(*dns.A); ok {
+			ip = a.A
+		} else {
+			ip = rr.(*dns.AAAA).AAAA
+		}
+		closeness[rr] = g.locate(ip).closeness(location)
+		if closeness[rr] > best {
+			best = closeness[rr]
+		}
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return closeness[addrs[i]] > closeness[addrs[j]]
+	})
+	if g.filter && best > 0 {
+		kept := addrs[:0]
+		for _, rr := range addrs {
+			if closeness[rr] == best {
+				kept = append(kept, rr)
+			}
+		}
+		if len(kept) < len(addrs) {
+			g.stats.inc("geoip_filtered")
+			// the signatures don't match the filtered RRsets anymore
+			res.AuthenticatedData = false
+		}
+		addrs = kept
+	}
+
+	answer := make([]dns.RR, 0, len(res.Answer))
+	for _, rr := range res.Answer {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			answer = append(answer, addrs...)
+			addrs = nil
+		default:
+			answer = append(answer, rr)
+		}
+	}
+	res.Answer = answer
+	g.stats.inc("geoip_sorted")
+}
+
+func (s *Server) serveGeoIP(ctx context.Context, req *Request, next Next) *dns.Msg {
+	res := next(ctx, req)
+	if s.geoip == nil || res == nil || res.Rcode != dns.RcodeSuccess || req.ClientIP == nil {
+		return res
+	}
+	s.geoip.sortAnswer(res, req.ClientIP)
+	return res
+}
@@ -0,0 +1,240 @@
+package freedns
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func country(code string) map[string]interface{} {
+	return map[string]interface{}{"country": map[string]interface{}{"iso_code": code}}
+}
+
+func asn(n uint32) map[string]interface{} {
+	return map[string]interface{}{"autonomous_system_number": n}
+}
+
+// writeTestGeoIP writes a country and an ASN database to dir.
+func writeTestGeoIP(t *testing.T, dir string) (string, string) {
+	countryFile := filepath.Join(dir, "country.mmdb")
+	asnFile := filepath.Join(dir, "asn.mmdb")
+	err := ioutil.WriteFile(countryFile, buildTestMMDB(t, 24, 6, []testNetwork{
+		{"1.0.0.0/8", country("CN")},
+		{"2.0.0.0/8", country("CN")},
+		{"3.0.0.0/8", country("US")},
+		{"2001:db8::/32", country("CN")},
+	}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(asnFile, buildTestMMDB(t, 28, 6, []testNetwork{
+		{"1.0.0.0/8", asn(4134)},
+		{"2.0.0.0/8", asn(4837)},
+	}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return countryFile, asnFile
+}
+
+func TestLocationOf(t *testing.T) {
+	tests := []struct {
+		record interface{}
+		want   geoLocation
+	}{
+		{nil, geoLocation{}},
+		{"invalid", geoLocation{}},
+		{country("CN"), geoLocation{country: "CN"}},
+		{map[string]interface{}{"registered_country": map[string]interface{}{"iso_code": "JP"}}, geoLocation{country: "JP"}},
+		{map[string]interface{}{
+			"country":            map[string]interface{}{"iso_code": "US"},
+			"registered_country": map[string]interface{}{"iso_code": "JP"},
+		}, geoLocation{country: "US"}},
+		{map[string]interface{}{"autonomous_system_number": uint64(15169)}, geoLocation{asn: 15169}},
+	}
+	for _, tt := range tests {
+		if got := locationOf(tt.record); got != tt.want {
+			t.Errorf("locationOf(%v) = %+v, want %+v", tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestGeoIPSortAnswer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freedns_geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	countryFile, asnFile := writeTestGeoIP(t, dir)
+
+	answer := []string{
+		"www.example. 300 IN CNAME cdn.example.",
+		"cdn.example. 300 IN A 3.3.3.3",
+		"cdn.example. 300 IN A 2.2.2.2",
+		"cdn.example. 300 IN A 1.1.1.1",
+		"cdn.example. 300 IN AAAA 2001:db8::1",
+	}
+	tests := []struct {
+		cfg    GeoIP
+		client string
+		want   []string
+	}{
+		{GeoIP{}, "1.0.0.9", []string{"www.example.", "1.1.1.1", "2.2.2.2", "2001:db8::1", "3.3.3.3"}},
+		{GeoIP{}, "2.0.0.9", []string{"www.example.", "2.2.2.2", "1.1.1.1", "2001:db8::1", "3.3.3.3"}},
+		{GeoIP{}, "3.0.0.9", []string{"www.example.", "3.3.3.3", "2.2.2.2", "1.1.1.1", "2001:db8::1"}},
+		{GeoIP{}, "2001:db8::9", []string{"www.example.", "2.2.2.2", "1.1.1.1", "2001:db8::1", "3.3.3.3"}},
+		// the unknown clients get the answer unchanged
+		{GeoIP{}, "192.168.1.2", []string{"www.example.", "3.3.3.3", "2.2.2.2", "1.1.1.1", "2001:db8::1"}},
+		{GeoIP{ClientIP: "1.0.0.1"}, "192.168.1.2", []string{"www.example.", "1.1.1.1", "2.2.2.2", "2001:db8::1", "3.3.3.3"}},
+		{GeoIP{Filter: true}, "1.0.0.9", []string{"www.example.", "1.1.1.1"}},
+		{GeoIP{Filter: true}, "3.0.0.9", []string{"www.example.", "3.3.3.3"}},
+		// nothing is filtered when no address is close to the client
+		{GeoIP{Filter: true}, "4.0.0.9", []string{"www.example.", "3.3.3.3", "2.2.2.2", "1.1.1.1", "2001:db8::1"}},
+	}
+	for _, tt := range tests {
+		tt.cfg.Files = []string{countryFile, asnFile}
+		g, err := newGeoIP(&tt.cfg, newCounters())
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := &dns.Msg{}
+		for _, s := range answer {
+			rr, _ := dns.NewRR(s)
+			res.Answer = append(res.Answer, rr)
+		}
+		g.sortAnswer(res, net.ParseIP(tt.client))
+
+		var got []string
+		for _, rr := range res.Answer {
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				got = append(got, rr.Hdr.Name)
+			case *dns.A:
+				got = append(got, rr.A.String())
+			case *dns.AAAA:
+				got = append(got, rr.AAAA.String())
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%+v for %s: got %v, want %v", tt.cfg, tt.client, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%+v for %s: got %v, want %v", tt.cfg, tt.client, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestInvalidGeoIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freedns_geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	countryFile, _ := writeTestGeoIP(t, dir)
+	invalid := filepath.Join(dir, "invalid.mmdb")
+	ioutil.WriteFile(invalid, []byte("invalid"), 0644)
+
+	for _, cfg := range []*GeoIP{
+		{},
+		{Files: []string{filepath.Join(dir, "missing.mmdb")}},
+		{Files: []string{invalid}},
+		{Files: []string{countryFile}, ClientIP: "invalid"},
+	} {
+		if _, err := newGeoIP(cfg, newCounters()); err == nil {
+			t.Errorf("Should not enable GeoIP with %+v", cfg)
+		}
+	}
+}
+
+func TestGeoIPReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freedns_geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	countryFile, asnFile := writeTestGeoIP(t, dir)
+
+	s, err := NewServer(Config{
+		FastUpstream:   "127.0.0.1:53",
+		CleanUpstream:  "127.0.0.1:53",
+		PublicUpstream: "127.0.0.1:53",
+		Listen:         "127.0.0.1:0",
+		GeoIP:          &GeoIP{Files: []string{countryFile, asnFile}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	if l := s.geoip.locate(net.ParseIP("3.3.3.3")); l.country != "US" {
+		t.Fatalf("unexpected location %+v", l)
+	}
+
+	// replace the file with a rename, like geoipupdate does
+	tmp := filepath.Join(dir, "country.mmdb.tmp")
+	ioutil.WriteFile(tmp, buildTestMMDB(t, 24, 6, []testNetwork{{"3.0.0.0/8", country("CA")}}), 0644)
+	if err := os.Rename(tmp, countryFile); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for s.geoip.locate(net.ParseIP("3.3.3.3")).country != "CA" {
+		if time.Now().After(deadline) {
+			t.Fatal("the database should be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if l := s.geoip.locate(net.ParseIP("1.1.1.1")); l != (geoLocation{asn: 4134}) {
+		t.Errorf("the other database should be kept, got %+v", l)
+	}
+
+	ioutil.WriteFile(countryFile, []byte("invalid"), 0644)
+	time.Sleep(100 * time.Millisecond)
+	if l := s.geoip.locate(net.ParseIP("3.3.3.3")); l.country != "CA" {
+		t.Errorf("the invalid database should be ignored, got %+v", l)
+	}
+	if s.stats.snapshot()["geoip_reloads"] == 0 {
+		t.Errorf("the reloads should be counted")
+	}
+}
+
+func TestServeGeoIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freedns_geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	countryFile, asnFile := writeTestGeoIP(t, dir)
+	s := &Server{stats: newCounters()}
+	if s.geoip, err = newGeoIP(&GeoIP{Files: []string{countryFile, asnFile}}, s.stats); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func(ctx context.Context, req *Request) *dns.Msg {
+		res := &dns.Msg{}
+		res.SetReply(req.Msg)
+		for _, ip := range []string{"3.3.3.3", "1.1.1.1"} {
+			rr, _ := dns.NewRR("www.example. 300 IN A " + ip)
+			res.Answer = append(res.Answer, rr)
+		}
+		return res
+	}
+	req := &Request{Msg: &dns.Msg{}, ClientIP: net.ParseIP("1.2.3.4")}
+	req.Msg.SetQuestion("www.example.", dns.TypeA)
+	res := s.serveGeoIP(context.Background(), req, next)
+	if res.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Errorf("the closest address should come first, got %v", res.Answer)
+	}
+	if s.stats.snapshot()["geoip_sorted"] != 1 {
+		t.Errorf("the sorted answers should be counted")
+	}
+}
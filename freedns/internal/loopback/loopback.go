@@ -0,0 +1,65 @@
+// Package loopback serves DNS on a loopback address, over udp and tcp on the same port
+// like a real upstream. It backs the fake upstreams of dnstest and of the replays.
+package loopback
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Server serves both udp and tcp on the same loopback address.
+type Server struct {
+	// Addr is the ip:port of the server.
+	Addr string
+
+	udp *dns.Server
+	tcp *dns.Server
+}
+
+// Start starts a server answering with `handler`, the caller should Close it.
+func Start(handler dns.Handler) (*Server, error) {
+	s := &Server{}
+
+	var err error
+	for i := 0; i < 10; i++ {
+		var l net.Listener
+		var pc net.PacketConn
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			continue
+		}
+		// the udp port is free most of the time, otherwise try another one
+		pc, err = net.ListenPacket("udp", l.Addr().String())
+		if err != nil {
+			l.Close()
+			continue
+		}
+		s.Addr = l.Addr().String()
+		s.tcp = &dns.Server{Listener: l, Handler: handler, MsgAcceptFunc: acceptAll}
+		s.udp = &dns.Server{PacketConn: pc, Handler: handler, MsgAcceptFunc: acceptAll}
+		break
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, server := range []*dns.Server{s.udp, s.tcp} {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go server.ActivateAndServe()
+		<-started
+	}
+	return s, nil
+}
+
+// acceptAll lets the handler see every message, the UPDATE requests included.
+func acceptAll(dh dns.Header) dns.MsgAcceptAction {
+	return dns.MsgAccept
+}
+
+// Close shuts the server down.
+func (s *Server) Close() {
+	s.udp.Shutdown()
+	s.tcp.Shutdown()
+}
@@ -0,0 +1,335 @@
+package freedns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// The batching of the set updates, so they never slow the answers down.
+const (
+	// ipsetQueueSize is how many addresses wait for the updater, the others are dropped.
+	ipsetQueueSize = 4096
+	// ipsetBatchSize and ipsetBatchDelay flush the batch when it is full or old enough.
+	ipsetBatchSize  = 256
+	ipsetBatchDelay = 50 * time.Millisecond
+)
+
+// SetRef names a kernel set, written "ipset:NAME" (or just "NAME") for the ipsets,
+// and "nftset:FAMILY#TABLE#SET" for the nftables sets, where FAMILY defaults to inet.
+// A "4#" or "6#" prefix, e.g. "nftset:4#inet#filter#proxy4", only keeps the IPv4 or IPv6 addresses.
+type SetRef struct {
+	// Nft is true for the nftables sets, false for the ipsets.
+	Nft bool
+	// Family and Table locate the nftables sets, e.g. "inet" and "filter".
+	Family string
+	Table  string
+	Name   string
+	// Version only keeps the IPv4 (4) or IPv6 (6) addresses, 0 keeps both.
+	Version int
+}
+
+// ParseSetRef parses the name of a set.
+func ParseSetRef(s string) (SetRef, error) {
+	ref := SetRef{}
+	spec := s
+	if strings.HasPrefix(spec, "nftset:") {
+		ref.Nft = true
+		spec = strings.TrimPrefix(spec, "nftset:")
+	} else {
+		spec = strings.TrimPrefix(spec, "ipset:")
+	}
+	if strings.HasPrefix(spec, "4#") || strings.HasPrefix(spec, "6#") {
+		ref.Version = int(spec[0] - '0')
+		spec = spec[2:]
+	}
+
+	parts := strings.Split(spec, "#")
+	switch {
+	case !ref.Nft && len(parts) == 1:
+		ref.Name = parts[0]
+	case ref.Nft && len(parts) == 2:
+		ref.Family, ref.Table, ref.Name = "inet", parts[0], parts[1]
+	case ref.Nft && len(parts) == 3:
+		ref.Family, ref.Table, ref.Name = parts[0], parts[1], parts[2]
+	default:
+		return SetRef{}, Error("Invalid set " + s)
+	}
+	if ref.Name == "" || (ref.Nft && ref.Table == "") {
+		return SetRef{}, Error("Invalid set " + s)
+	}
+	if ref.Nft {
+		if _, ok := nftFamilies[ref.Family]; !ok {
+			return SetRef{}, Error("Invalid nftables family " + ref.Family + " in " + s)
+		}
+	}
+	return ref, nil
+}
+
+func (ref SetRef) String() string {
+	version := ""
+	if ref.Version != 0 {
+		version = string(rune('0'+ref.Version)) + "#"
+	}
+	if ref.Nft {
+		return "nftset:" + version + ref.Family + "#" + ref.Table + "#" + ref.Name
+	}
+	return "ipset:" + version + ref.Name
+}
+
+// nftFamilies are the nftables families, with their NFPROTO numbers.
+var nftFamilies = map[string]uint8{
+	"inet":   1,
+	"ip":     2,
+	"arp":    3,
+	"netdev": 5,
+	"bridge": 7,
+	"ip6":    10,
+}
+
+// IPSetEntry is an address added to a set, which expires after Timeout.
+type IPSetEntry struct {
+	IP      net.IP
+	Timeout time.Duration
+}
+
+// IPSet adds addresses to kernel sets, Config.IPSetBackend can replace the netlink one.
+type IPSet interface {
+	// Add adds the entries to the set, refreshing the timeout of the existing ones.
+	// An *IPSetError tells how many entries failed, any other error fails them all.
+	Add(set SetRef, entries []IPSetEntry) error
+}
+
+// IPSetError is the error of IPSet.Add when some of the entries may have been added.
+type IPSetError struct {
+	// Failed is how many entries were not added.
+	Failed int
+	Err    error
+}
+
+func (e *IPSetError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *IPSetError) Unwrap() error {
+	return e.Err
+}
+
+// MemoryIPSet is an IPSet kept in memory, e.g. for testing.
+type MemoryIPSet struct {
+	mutex sync.Mutex
+	sets  map[string]map[string]time.Time
+}
+
+// NewMemoryIPSet returns an empty MemoryIPSet.
+func NewMemoryIPSet() *MemoryIPSet {
+	return &MemoryIPSet{sets: make(map[string]map[string]time.Time)}
+}
+
+func (m *MemoryIPSet) Add(set SetRef, entries []IPSetEntry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	name := set.String()
+	if m.sets[name] == nil {
+		m.sets[name] = make(map[string]time.Time)
+	}
+	for _, entry := range entries {
+		m.sets[name][entry.IP.String()] = time.Now().Add(entry.Timeout)
+	}
+	return nil
+}
+
+// Entries returns the addresses of the set which have not expired.
+func (m *MemoryIPSet) Entries(set string) []string {
+	ref, err := ParseSetRef(set)
+	if err != nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var ips []string
+	now := time.Now()
+	for ip, expire := range m.sets[ref.String()] {
+		if now.Before(expire) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+type ipsetUpdate struct {
+	set   SetRef
+	entry IPSetEntry
+}
+
+// ipsetUpdater adds the addresses to the sets in batches, in the background.
+type ipsetUpdater struct {
+	backend IPSet
+	stats   *counters
+	// rules map the lowercased domain suffixes to their sets.
+	rules map[string][]SetRef
+	// white are the sets of the white domains of the resolver.
+	white []SetRef
+	queue chan ipsetUpdate
+}
+
+func newIPSetUpdater(cfg Config, stats *counters) (*ipsetUpdater, error) {
+	if len(cfg.IPSets) == 0 && len(cfg.WhiteIPSets) == 0 {
+		return nil, nil
+	}
+	u := &ipsetUpdater{
+		backend: cfg.IPSetBackend,
+		stats:   stats,
+		rules:   make(map[string][]SetRef),
+		queue:   make(chan ipsetUpdate, ipsetQueueSize),
+	}
+	parse := func(names []string) ([]SetRef, error) {
+		refs := make([]SetRef, len(names))
+		for i, name := range names {
+			ref, err := ParseSetRef(name)
+			if err != nil {
+				return nil, err
+			}
+			refs[i] = ref
+		}
+		return refs, nil
+	}
+	for domain, names := range cfg.IPSets {
+		refs, err := parse(names)
+		if err != nil {
+			return nil, err
+		}
+		u.rules[strings.ToLower(strings.Trim(domain, "."))] = refs
+	}
+	var err error
+	if u.white, err = parse(cfg.WhiteIPSets); err != nil {
+		return nil, err
+	}
+	if u.backend == nil {
+		if u.backend, err = newNetlinkIPSet(); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// sets returns the sets of the domain: those of its longest matching suffix, and the white ones.
+func (u *ipsetUpdater) sets(name string, white bool) []SetRef {
+	var sets []SetRef
+	if white {
+		sets = append(sets, u.white...)
+	}
+	name = strings.ToLower(strings.TrimRight(name, "."))
+	for {
+		if refs, ok := u.rules[name]; ok {
+			return append(sets, refs...)
+		}
+		i := strings.Index(name, ".")
+		if i < 0 {
+			return sets
+		}
+		name = name[i+1:]
+	}
+}
+
+// enqueue queues the addresses of the answer for the sets, without ever blocking.
+func (u *ipsetUpdater) enqueue(sets []SetRef, res *dns.Msg) {
+	for _, rr := range res.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		timeout := time.Duration(rr.Header().Ttl) * time.Second
+		if timeout < time.Second {
+			timeout = time.Second
+		}
+		for _, set := range sets {
+			if (set.Version == 4 && ip.To4() == nil) || (set.Version == 6 && ip.To4() != nil) {
+				continue
+			}
+			select {
+			case u.queue <- ipsetUpdate{set, IPSetEntry{IP: ip, Timeout: timeout}}:
+			default:
+				u.stats.inc("ipset_dropped")
+			}
+		}
+	}
+}
+
+// run adds the queued addresses in batches until done is closed.
+func (u *ipsetUpdater) run(done chan struct{}) {
+	batch := make(map[SetRef][]IPSetEntry)
+	size := 0
+	timer := time.NewTimer(ipsetBatchDelay)
+	timer.Stop()
+
+	flush := func() {
+		for set, entries := range batch {
+			failed := 0
+			if err := u.backend.Add(set, entries); err != nil {
+				failed = len(entries)
+				var partial *IPSetError
+				if errors.As(err, &partial) && partial.Failed < failed {
+					failed = partial.Failed
+				}
+				log.WithFields(logrus.Fields{
+					"op":      "ipset",
+					"set":     set.String(),
+					"entries": len(entries),
+					"failed":  failed,
+				}).Error(err)
+			}
+			u.stats.add("ipset_errors", uint64(failed))
+			u.stats.add("ipset_added", uint64(len(entries)-failed))
+		}
+		batch = make(map[SetRef][]IPSetEntry)
+		size = 0
+	}
+
+	for {
+		select {
+		case update := <-u.queue:
+			if size == 0 {
+				timer.Reset(ipsetBatchDelay)
+			}
+			batch[update.set] = append(batch[update.set], update.entry)
+			size++
+			if size >= ipsetBatchSize {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		case <-done:
+			timer.Stop()
+			flush()
+			return
+		}
+	}
+}
+
+func (s *Server) serveIPSet(ctx context.Context, req *Request, next Next) *dns.Msg {
+	res := next(ctx, req)
+	if s.ipsets == nil || res == nil || res.Rcode != dns.RcodeSuccess || len(req.Msg.Question) == 0 {
+		return res
+	}
+	name := req.Msg.Question[0].Name
+	route := req.resolver.route(req.Msg.Question[0])
+	if sets := s.ipsets.sets(name, route == routeWhite || route == routeFast); len(sets) > 0 {
+		s.ipsets.enqueue(sets, res)
+	}
+	return res
+}
@@ -0,0 +1,261 @@
+//go:build linux
+// +build linux
+
+package freedns
+
+import (
+	"encoding/binary"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The netlink constants of the netfilter subsystems, from linux/netfilter/nfnetlink.h,
+// linux/netfilter/ipset/ip_set.h and linux/netfilter/nf_tables.h.
+const (
+	nlaFNested       = 0x8000
+	nlaFNetByteorder = 0x4000
+
+	nfnlSubsysIPSet     = 6
+	nfnlSubsysNFTables  = 10
+	nfnlMsgBatchBegin   = 0x10
+	nfnlMsgBatchEnd     = 0x11
+	ipsetProtocol       = 6
+	ipsetCmdAdd         = 9
+	ipsetAttrProtocol   = 1
+	ipsetAttrSetname    = 2
+	ipsetAttrData       = 7
+	ipsetAttrIP         = 1
+	ipsetAttrTimeout    = 6
+	ipsetAttrIPAddrIPv4 = 1
+	ipsetAttrIPAddrIPv6 = 2
+
+	nftMsgNewSetElem        = 12
+	nftaSetElemListTable    = 1
+	nftaSetElemListSet      = 2
+	nftaSetElemListElements = 3
+	nftaListElem            = 1
+	nftaSetElemKey          = 1
+	nftaSetElemTimeout      = 4
+	nftaDataValue           = 1
+)
+
+// nativeEndian is the byte order of the netlink headers.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// netlinkIPSet updates the ipsets and the nftables sets with netlink messages,
+// which needs CAP_NET_ADMIN.
+type netlinkIPSet struct {
+	seq uint32
+}
+
+func newNetlinkIPSet() (IPSet, error) {
+	return &netlinkIPSet{}, nil
+}
+
+func (n *netlinkIPSet) Add(set SetRef, entries []IPSetEntry) error {
+	if !set.Nft {
+		return ipsetResult(netlinkRequest(n.ipsetMessages(set, entries)))
+	}
+	failed, firstErr := 0, error(nil)
+	for _, family := range splitFamilies(entries) {
+		familyFailed, err := netlinkRequest(n.nftMessages(set, family))
+		failed += familyFailed
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return ipsetResult(failed, firstErr)
+}
+
+// splitFamilies splits the IPv4 and IPv6 entries. The keys of a nftables set have a single size,
+// so the families go in separate batches: the rejected batch of one doesn't lose the entries of the other.
+func splitFamilies(entries []IPSetEntry) [][]IPSetEntry {
+	var v4, v6 []IPSetEntry
+	for _, entry := range entries {
+		if entry.IP.To4() != nil {
+			v4 = append(v4, entry)
+		} else {
+			v6 = append(v6, entry)
+		}
+	}
+	var families [][]IPSetEntry
+	for _, family := range [][]IPSetEntry{v4, v6} {
+		if len(family) > 0 {
+			families = append(families, family)
+		}
+	}
+	return families
+}
+
+// ipsetResult returns the error of a request, an *IPSetError telling how many entries failed.
+func ipsetResult(failed int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &IPSetError{Failed: failed, Err: err}
+}
+
+// ipsetMessages returns one IPSET_CMD_ADD message per entry. Without NLM_F_EXCL
+// the existing entries get the new timeout instead of failing. The acks map the
+// sequence numbers of the messages to their number of entries.
+func (n *netlinkIPSet) ipsetMessages(set SetRef, entries []IPSetEntry) ([]byte, map[uint32]int) {
+	var msgs []byte
+	acks := make(map[uint32]int, len(entries))
+	for _, entry := range entries {
+		family, addrType, addr := uint8(syscall.AF_INET), uint16(ipsetAttrIPAddrIPv4), []byte(entry.IP.To4())
+		if addr == nil {
+			family, addrType, addr = syscall.AF_INET6, ipsetAttrIPAddrIPv6, entry.IP.To16()
+		}
+		timeout := make([]byte, 4)
+		binary.BigEndian.PutUint32(timeout, uint32(entry.Timeout/time.Second))
+
+		ip := appendAttr(nil, addrType|nlaFNetByteorder, addr)
+		data := appendAttr(nil, ipsetAttrIP|nlaFNested, ip)
+		data = appendAttr(data, ipsetAttrTimeout|nlaFNetByteorder, timeout)
+
+		attrs := appendAttr(nil, ipsetAttrProtocol, []byte{ipsetProtocol})
+		attrs = appendAttr(attrs, ipsetAttrSetname, append([]byte(set.Name), 0))
+		attrs = appendAttr(attrs, ipsetAttrData|nlaFNested, data)
+
+		n.seq++
+		msgs = appendNetlinkMsg(msgs, nfnlSubsysIPSet<<8|ipsetCmdAdd, syscall.NLM_F_REQUEST|syscall.NLM_F_ACK, n.seq, family, 0, attrs)
+		acks[n.seq] = 1
+	}
+	return msgs, acks
+}
+
+// nftMessages returns a batch adding all the entries with a single NFT_MSG_NEWSETELEM,
+// the entries must have the same address family.
+func (n *netlinkIPSet) nftMessages(set SetRef, entries []IPSetEntry) ([]byte, map[uint32]int) {
+	var elems []byte
+	for _, entry := range entries {
+		key := []byte(entry.IP.To4())
+		if key == nil {
+			key = entry.IP.To16()
+		}
+		timeout := make([]byte, 8)
+		binary.BigEndian.PutUint64(timeout, uint64(entry.Timeout/time.Millisecond))
+
+		elem := appendAttr(nil, nftaSetElemKey|nlaFNested, appendAttr(nil, nftaDataValue, key))
+		elem = appendAttr(elem, nftaSetElemTimeout, timeout)
+		elems = appendAttr(elems, nftaListElem|nlaFNested, elem)
+	}
+	attrs := appendAttr(nil, nftaSetElemListTable, append([]byte(set.Table), 0))
+	attrs = appendAttr(attrs, nftaSetElemListSet, append([]byte(set.Name), 0))
+	attrs = appendAttr(attrs, nftaSetElemListElements|nlaFNested, elems)
+
+	var msgs []byte
+	n.seq++
+	msgs = appendNetlinkMsg(msgs, nfnlMsgBatchBegin, syscall.NLM_F_REQUEST, n.seq, syscall.AF_UNSPEC, nfnlSubsysNFTables, nil)
+	n.seq++
+	msgs = appendNetlinkMsg(msgs, nfnlSubsysNFTables<<8|nftMsgNewSetElem, syscall.NLM_F_REQUEST|syscall.NLM_F_CREATE|syscall.NLM_F_ACK, n.seq, nftFamilies[set.Family], 0, attrs)
+	acks := map[uint32]int{n.seq: len(entries)}
+	n.seq++
+	msgs = appendNetlinkMsg(msgs, nfnlMsgBatchEnd, syscall.NLM_F_REQUEST, n.seq, syscall.AF_UNSPEC, nfnlSubsysNFTables, nil)
+	return msgs, acks
+}
+
+// appendAttr appends a netlink attribute, padded to 4 bytes.
+func appendAttr(b []byte, typ uint16, data []byte) []byte {
+	header := make([]byte, 4)
+	nativeEndian.PutUint16(header, uint16(4+len(data)))
+	nativeEndian.PutUint16(header[2:], typ)
+	b = append(append(b, header...), data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// appendNetlinkMsg appends a netfilter netlink message: nlmsghdr, nfgenmsg and the attributes.
+func appendNetlinkMsg(b []byte, typ uint16, flags uint16, seq uint32, family uint8, resID uint16, attrs []byte) []byte {
+	header := make([]byte, syscall.NLMSG_HDRLEN+4)
+	nativeEndian.PutUint32(header, uint32(len(header)+len(attrs)))
+	nativeEndian.PutUint16(header[4:], typ)
+	nativeEndian.PutUint16(header[6:], flags)
+	nativeEndian.PutUint32(header[8:], seq)
+	// nfgenmsg: family, version, res_id in network byte order
+	header[syscall.NLMSG_HDRLEN] = family
+	header[syscall.NLMSG_HDRLEN+1] = 0
+	binary.BigEndian.PutUint16(header[syscall.NLMSG_HDRLEN+2:], resID)
+	return append(append(b, header...), attrs...)
+}
+
+// netlinkRequest sends the messages to the netfilter subsystem and waits for their acks,
+// which map the sequence numbers of the messages to their number of entries.
+// It returns how many entries failed, with the first error.
+func netlinkRequest(msgs []byte, acks map[uint32]int) (int, error) {
+	pending := 0
+	for _, n := range acks {
+		pending += n
+	}
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return pending, err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return pending, err
+	}
+	tv := syscall.NsecToTimeval(int64(time.Second))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return pending, err
+	}
+	if err := syscall.Sendto(fd, msgs, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return pending, err
+	}
+
+	failed := 0
+	var firstErr error
+	buf := make([]byte, syscall.Getpagesize())
+	for len(acks) > 0 {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			for _, n := range acks {
+				failed += n
+			}
+			return failed, err
+		}
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			for _, n := range acks {
+				failed += n
+			}
+			return failed, err
+		}
+		for _, reply := range replies {
+			if reply.Header.Type != syscall.NLMSG_ERROR || len(reply.Data) < 4 {
+				continue
+			}
+			entries, ok := acks[reply.Header.Seq]
+			errno := int32(nativeEndian.Uint32(reply.Data))
+			if !ok && errno == 0 {
+				continue
+			}
+			if errno != 0 && firstErr == nil {
+				firstErr = Error("netlink: " + syscall.Errno(-errno).Error() + " (errno " + strconv.Itoa(int(-errno)) + ")")
+			}
+			if !ok {
+				// the error of a batch message fails the whole batch
+				for seq, n := range acks {
+					failed += n
+					delete(acks, seq)
+				}
+				continue
+			}
+			delete(acks, reply.Header.Seq)
+			if errno != 0 {
+				failed += entries
+			}
+		}
+	}
+	return failed, firstErr
+}
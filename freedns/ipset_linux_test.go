@@ -0,0 +1,59 @@
+package freedns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNetlinkIPSetMessages(t *testing.T) {
+	n := &netlinkIPSet{}
+	entries := []IPSetEntry{
+		{IP: net.ParseIP("1.2.3.4"), Timeout: 300 * time.Second},
+		{IP: net.ParseIP("fd00::1"), Timeout: time.Second},
+	}
+
+	wire, acks := n.ipsetMessages(SetRef{Name: "gfw"}, entries)
+	msgs, err := syscall.ParseNetlinkMessage(wire)
+	if err != nil || len(msgs) != 2 || len(acks) != 2 || acks[msgs[0].Header.Seq] != 1 {
+		t.Fatalf("expected a message per entry, got %d, %v", len(msgs), err)
+	}
+	for i, msg := range msgs {
+		if msg.Header.Type != nfnlSubsysIPSet<<8|ipsetCmdAdd || msg.Header.Flags&syscall.NLM_F_ACK == 0 {
+			t.Errorf("unexpected header %+v", msg.Header)
+		}
+		timeout := make([]byte, 4)
+		binary.BigEndian.PutUint32(timeout, uint32(entries[i].Timeout/time.Second))
+		ip := []byte(entries[i].IP.To4())
+		family := byte(syscall.AF_INET)
+		if ip == nil {
+			ip, family = entries[i].IP.To16(), syscall.AF_INET6
+		}
+		if msg.Data[0] != family || !bytes.Contains(msg.Data, []byte("gfw\x00")) || !bytes.Contains(msg.Data, ip) || !bytes.Contains(msg.Data, timeout) {
+			t.Errorf("message %d should carry the set, the address and the timeout: %x", i, msg.Data)
+		}
+	}
+
+	families := splitFamilies(append(entries, IPSetEntry{IP: net.ParseIP("5.6.7.8"), Timeout: time.Second}))
+	if len(families) != 2 || len(families[0]) != 2 || len(families[1]) != 1 || families[1][0].IP.To4() != nil {
+		t.Fatalf("the entries should be split by family, got %v", families)
+	}
+
+	wire, acks = n.nftMessages(SetRef{Nft: true, Family: "inet", Table: "fw", Name: "white"}, families[0])
+	msgs, err = syscall.ParseNetlinkMessage(wire)
+	if err != nil || len(msgs) != 3 || len(acks) != 1 || acks[msgs[1].Header.Seq] != 2 {
+		t.Fatalf("expected a batch of 3 messages, got %d, %v", len(msgs), err)
+	}
+	types := []uint16{nfnlMsgBatchBegin, nfnlSubsysNFTables<<8 | nftMsgNewSetElem, nfnlMsgBatchEnd}
+	for i, msg := range msgs {
+		if msg.Header.Type != types[i] {
+			t.Errorf("message %d has type %#x, want %#x", i, msg.Header.Type, types[i])
+		}
+	}
+	if data := msgs[1].Data; data[0] != nftFamilies["inet"] || !bytes.Contains(data, []byte("fw\x00")) || !bytes.Contains(data, []byte("white\x00")) {
+		t.Errorf("the elements should be added to inet fw white: %x", data)
+	}
+}
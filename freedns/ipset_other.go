@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package freedns
+
+func newNetlinkIPSet() (IPSet, error) {
+	return nil, Error("The ipsets and nftables sets are only supported on linux")
+}
@@ -0,0 +1,149 @@
+package freedns
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/freedns/dnstest"
+	"github.com/xiangyu123/cosp_dns/whitedomain"
+)
+
+func TestParseSetRef(t *testing.T) {
+	tests := []struct {
+		name string
+		ref  SetRef
+		ok   bool
+	}{
+		{"gfw", SetRef{Name: "gfw"}, true},
+		{"ipset:gfw", SetRef{Name: "gfw"}, true},
+		{"ipset:6#gfw6", SetRef{Name: "gfw6", Version: 6}, true},
+		{"nftset:filter#gfw", SetRef{Nft: true, Family: "inet", Table: "filter", Name: "gfw"}, true},
+		{"nftset:4#ip#nat#gfw4", SetRef{Nft: true, Family: "ip", Table: "nat", Name: "gfw4", Version: 4}, true},
+		{"nftset:gfw", SetRef{}, false},
+		{"nftset:foo#filter#gfw", SetRef{}, false},
+		{"ipset:", SetRef{}, false},
+		{"ipset:a#b", SetRef{}, false},
+	}
+	for _, tt := range tests {
+		ref, err := ParseSetRef(tt.name)
+		if (err == nil) != tt.ok || ref != tt.ref {
+			t.Errorf("ParseSetRef(%q) = %+v, %v, want %+v", tt.name, ref, err, tt.ref)
+		}
+		if err == nil {
+			if again, _ := ParseSetRef(ref.String()); again != ref {
+				t.Errorf("%q should parse back to %+v, got %+v", ref.String(), ref, again)
+			}
+		}
+	}
+}
+
+func TestIPSets(t *testing.T) {
+	upstream := dnstest.NewServer(dnstest.Records(
+		"www.corp.example. 300 IN A 10.0.0.1",
+		"www.corp.example. 300 IN AAAA fd00::1",
+		"www.shop.example. 60 IN CNAME cdn.example.",
+		"www.shop.example. 60 IN A 5.6.7.8",
+		"www.other.example. 300 IN A 9.9.9.9",
+	))
+	defer upstream.Close()
+
+	sets := NewMemoryIPSet()
+	s, err := NewServer(Config{
+		FastUpstream:   upstream.Addr,
+		CleanUpstream:  upstream.Addr,
+		PublicUpstream: upstream.Addr,
+		Listen:         "127.0.0.1:0",
+		IPSets: map[string][]string{
+			"shop.example": {"ipset:shop"},
+		},
+		WhiteIPSets:  []string{"nftset:4#inet#fw#white4", "nftset:6#inet#fw#white6"},
+		IPSetBackend: sets,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	s.resolver.whiteDomains = whitedomain.MustCompile([]string{"corp.example"})
+	ln, _ := newListener(Listener{Addr: "127.0.0.1:0"}, nil, "udp")
+
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"www.corp.example.", dns.TypeA},
+		{"www.corp.example.", dns.TypeAAAA},
+		{"www.shop.example.", dns.TypeA},
+		{"www.other.example.", dns.TypeA},
+	} {
+		req := &dns.Msg{}
+		req.SetQuestion(q.name, q.qtype)
+		w := newTestResponseWriter("127.0.0.1", "udp")
+		s.handle(w, req, ln)
+		if w.msg == nil || len(w.msg.Answer) == 0 {
+			t.Fatalf("%s: unexpected answer %v", q.name, w.msg)
+		}
+	}
+	time.Sleep(2 * ipsetBatchDelay)
+
+	tests := map[string][]string{
+		"nftset:4#inet#fw#white4": {"10.0.0.1"},
+		"nftset:6#inet#fw#white6": {"fd00::1"},
+		"ipset:shop":              {"5.6.7.8"},
+	}
+	for set, want := range tests {
+		got := sets.Entries(set)
+		sort.Strings(got)
+		if len(got) != len(want) || got[0] != want[0] {
+			t.Errorf("%s = %v, want %v", set, got, want)
+		}
+	}
+	if added := s.Stats()["ipset_added"]; added != 3 {
+		t.Errorf("the added addresses should be counted, got %d", added)
+	}
+}
+
+// failingIPSet fails to add the IPv6 entries, like a nftables set of ipv4_addr.
+type failingIPSet struct{}
+
+func (failingIPSet) Add(set SetRef, entries []IPSetEntry) error {
+	failed := 0
+	for _, entry := range entries {
+		if entry.IP.To4() == nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return &IPSetError{Failed: failed, Err: Error("invalid argument")}
+}
+
+func TestIPSetPartialErrors(t *testing.T) {
+	stats := newCounters()
+	u, err := newIPSetUpdater(Config{WhiteIPSets: []string{"nftset:inet#fw#white"}, IPSetBackend: failingIPSet{}}, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		u.run(done)
+		close(finished)
+	}()
+
+	res := &dns.Msg{}
+	for _, s := range []string{"www.corp.example. 300 IN A 10.0.0.1", "www.corp.example. 300 IN A 10.0.0.2", "www.corp.example. 300 IN AAAA fd00::1"} {
+		rr, _ := dns.NewRR(s)
+		res.Answer = append(res.Answer, rr)
+	}
+	u.enqueue(u.white, res)
+	time.Sleep(2 * ipsetBatchDelay)
+	close(done)
+	<-finished
+
+	if got := stats.snapshot(); got["ipset_added"] != 2 || got["ipset_errors"] != 1 {
+		t.Errorf("only the failed entries should be counted as errors, got %v", got)
+	}
+}
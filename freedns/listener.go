@@ -0,0 +1,56 @@
+package freedns
+
+// Listener is an address the server accepts queries on, with its own access control.
+type Listener struct {
+	// Name identifies the listener in logs and stats, defaults to Addr.
+	Name string
+	Addr string
+
+	// ACL overrides Config.ACL for this listener,
+	// UDPACL and TCPACL override it for a single transport.
+	ACL    *ACL
+	UDPACL *ACL
+	TCPACL *ACL
+}
+
+// listener is the runtime state of a Listener for one transport.
+type listener struct {
+	name string
+	addr string
+	net  string
+	acl  *compiledACL
+}
+
+func newListener(cfg Listener, defaultACL *ACL, net string) (*listener, error) {
+	addr, err := normalizeDnsAddress(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	name := cfg.Name
+	if name == "" {
+		name = addr
+	}
+
+	// the most specific policy wins
+	policy := defaultACL
+	if cfg.ACL != nil {
+		policy = cfg.ACL
+	}
+	if net == "udp" && cfg.UDPACL != nil {
+		policy = cfg.UDPACL
+	}
+	if net == "tcp" && cfg.TCPACL != nil {
+		policy = cfg.TCPACL
+	}
+	acl, err := compileACL(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &listener{
+		name: name,
+		addr: addr,
+		net:  net,
+		acl:  acl,
+	}, nil
+}
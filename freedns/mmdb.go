@@ -0,0 +1,319 @@
+package freedns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+)
+
+// mmdbMetadataMarker starts the metadata at the end of the MaxMind DB files.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbReader looks the addresses up in a MaxMind DB file, e.g. GeoLite2-Country.mmdb,
+// read in memory. See https://maxmind.github.io/MaxMind-DB/ for the format.
+type mmdbReader struct {
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// databaseType is e.g. "GeoLite2-Country" or "GeoLite2-ASN".
+	databaseType string
+
+	tree []byte
+	data mmdbDecoder
+	// ipv4Start is the node of ::/96, where the IPv4 addresses start in the IPv6 trees.
+	ipv4Start uint
+}
+
+func openMMDB(file string) (*mmdbReader, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newMMDBReader(buf)
+	if err != nil {
+		return nil, Error("Invalid MaxMind DB " + file + ": " + err.Error())
+	}
+	return r, nil
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, Error("the metadata is missing")
+	}
+	metadata, _, err := mmdbDecoder{buf[i+len(mmdbMetadataMarker):]}.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := metadata.(map[string]interface{})
+	if !ok {
+		return nil, Error("the metadata is not a map")
+	}
+	r := &mmdbReader{}
+	for key, field := range map[string]*uint{
+		"node_count":  &r.nodeCount,
+		"record_size": &r.recordSize,
+		"ip_version":  &r.ipVersion,
+	} {
+		value, ok := m[key].(uint64)
+		if !ok {
+			return nil, Error("the metadata " + key + " is missing")
+		}
+		*field = uint(value)
+	}
+	r.databaseType, _ = m["database_type"].(string)
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, Error("unsupported record size " + strconv.Itoa(int(r.recordSize)))
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, Error("unsupported ip version " + strconv.Itoa(int(r.ipVersion)))
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	// the tree is followed by 16 zero bytes, then the data section
+	if treeSize+16 > uint(i) {
+		return nil, Error("the search tree is truncated")
+	}
+	r.tree = buf[:treeSize]
+	r.data = mmdbDecoder{buf[treeSize+16 : i]}
+
+	if r.ipVersion == 6 {
+		for depth := 0; depth < 96 && r.ipv4Start < r.nodeCount; depth++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of the node.
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.tree[node*8+bit*4:]))
+	}
+}
+
+// lookup returns the data of the network containing the address, nil when there is none.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	var node uint
+	addr := ip.To4()
+	switch {
+	case addr != nil && r.ipVersion == 6:
+		node = r.ipv4Start
+	case addr == nil && r.ipVersion == 4:
+		return nil, nil
+	case addr == nil:
+		addr = ip.To16()
+	}
+	if addr == nil {
+		return nil, nil
+	}
+
+	for i := 0; i < len(addr)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(addr[i/8]>>(7-uint(i%8))&1))
+	}
+	switch {
+	case node == r.nodeCount:
+		return nil, nil
+	case node < r.nodeCount:
+		return nil, Error("the search tree is too deep")
+	}
+	offset := node - r.nodeCount - 16
+	value, _, err := r.data.decode(offset)
+	return value, err
+}
+
+// mmdbDecoder decodes the values of the data section, the maps are map[string]interface{},
+// the arrays []interface{}, the unsigned integers uint64 (uint128 are []byte) and int32 int64.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// The types of the data section.
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// errMMDBTruncated is returned for the values going past the end of the data section.
+const errMMDBTruncated = Error("the data section is truncated")
+
+func (d mmdbDecoder) bytes(offset uint, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.buf)) || offset+size < offset {
+		return nil, errMMDBTruncated
+	}
+	return d.buf[offset : offset+size], nil
+}
+
+// decode decodes the value at offset, and returns the offset following it.
+func (d mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	return d.decodeDepth(offset, 0)
+}
+
+func (d mmdbDecoder) decodeDepth(offset uint, depth int) (interface{}, uint, error) {
+	if depth > 64 {
+		return nil, 0, Error("the data is nested too deeply")
+	}
+	b, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	typ := uint(ctrl >> 5)
+
+	if typ == mmdbPointer {
+		ptrSize := uint(ctrl>>3) & 0x3
+		b, err := d.bytes(offset, ptrSize+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var ptr uint
+		switch ptrSize {
+		case 0:
+			ptr = uint(ctrl&0x7)<<8 | uint(b[0])
+		case 1:
+			ptr = (uint(ctrl&0x7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			ptr = (uint(ctrl&0x7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			ptr = uint(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := d.decodeDepth(ptr, depth+1)
+		return value, offset + ptrSize + 1, err
+	}
+
+	if typ == mmdbExtended {
+		b, err := d.bytes(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		default:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+
+	switch typ {
+	case mmdbMap, mmdbArray:
+		// every entry takes a byte at least, the corrupted sizes must not allocate the memory
+		if size > uint(len(d.buf)) {
+			return nil, 0, errMMDBTruncated
+		}
+	}
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decodeDepth(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, Error("the key of a map is not a string")
+			}
+			if m[name], offset, err = d.decodeDepth(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, size)
+		for i := range a {
+			if a[i], offset, err = d.decodeDepth(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbContainer, mmdbEndMarker:
+		return nil, offset, nil
+	}
+
+	b, err = d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbBytes, mmdbUint128:
+		return append([]byte(nil), b...), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, Error("invalid double size " + strconv.Itoa(int(size)))
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, Error("invalid float size " + strconv.Itoa(int(size)))
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		if size > 8 {
+			return nil, 0, Error("invalid integer size " + strconv.Itoa(int(size)))
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, Error("invalid integer size " + strconv.Itoa(int(size)))
+		}
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset, nil
+	}
+	return nil, 0, Error("unknown data type " + strconv.Itoa(int(typ)))
+}
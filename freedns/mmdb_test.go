@@ -0,0 +1,313 @@
+package freedns
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type testNetwork struct {
+	cidr string
+	data map[string]interface{}
+}
+
+// appendMMDBHeader appends the control byte of a value, with its extended type and size.
+func appendMMDBHeader(b []byte, typ int, size int) []byte {
+	ctrl, ext := typ, []byte(nil)
+	if typ > 7 {
+		ctrl, ext = 0, []byte{byte(typ - 7)}
+	}
+	var extSize []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		extSize = []byte{byte(size - 29)}
+		size = 29
+	case size < 65821:
+		v := size - 285
+		extSize = []byte{byte(v >> 8), byte(v)}
+		size = 30
+	default:
+		v := size - 65821
+		extSize = []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+		size = 31
+	}
+	b = append(b, byte(ctrl<<5|size))
+	return append(append(b, ext...), extSize...)
+}
+
+func appendMMDBUint(b []byte, typ int, n uint64) []byte {
+	var digits []byte
+	for ; n > 0; n >>= 8 {
+		digits = append([]byte{byte(n)}, digits...)
+	}
+	return append(appendMMDBHeader(b, typ, len(digits)), digits...)
+}
+
+// appendMMDBValue encodes a value in the format of the data section.
+func appendMMDBValue(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(appendMMDBHeader(b, mmdbString, len(v)), v...)
+	case uint16:
+		return appendMMDBUint(b, mmdbUint16, uint64(v))
+	case uint32:
+		return appendMMDBUint(b, mmdbUint32, uint64(v))
+	case uint64:
+		return appendMMDBUint(b, mmdbUint64, v)
+	case int32:
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(v))
+		return append(appendMMDBHeader(b, mmdbInt32, 4), n[:]...)
+	case float64:
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], math.Float64bits(v))
+		return append(appendMMDBHeader(b, mmdbDouble, 8), n[:]...)
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		return appendMMDBHeader(b, mmdbBool, size)
+	case []interface{}:
+		b = appendMMDBHeader(b, mmdbArray, len(v))
+		for _, item := range v {
+			b = appendMMDBValue(b, item)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b = appendMMDBHeader(b, mmdbMap, len(v))
+		for _, key := range keys {
+			b = appendMMDBValue(appendMMDBValue(b, key), v[key])
+		}
+		return b
+	}
+	panic("unsupported value")
+}
+
+// buildTestMMDB builds a MaxMind DB of the networks, which must not overlap.
+func buildTestMMDB(t *testing.T, recordSize int, ipVersion int, networks []testNetwork) []byte {
+	t.Helper()
+	var data []byte
+	offsets := make([]int, len(networks))
+	for i, n := range networks {
+		offsets[i] = len(data)
+		data = appendMMDBValue(data, n.data)
+	}
+
+	// the records are the index of the next node, -1 when empty, and -2-i for the data of networks[i]
+	nodes := [][2]int{{-1, -1}}
+	for i, n := range networks {
+		_, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipnet.Mask.Size()
+		ip := ipnet.IP
+		if ipVersion == 6 {
+			if ip.To4() != nil {
+				ones += 96
+			}
+			ip = ip.To16()
+			if ip4 := ipnet.IP.To4(); ip4 != nil {
+				// the IPv4 addresses are under ::/96, not ::ffff:0:0/96
+				ip = append(make(net.IP, 12), ip4...)
+			}
+		}
+		node := 0
+		for depth := 0; depth < ones; depth++ {
+			bit := ip[depth/8] >> (7 - uint(depth%8)) & 1
+			if depth == ones-1 {
+				nodes[node][bit] = -2 - i
+				break
+			}
+			next := nodes[node][bit]
+			if next < -1 {
+				t.Fatalf("%s overlaps another network", n.cidr)
+			}
+			if next == -1 {
+				nodes = append(nodes, [2]int{-1, -1})
+				next = len(nodes) - 1
+				nodes[node][bit] = next
+			}
+			node = next
+		}
+	}
+
+	count := len(nodes)
+	record := func(v int) uint32 {
+		switch {
+		case v >= 0:
+			return uint32(v)
+		case v == -1:
+			return uint32(count)
+		}
+		return uint32(count + 16 + offsets[-2-v])
+	}
+	var buf []byte
+	for _, node := range nodes {
+		left, right := record(node[0]), record(node[1])
+		switch recordSize {
+		case 24:
+			buf = append(buf, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			buf = append(buf, byte(left>>16), byte(left>>8), byte(left),
+				byte(left>>20)&0xf0|byte(right>>24)&0x0f, byte(right>>16), byte(right>>8), byte(right))
+		case 32:
+			buf = append(buf, byte(left>>24), byte(left>>16), byte(left>>8), byte(left),
+				byte(right>>24), byte(right>>16), byte(right>>8), byte(right))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, mmdbMetadataMarker...)
+	return appendMMDBValue(buf, map[string]interface{}{
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(recordSize),
+		"ip_version":                  uint16(ipVersion),
+		"database_type":               "Test",
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1600000000),
+		"languages":                   []interface{}{"en"},
+	})
+}
+
+func TestMMDBLookup(t *testing.T) {
+	networks := []testNetwork{
+		{"1.2.3.0/24", map[string]interface{}{"country": map[string]interface{}{"iso_code": "CN"}}},
+		{"5.6.0.0/16", map[string]interface{}{"country": map[string]interface{}{"iso_code": "US"}, "autonomous_system_number": uint32(15169)}},
+	}
+	networks6 := append(networks, testNetwork{"2001:db8::/32", map[string]interface{}{"autonomous_system_number": uint32(64500)}})
+
+	for _, recordSize := range []int{24, 28, 32} {
+		for _, ipVersion := range []int{4, 6} {
+			nets := networks
+			if ipVersion == 6 {
+				nets = networks6
+			}
+			r, err := newMMDBReader(buildTestMMDB(t, recordSize, ipVersion, nets))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.databaseType != "Test" {
+				t.Errorf("unexpected database type %q", r.databaseType)
+			}
+			tests := []struct {
+				ip   string
+				want geoLocation
+			}{
+				{"1.2.3.4", geoLocation{country: "CN"}},
+				{"1.2.4.1", geoLocation{}},
+				{"5.6.7.8", geoLocation{country: "US", asn: 15169}},
+				{"9.9.9.9", geoLocation{}},
+				{"2001:db8::1", geoLocation{asn: 64500}},
+				{"2001:db9::1", geoLocation{}},
+			}
+			for _, tt := range tests {
+				if ipVersion == 4 && strings.Contains(tt.ip, ":") {
+					tt.want = geoLocation{}
+				}
+				record, err := r.lookup(net.ParseIP(tt.ip))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := locationOf(record); got != tt.want {
+					t.Errorf("record size %d, ipv%d: %s is in %+v, want %+v", recordSize, ipVersion, tt.ip, got, tt.want)
+				}
+			}
+		}
+	}
+}
+
+func TestMMDBDecoder(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	huge := strings.Repeat("b", 70000)
+	near := 0
+	buf := appendMMDBValue(nil, "near")
+	hugeStart := len(buf)
+	buf = appendMMDBValue(buf, huge)
+	target := len(buf)
+	buf = appendMMDBValue(buf, "target")
+
+	values := []interface{}{long, uint64(1) << 40, int32(-5), 1.5, true, false, []interface{}{"x", uint32(7)}, uint16(0)}
+	starts := make([]int, len(values))
+	for i, v := range values {
+		starts[i] = len(buf)
+		buf = appendMMDBValue(buf, v)
+	}
+	// pointers with one byte (to `near`) and two bytes (to `target`)
+	ptr0 := len(buf)
+	buf = append(buf, byte(mmdbPointer<<5|near>>8), byte(near))
+	ptr1 := len(buf)
+	v := target - 2048
+	buf = append(buf, byte(mmdbPointer<<5|1<<3|v>>16), byte(v>>8), byte(v))
+
+	d := mmdbDecoder{buf}
+	want := []interface{}{long, uint64(1) << 40, int64(-5), 1.5, true, false, nil, uint64(0)}
+	for i, start := range starts {
+		got, next, err := d.decode(uint(start))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i+1 < len(starts) && next != uint(starts[i+1]) {
+			t.Errorf("value %d ends at %d, want %d", i, next, starts[i+1])
+		}
+		if want[i] != nil && got != want[i] {
+			t.Errorf("value %d = %v, want %v", i, got, want[i])
+		}
+	}
+	if a, _, _ := d.decode(uint(starts[6])); len(a.([]interface{})) != 2 || a.([]interface{})[1] != uint64(7) {
+		t.Errorf("unexpected array %v", a)
+	}
+	if got, _, _ := d.decode(uint(hugeStart)); got != huge {
+		t.Errorf("the string of 70000 bytes is not decoded")
+	}
+	if got, next, err := d.decode(uint(ptr0)); got != "near" || next != uint(ptr1) || err != nil {
+		t.Errorf("pointer = %v, %d, %v", got, next, err)
+	}
+	if got, next, err := d.decode(uint(ptr1)); got != "target" || next != uint(len(buf)) || err != nil {
+		t.Errorf("pointer = %v, %d, %v", got, next, err)
+	}
+
+	for _, corrupted := range [][]byte{
+		{},
+		appendMMDBHeader(nil, mmdbString, 10),
+		appendMMDBHeader(nil, mmdbMap, 1000),
+		appendMMDBHeader(nil, mmdbUint32, 9),
+		{byte(mmdbPointer << 5), 10},
+		// a pointer to itself
+		{byte(mmdbPointer << 5), 0},
+	} {
+		if _, _, err := (mmdbDecoder{corrupted}).decode(0); err == nil {
+			t.Errorf("should not decode %v", corrupted)
+		}
+	}
+}
+
+func TestInvalidMMDB(t *testing.T) {
+	valid := buildTestMMDB(t, 24, 6, nil)
+	metadata := func(m map[string]interface{}) []byte {
+		return appendMMDBValue(append(make([]byte, 16), mmdbMetadataMarker...), m)
+	}
+	for _, buf := range [][]byte{
+		nil,
+		valid[:len(valid)-30],
+		metadata(map[string]interface{}{"node_count": uint32(1), "record_size": uint16(20), "ip_version": uint16(6)}),
+		metadata(map[string]interface{}{"node_count": uint32(1), "record_size": uint16(24), "ip_version": uint16(5)}),
+		metadata(map[string]interface{}{"node_count": uint32(100), "record_size": uint16(24), "ip_version": uint16(6)}),
+		metadata(map[string]interface{}{"record_size": uint16(24), "ip_version": uint16(6)}),
+	} {
+		if _, err := newMMDBReader(buf); err == nil {
+			t.Errorf("should not read %v", buf)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package freedns
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// isNegative returns true for NXDOMAIN and NODATA answers.
+func isNegative(res *dns.Msg) bool {
+	if res.Rcode == dns.RcodeNameError {
+		return true
+	}
+	return res.Rcode == dns.RcodeSuccess && len(res.Answer) == 0
+}
+
+// negativeTTL returns how long a negative answer can be cached: the minimum of the TTL and
+// the MINIMUM field of the SOA in the authority section, capped by maxTTL (RFC 2308 5).
+// Negative answers without SOA must not be cached.
+func negativeTTL(res *dns.Msg, maxTTL time.Duration) (uint32, bool) {
+	for _, rr := range res.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		if max := uint32(maxTTL.Seconds()); ttl > max {
+			ttl = max
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+// store caches the response of the upstreams: positive answers for their TTL clamped by the
+// TTL policy, negative answers for their negative TTL, and failures for ServfailTTL.
+func (s *Server) store(cache *dnsCache, q dns.Question, recursion bool, res *dns.Msg, net string) {
+	switch {
+	case res.Rcode == dns.RcodeServerFailure:
+		if s.config.ServfailTTL <= 0 {
+			return
+		}
+		key := requestToString(q, recursion, net)
+		cache.put(key, cacheEntry{
+			putin: time.Now(),
+			reply: res.Copy(),
+			ttl:   uint32(s.config.ServfailTTL.Seconds()),
+		})
+	case isNegative(res):
+		ttl, ok := negativeTTL(res, s.config.MaxNegativeTTL)
+		if !ok {
+			return
+		}
+		// the SOA carries the negative TTL to the cache and to the client
+		for _, rr := range res.Ns {
+			if rr.Header().Ttl > ttl {
+				rr.Header().Ttl = ttl
+			}
+		}
+		cache.set(res, net)
+	case res.Rcode == dns.RcodeSuccess:
+		policy := s.ttlPolicy(q.Name)
+		if policy.RewriteClientTTL {
+			policy.clampTTLs(res)
+		}
+		entry := cacheEntry{
+			putin: time.Now(),
+			reply: res.Copy(),
+		}
+		// the clients keep seeing the published TTLs while the entry lives for the clamped one
+		if ttl, ok := minTTL(res); ok && policy.clamp(ttl) != ttl {
+			entry.ttl = policy.clamp(ttl)
+		}
+		cache.put(requestToString(q, recursion, net), entry)
+	}
+}
+
+// countCacheHit counts the answers served from the cache by kind.
+func (s *Server) countCacheHit(res *dns.Msg) {
+	switch {
+	case res.Rcode == dns.RcodeServerFailure:
+		s.stats.inc("cache_servfail_hits")
+	case isNegative(res):
+		s.stats.inc("cache_negative_hits")
+	default:
+		s.stats.inc("cache_hits")
+	}
+}
@@ -0,0 +1,108 @@
+package freedns
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNegativeTTL(t *testing.T) {
+	tests := []struct {
+		soa    string
+		maxTTL time.Duration
+		ttl    uint32
+		ok     bool
+	}{
+		{"example.com. 3600 IN SOA ns. admin. 1 7200 900 1209600 60", time.Hour, 60, true},
+		{"example.com. 30 IN SOA ns. admin. 1 7200 900 1209600 600", time.Hour, 30, true},
+		{"example.com. 86400 IN SOA ns. admin. 1 7200 900 1209600 86400", time.Hour, 3600, true},
+		{"", time.Hour, 0, false},
+	}
+	for _, tt := range tests {
+		res := &dns.Msg{}
+		res.SetQuestion("nx.example.com.", dns.TypeA)
+		res.Rcode = dns.RcodeNameError
+		if tt.soa != "" {
+			res.Ns = append(res.Ns, mustRR(t, tt.soa))
+		}
+		ttl, ok := negativeTTL(res, tt.maxTTL)
+		if ttl != tt.ttl || ok != tt.ok {
+			t.Errorf("negativeTTL(%q) = %d, %v, want %d, %v", tt.soa, ttl, ok, tt.ttl, tt.ok)
+		}
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	var queries int32
+	addr, shutdown := startTestUpstream(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		res := &dns.Msg{}
+		switch req.Question[0].Name {
+		case "nx.example.":
+			res.SetRcode(req, dns.RcodeNameError)
+			res.Ns = append(res.Ns, mustRR(t, "example. 3600 IN SOA ns. admin. 1 7200 900 1209600 60"))
+		case "nodata.example.":
+			res.SetReply(req)
+			res.Ns = append(res.Ns, mustRR(t, "example. 30 IN SOA ns. admin. 1 7200 900 1209600 600"))
+		case "nosoa.example.":
+			res.SetRcode(req, dns.RcodeNameError)
+		default:
+			res.SetRcode(req, dns.RcodeServerFailure)
+		}
+		w.WriteMsg(res)
+	}))
+	defer shutdown()
+
+	s, err := NewServer(Config{
+		FastUpstream:   addr,
+		CleanUpstream:  addr,
+		PublicUpstream: addr,
+		Listen:         "127.0.0.1:0",
+		Cache:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, _ := newListener(Listener{Addr: "127.0.0.1:0"}, nil, "udp")
+	query := func(name string) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		w := newTestResponseWriter("127.0.0.1", "udp")
+		s.handle(w, req, ln)
+		return w.msg
+	}
+
+	tests := []struct {
+		name    string
+		rcode   int
+		ttl     uint32
+		queries int32
+	}{
+		{"nx.example.", dns.RcodeNameError, 60, 1},
+		{"nodata.example.", dns.RcodeSuccess, 30, 1},
+		{"nosoa.example.", dns.RcodeNameError, 0, 2},
+		{"failing.example.", dns.RcodeServerFailure, 0, 1},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&queries, 0)
+		for i := 0; i < 2; i++ {
+			res := query(tt.name)
+			if res.Rcode != tt.rcode {
+				t.Errorf("%s: rcode = %s, want %s", tt.name, dns.RcodeToString[res.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if tt.ttl > 0 && (len(res.Ns) != 1 || res.Ns[0].Header().Ttl > tt.ttl || res.Ns[0].Header().Ttl < tt.ttl-1) {
+				t.Errorf("%s: the SOA should carry the negative TTL %d, got %v", tt.name, tt.ttl, res.Ns)
+			}
+		}
+		if n := atomic.LoadInt32(&queries); n != tt.queries {
+			t.Errorf("%s: the upstream got %d queries, want %d", tt.name, n, tt.queries)
+		}
+	}
+
+	stats := s.Stats()
+	if stats["cache_negative_hits"] != 2 || stats["cache_servfail_hits"] != 1 || stats["cache_hits"] != 0 {
+		t.Errorf("cache hits should be counted by kind, got %v", stats)
+	}
+}
@@ -0,0 +1,98 @@
+package freedns
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// prefetchMinWindow is how long before expiry the hot entries are refreshed at least.
+// It must be larger than the 3 seconds of subTTL, so clients never wait for the update.
+const prefetchMinWindow = 5 * time.Second
+
+type prefetcher struct {
+	minHits uint32
+	slots   chan struct{}
+}
+
+func newPrefetcher(minHits int, concurrency int) *prefetcher {
+	if minHits <= 0 {
+		minHits = 3
+	}
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	return &prefetcher{
+		minHits: uint32(minHits),
+		slots:   make(chan struct{}, concurrency),
+	}
+}
+
+// prefetchDue returns true if the entry expires within the prefetch window,
+// which is a tenth of its TTL or prefetchMinWindow.
+func prefetchDue(entry cacheEntry, now time.Time) bool {
+	ttl, ok := entry.lifetime()
+	if !ok {
+		return false
+	}
+	lifetime := time.Duration(ttl) * time.Second
+	window := lifetime / 10
+	if window < prefetchMinWindow {
+		window = prefetchMinWindow
+	}
+	return now.Sub(entry.putin)+window >= lifetime
+}
+
+// keyNet returns the transport of a key generated by requestToString.
+func keyNet(key string) string {
+	return key[strings.LastIndex(key, "_")+1:]
+}
+
+// prefetchPeriodically refreshes the hot entries of the caches until done is closed.
+func (s *Server) prefetchPeriodically(p *prefetcher, done chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.prefetch(p, s.resolver)
+			for _, v := range s.views {
+				s.prefetch(p, v.resolver)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *Server) prefetch(p *prefetcher, resolver *spoofingProofResolver) {
+	now := time.Now()
+	for _, key := range resolver.cache.hot(p.minHits) {
+		entry, ok := resolver.cache.get(key)
+		if !ok || !prefetchDue(entry, now) {
+			continue
+		}
+
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			// too many prefetches running, the next tick tries again
+			return
+		}
+		resolver.cache.resetHits(key)
+		s.stats.inc("prefetch")
+
+		q := entry.reply.Question[0]
+		log.WithFields(logrus.Fields{
+			"op":     "prefetch",
+			"domain": q.Name,
+			"type":   dns.TypeToString[q.Qtype],
+		}).Debug()
+		go func(q dns.Question, recursion bool, net string) {
+			defer func() { <-p.slots }()
+			s.refresh(resolver, q, recursion, net)
+		}(q, entry.reply.RecursionDesired, keyNet(key))
+	}
+}
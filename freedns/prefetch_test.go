@@ -0,0 +1,80 @@
+package freedns
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPrefetchDue(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		ttl string
+		age time.Duration
+		due bool
+	}{
+		{"300", 0, false},
+		{"300", 269 * time.Second, false},
+		{"300", 271 * time.Second, true},
+		{"20", 14 * time.Second, false},
+		{"20", 16 * time.Second, true},
+		{"20", time.Minute, true},
+	}
+	for _, tt := range tests {
+		entry := cacheEntry{putin: now.Add(-tt.age), reply: newCachedReply(t, "example.com.", tt.ttl)}
+		if got := prefetchDue(entry, now); got != tt.due {
+			t.Errorf("prefetchDue(ttl %s, age %v) = %v, want %v", tt.ttl, tt.age, got, tt.due)
+		}
+	}
+}
+
+func TestPrefetchHotEntries(t *testing.T) {
+	var queries int32
+	addr, shutdown := startTestUpstream(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		answerA("1.2.3.4")(w, req)
+	}))
+	defer shutdown()
+
+	s, err := NewServer(Config{
+		FastUpstream:   addr,
+		CleanUpstream:  addr,
+		PublicUpstream: addr,
+		Listen:         "127.0.0.1:0",
+		Cache:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := s.resolver.cache
+
+	hot := dns.Question{Name: "hot.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	cold := dns.Question{Name: "cold.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	for _, q := range []dns.Question{hot, cold} {
+		reply := newCachedReply(t, q.Name, "20")
+		reply.RecursionDesired = true
+		cache.put(requestToString(q, true, "udp"), cacheEntry{putin: time.Now().Add(-18 * time.Second), reply: reply})
+	}
+	for i := 0; i < 3; i++ {
+		cache.lookup(hot, true, "udp")
+	}
+	cache.lookup(cold, true, "udp")
+
+	p := newPrefetcher(3, 1)
+	s.prefetch(p, s.resolver)
+	// wait for the prefetch slot to be released
+	p.slots <- struct{}{}
+
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Fatalf("only the hot entry should be prefetched, got %d queries", n)
+	}
+	res, needUpdate := cache.lookup(hot, true, "udp")
+	if needUpdate || res.Answer[0].Header().Ttl != 300 {
+		t.Errorf("the hot entry should be refreshed, got %v", res)
+	}
+	if s.Stats()["prefetch"] != 1 {
+		t.Errorf("prefetches should be counted")
+	}
+}
@@ -0,0 +1,400 @@
+package freedns
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// proxyTimeout bounds the whole exchange through a proxy, like the timeouts of dns.Client.
+const proxyTimeout = 2 * time.Second
+
+// splitUpstream splits the options off an upstream, e.g. "8.8.8.8:53?proxy=socks5://127.0.0.1:1080".
+func splitUpstream(upstream string) (string, url.Values, error) {
+	i := strings.Index(upstream, "?")
+	if i < 0 {
+		return upstream, nil, nil
+	}
+	options, err := url.ParseQuery(upstream[i+1:])
+	if err != nil {
+		// the options may hold the password of a proxy
+		return "", nil, Error("Invalid options of upstream " + upstream[:i] + ": " + err.Error())
+	}
+	return upstream[:i], options, nil
+}
+
+// redactUpstream hides the password of the proxy of an upstream, wherever the upstream
+// leaves the dialer: in the logs, the fixtures and the decisions.
+func redactUpstream(upstream string) string {
+	addr, options, err := splitUpstream(upstream)
+	if err != nil {
+		return upstream[:strings.Index(upstream, "?")] + "?xxxxx"
+	}
+	raw := options.Get("proxy")
+	if raw == "" {
+		return upstream
+	}
+	proxy, err := url.Parse(raw)
+	if err != nil {
+		options.Set("proxy", "xxxxx")
+	} else if redacted := redactURL(proxy); redacted != raw {
+		options.Set("proxy", redacted)
+	} else {
+		return upstream
+	}
+	return addr + "?" + options.Encode()
+}
+
+// redactURL is url.URL.String with the password replaced by "xxxxx".
+func redactURL(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+	if _, ok := u.User.Password(); !ok {
+		return u.String()
+	}
+	redacted := *u
+	redacted.User = url.UserPassword(u.User.Username(), "xxxxx")
+	return redacted.String()
+}
+
+// parseUpstream splits the upstream into its address, its options and its proxy, nil when there is none.
+func parseUpstream(upstream string) (string, url.Values, *url.URL, error) {
+	addr, options, err := splitUpstream(upstream)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	proxy, err := parseProxy(options)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return addr, options, proxy, nil
+}
+
+// parseProxy parses the proxy option of an upstream, nil when there is none.
+func parseProxy(options url.Values) (*url.URL, error) {
+	raw := options.Get("proxy")
+	if raw == "" {
+		return nil, nil
+	}
+	proxy, err := url.Parse(raw)
+	if err != nil {
+		// the error of url.Parse quotes the whole url, the password included
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return nil, Error("Invalid proxy: " + err.Error())
+	}
+	switch proxy.Scheme {
+	case "socks5", "http":
+	default:
+		return nil, Error("Unsupported proxy " + redactURL(proxy) + ", socks5:// or http:// is expected")
+	}
+	if proxy.Port() == "" {
+		return nil, Error("Invalid proxy " + redactURL(proxy) + ": the port is missing")
+	}
+	return proxy, nil
+}
+
+// exchangeViaProxy sends the request `r` to the upstream `addr` through the proxy, which is
+// dialed with the options of the upstream. SOCKS5 proxies relay udp with UDP ASSOCIATE,
+// HTTP proxies only relay tcp so udp falls back to it. The exchange is aborted when ctx is done.
+func exchangeViaProxy(ctx context.Context, r *dns.Msg, network string, addr string, proxy *url.URL, options url.Values) (*dns.Msg, error) {
+	deadline := time.Now().Add(proxyTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	tcpDialer, err := upstreamDialer(options, "tcp")
+	if err != nil {
+		return nil, err
+	}
+	tcpDialer.Deadline = deadline
+
+	var conn net.Conn
+	switch {
+	case proxy.Scheme == "socks5" && network == "udp":
+		var udpDialer *net.Dialer
+		if udpDialer, err = upstreamDialer(options, "udp"); err == nil {
+			conn, err = socks5Associate(ctx, tcpDialer, udpDialer, proxy, addr, deadline)
+		}
+	case proxy.Scheme == "socks5":
+		conn, err = socks5Connect(ctx, tcpDialer, proxy, addr, deadline)
+	default:
+		conn, err = httpConnect(ctx, tcpDialer, proxy, addr, deadline)
+	}
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	co := &dns.Conn{Conn: conn, UDPSize: dns.MaxMsgSize}
+	if opt := r.IsEdns0(); opt != nil {
+		// the relayed datagrams are read into buffers of this size
+		co.UDPSize = opt.UDPSize()
+	}
+	defer co.Close()
+	return exchangeConn(ctx, co, r, deadline)
+}
+
+// socks5Handshake opens a connection to the SOCKS5 proxy, authenticates,
+// and sends the command `cmd` for `addr`. It returns the address bound by the proxy.
+func socks5Handshake(ctx context.Context, dialer *net.Dialer, proxy *url.URL, cmd byte, addr string, deadline time.Time) (net.Conn, string, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, "", err
+	}
+	conn.SetDeadline(deadline)
+	fail := func(err error) (net.Conn, string, error) {
+		conn.Close()
+		return nil, "", err
+	}
+
+	methods := []byte{0x00}
+	if proxy.User != nil {
+		methods = []byte{0x00, 0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return fail(err)
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return fail(err)
+	}
+	switch {
+	case reply[0] != 0x05:
+		return fail(Error("socks5: invalid version from proxy " + proxy.Host))
+	case reply[1] == 0x02 && proxy.User != nil:
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		auth := append([]byte{0x01, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		if _, err := conn.Write(auth); err != nil {
+			return fail(err)
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return fail(err)
+		}
+		if reply[1] != 0x00 {
+			return fail(Error("socks5: authentication failed with proxy " + proxy.Host))
+		}
+	case reply[1] != 0x00:
+		return fail(Error("socks5: no acceptable authentication method for proxy " + proxy.Host))
+	}
+
+	req, err := appendSocks5Addr([]byte{0x05, cmd, 0x00}, addr)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return fail(err)
+	}
+	var header [3]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return fail(err)
+	}
+	if header[1] != 0x00 {
+		return fail(Error("socks5: proxy " + proxy.Host + " refused the command with code " + strconv.Itoa(int(header[1]))))
+	}
+	bound, err := readSocks5Addr(conn)
+	if err != nil {
+		return fail(err)
+	}
+	return conn, bound, nil
+}
+
+func socks5Connect(ctx context.Context, dialer *net.Dialer, proxy *url.URL, addr string, deadline time.Time) (net.Conn, error) {
+	conn, _, err := socks5Handshake(ctx, dialer, proxy, 0x01, addr, deadline)
+	return conn, err
+}
+
+// socks5Associate asks the proxy to relay udp to `addr`, the datagrams are sent to the relay address it returns.
+func socks5Associate(ctx context.Context, tcpDialer, udpDialer *net.Dialer, proxy *url.URL, addr string, deadline time.Time) (net.Conn, error) {
+	target, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ctrl, bound, err := socks5Handshake(ctx, tcpDialer, proxy, 0x03, "0.0.0.0:0", deadline)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(bound)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		// the relay listens on the address of the proxy
+		host = proxy.Hostname()
+	}
+	relay, err := udpDialer.DialContext(ctx, "udp", net.JoinHostPort(host, port))
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	return &socks5UDPConn{UDPConn: relay.(*net.UDPConn), ctrl: ctrl, target: target}, nil
+}
+
+// socks5UDPConn wraps the datagrams to the relay of the proxy with the SOCKS5 udp header.
+// It is a net.PacketConn so dns.Conn doesn't prefix the messages with their length.
+type socks5UDPConn struct {
+	*net.UDPConn
+	// ctrl keeps the association alive, it ends when the tcp connection is closed.
+	ctrl   net.Conn
+	target *net.UDPAddr
+}
+
+func (c *socks5UDPConn) Write(p []byte) (int, error) {
+	packet, err := appendSocks5Addr([]byte{0x00, 0x00, 0x00}, c.target.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.UDPConn.Write(append(packet, p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socks5UDPConn) Read(p []byte) (int, error) {
+	buf := make([]byte, len(p)+262)
+	n, err := c.UDPConn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	if n < 4 || buf[2] != 0x00 {
+		return 0, Error("socks5: invalid udp datagram from the relay")
+	}
+	header := 4
+	switch buf[3] {
+	case 0x01:
+		header += net.IPv4len
+	case 0x04:
+		header += net.IPv6len
+	case 0x03:
+		if n < 5 {
+			return 0, Error("socks5: invalid udp datagram from the relay")
+		}
+		header += 1 + int(buf[4])
+	default:
+		return 0, Error("socks5: unknown address type from the relay")
+	}
+	header += 2
+	if n < header {
+		return 0, Error("socks5: invalid udp datagram from the relay")
+	}
+	return copy(p, buf[header:n]), nil
+}
+
+func (c *socks5UDPConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
+
+// appendSocks5Addr appends the SOCKS5 encoding of the address "host:port".
+func appendSocks5Addr(b []byte, addr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, Error("socks5: invalid port in " + addr)
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, Error("socks5: host name too long " + host)
+		}
+		b = append(append(b, 0x03, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, 0x01), ip4...)
+	} else {
+		b = append(append(b, 0x04), ip.To16()...)
+	}
+	return appendUint16(b, uint16(portNum)), nil
+}
+
+// readSocks5Addr reads a SOCKS5 encoded address.
+func readSocks5Addr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host []byte
+	switch atyp[0] {
+	case 0x01:
+		host = make([]byte, net.IPv4len)
+	case 0x04:
+		host = make([]byte, net.IPv6len)
+	case 0x03:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return "", err
+		}
+		host = make([]byte, length[0])
+	default:
+		return "", Error("socks5: invalid address type " + strconv.Itoa(int(atyp[0])))
+	}
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	hostname := string(host)
+	if atyp[0] != 0x03 {
+		hostname = net.IP(host).String()
+	}
+	return net.JoinHostPort(hostname, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// httpConnect opens a tunnel to `addr` through the HTTP proxy.
+func httpConnect(ctx context.Context, dialer *net.Dialer, proxy *url.URL, addr string, deadline time.Time) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := io.WriteString(conn, req+"\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, Error("http proxy " + proxy.Host + " refused to connect to " + addr + ": " + res.Status)
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn reads what the bufio.Reader may have read ahead first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,213 @@
+package freedns
+
+import (
+	"container/list"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit throttles the clients, grouped by address prefix.
+type RateLimit struct {
+	// QPS and Burst limit the queries of each client prefix, zero QPS disables it.
+	// Limited queries are dropped over udp and refused over tcp.
+	QPS   float64
+	Burst int
+
+	// ResponsesPerSecond limits the identical udp responses sent to each client prefix
+	// (response rate limiting against amplification), zero disables it.
+	ResponsesPerSecond float64
+	// Slip sends every Slip-th limited response truncated, so genuine clients retry over tcp.
+	// Zero drops all of them.
+	Slip int
+
+	// IPv4PrefixLen and IPv6PrefixLen group the clients, default to 24 and 56.
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+
+	// Allowlist are trusted CIDRs which are never limited.
+	Allowlist []string
+}
+
+// maxBuckets bounds the memory used by the limiter, the least recently used buckets are evicted beyond it.
+const maxBuckets = 65536
+
+type tokenBucket struct {
+	tokens  float64
+	last    time.Time
+	limited uint64
+}
+
+// take refills the bucket and takes a token out of it if there is one.
+func (b *tokenBucket) take(now time.Time, rate float64, burst float64) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		b.limited++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// bucketLRU keeps at most max buckets, evicting the least recently used one in constant time,
+// so a flood of spoofed sources can neither grow the memory nor slow the lookups down.
+type bucketLRU struct {
+	max   int
+	items map[string]*list.Element
+	order *list.List
+}
+
+type bucketLRUEntry struct {
+	key    string
+	bucket *tokenBucket
+}
+
+func newBucketLRU(max int) *bucketLRU {
+	return &bucketLRU{max: max, items: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the bucket of the key, creating it with newBucket if needed.
+func (l *bucketLRU) get(key string, newBucket func() *tokenBucket) *tokenBucket {
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToFront(e)
+		return e.Value.(*bucketLRUEntry).bucket
+	}
+	if l.order.Len() >= l.max {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*bucketLRUEntry).key)
+	}
+	b := newBucket()
+	l.items[key] = l.order.PushFront(&bucketLRUEntry{key, b})
+	return b
+}
+
+func (l *bucketLRU) each(f func(key string, b *tokenBucket)) {
+	for e := l.order.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*bucketLRUEntry)
+		f(entry.key, entry.bucket)
+	}
+}
+
+type rateLimiter struct {
+	cfg       RateLimit
+	allowlist []*net.IPNet
+	now       func() time.Time
+
+	mutex     sync.Mutex
+	queries   *bucketLRU
+	responses *bucketLRU
+}
+
+func newRateLimiter(cfg *RateLimit) (*rateLimiter, error) {
+	if cfg == nil || (cfg.QPS <= 0 && cfg.ResponsesPerSecond <= 0) {
+		return nil, nil
+	}
+	allowlist, err := parseCIDRs(cfg.Allowlist)
+	if err != nil {
+		return nil, err
+	}
+	limiter := &rateLimiter{
+		cfg:       *cfg,
+		allowlist: allowlist,
+		now:       time.Now,
+		queries:   newBucketLRU(maxBuckets),
+		responses: newBucketLRU(maxBuckets),
+	}
+	if limiter.cfg.Burst < 1 {
+		limiter.cfg.Burst = int(limiter.cfg.QPS) + 1
+	}
+	if limiter.cfg.IPv4PrefixLen <= 0 || limiter.cfg.IPv4PrefixLen > 32 {
+		limiter.cfg.IPv4PrefixLen = 24
+	}
+	if limiter.cfg.IPv6PrefixLen <= 0 || limiter.cfg.IPv6PrefixLen > 128 {
+		limiter.cfg.IPv6PrefixLen = 56
+	}
+	return limiter, nil
+}
+
+// prefix returns the client group of the ip, or "" if it is never limited.
+func (limiter *rateLimiter) prefix(ip net.IP) string {
+	if ip == nil || containsIP(limiter.allowlist, ip) {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(limiter.cfg.IPv4PrefixLen, 32)), Mask: net.CIDRMask(limiter.cfg.IPv4PrefixLen, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(limiter.cfg.IPv6PrefixLen, 128)), Mask: net.CIDRMask(limiter.cfg.IPv6PrefixLen, 128)}).String()
+}
+
+func (limiter *rateLimiter) take(buckets *bucketLRU, key string, rate float64, burst float64) (bool, uint64) {
+	now := limiter.now()
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	b := buckets.get(key, func() *tokenBucket {
+		return &tokenBucket{tokens: burst, last: now}
+	})
+	allowed := b.take(now, rate, burst)
+	return allowed, b.limited
+}
+
+// allowQuery returns false if the client sends queries too fast.
+func (limiter *rateLimiter) allowQuery(ip net.IP) bool {
+	if limiter == nil || limiter.cfg.QPS <= 0 {
+		return true
+	}
+	prefix := limiter.prefix(ip)
+	if prefix == "" {
+		return true
+	}
+	allowed, _ := limiter.take(limiter.queries, prefix, limiter.cfg.QPS, float64(limiter.cfg.Burst))
+	return allowed
+}
+
+// allowResponse returns whether the udp response for qname can be sent to the client,
+// and if not, whether it should slip through truncated.
+func (limiter *rateLimiter) allowResponse(ip net.IP, qname string) (allowed bool, slip bool) {
+	if limiter == nil || limiter.cfg.ResponsesPerSecond <= 0 {
+		return true, false
+	}
+	prefix := limiter.prefix(ip)
+	if prefix == "" {
+		return true, false
+	}
+	rate := limiter.cfg.ResponsesPerSecond
+	// a token is needed per response, so the burst is one at least
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	allowed, limited := limiter.take(limiter.responses, prefix+"_"+strings.ToLower(qname), rate, burst)
+	if allowed {
+		return true, false
+	}
+	return false, limiter.cfg.Slip > 0 && limited%uint64(limiter.cfg.Slip) == 0
+}
+
+// limited returns how many queries and responses of each client prefix are being limited.
+func (limiter *rateLimiter) limited() map[string]uint64 {
+	counts := make(map[string]uint64)
+	if limiter == nil {
+		return counts
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.queries.each(func(prefix string, b *tokenBucket) {
+		if b.limited > 0 {
+			counts[prefix] += b.limited
+		}
+	})
+	limiter.responses.each(func(key string, b *tokenBucket) {
+		if b.limited > 0 {
+			counts[key[:strings.Index(key, "_")]] += b.limited
+		}
+	})
+	return counts
+}
@@ -0,0 +1,127 @@
+package freedns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(t *testing.T, cfg RateLimit) (*rateLimiter, *time.Time) {
+	limiter, err := newRateLimiter(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	limiter.now = func() time.Time { return now }
+	return limiter, &now
+}
+
+func TestRateLimitQueries(t *testing.T) {
+	limiter, now := newTestRateLimiter(t, RateLimit{
+		QPS:       2,
+		Burst:     3,
+		Allowlist: []string{"10.0.0.0/8"},
+	})
+
+	client := net.ParseIP("192.0.2.1")
+	neighbour := net.ParseIP("192.0.2.200")
+	for i := 0; i < 3; i++ {
+		if !limiter.allowQuery(client) {
+			t.Fatalf("query %d should be allowed by the burst", i)
+		}
+	}
+	if limiter.allowQuery(neighbour) {
+		t.Errorf("clients of the same /24 share the bucket")
+	}
+	if !limiter.allowQuery(net.ParseIP("192.0.3.1")) {
+		t.Errorf("other prefixes have their own bucket")
+	}
+	for i := 0; i < 100; i++ {
+		if !limiter.allowQuery(net.ParseIP("10.1.2.3")) {
+			t.Fatalf("allowlisted clients should never be limited")
+		}
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	if !limiter.allowQuery(client) || limiter.allowQuery(client) {
+		t.Errorf("the bucket should refill at the QPS rate")
+	}
+
+	if got := limiter.limited()["192.0.2.0/24"]; got != 2 {
+		t.Errorf("limited() = %d for 192.0.2.0/24, want 2", got)
+	}
+}
+
+func TestRateLimitResponsesSlip(t *testing.T) {
+	limiter, _ := newTestRateLimiter(t, RateLimit{
+		ResponsesPerSecond: 1,
+		Slip:               2,
+	})
+
+	client := net.ParseIP("2001:db8::1")
+	if allowed, _ := limiter.allowResponse(client, "example.com."); !allowed {
+		t.Fatalf("the first response should be sent")
+	}
+	if allowed, _ := limiter.allowResponse(client, "other.com."); !allowed {
+		t.Errorf("responses are limited per name")
+	}
+
+	var slipped, dropped int
+	for i := 0; i < 10; i++ {
+		allowed, slip := limiter.allowResponse(client, "EXAMPLE.com.")
+		if allowed {
+			t.Fatalf("response %d should be limited", i)
+		}
+		if slip {
+			slipped++
+		} else {
+			dropped++
+		}
+	}
+	if slipped != 5 || dropped != 5 {
+		t.Errorf("every 2nd limited response should slip, got %d slipped and %d dropped", slipped, dropped)
+	}
+	if !limiter.allowQuery(client) {
+		t.Errorf("queries are not limited without QPS")
+	}
+}
+
+func TestRateLimitEvictsLeastRecentlyUsedBuckets(t *testing.T) {
+	buckets := newBucketLRU(2)
+	created := 0
+	newBucket := func() *tokenBucket {
+		created++
+		return &tokenBucket{}
+	}
+	a := buckets.get("a", newBucket)
+	buckets.get("b", newBucket)
+	if buckets.get("a", newBucket) != a {
+		t.Errorf("the existing bucket should be returned")
+	}
+	// "b" is the least recently used one
+	buckets.get("c", newBucket)
+	if len(buckets.items) != 2 || buckets.order.Len() != 2 {
+		t.Errorf("the buckets should be bounded, got %d", len(buckets.items))
+	}
+	if _, ok := buckets.items["b"]; ok {
+		t.Errorf("the least recently used bucket should be evicted")
+	}
+	if buckets.get("a", newBucket) != a || created != 3 {
+		t.Errorf("the recently used bucket should be kept")
+	}
+}
+
+func TestRateLimitResponsesBelowOnePerSecond(t *testing.T) {
+	limiter, now := newTestRateLimiter(t, RateLimit{ResponsesPerSecond: 0.5})
+	client := net.ParseIP("192.0.2.1")
+	if allowed, _ := limiter.allowResponse(client, "example.com."); !allowed {
+		t.Fatalf("the first response should be sent")
+	}
+	if allowed, _ := limiter.allowResponse(client, "example.com."); allowed {
+		t.Errorf("the second response should be limited")
+	}
+	*now = now.Add(2 * time.Second)
+	if allowed, _ := limiter.allowResponse(client, "example.com."); !allowed {
+		t.Errorf("a response should be sent every 2 seconds")
+	}
+}
@@ -0,0 +1,238 @@
+package freedns
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/xiangyu123/cosp_dns/freedns/internal/loopback"
+)
+
+// exchangeRecord is an upstream exchange saved in a fixture file, one JSON object per line.
+type exchangeRecord struct {
+	Name      string        `json:"name"`
+	Type      string        `json:"type"`
+	Class     string        `json:"class"`
+	Net       string        `json:"net"`
+	Recursion bool          `json:"recursion"`
+	Upstream  string        `json:"upstream"`
+	Latency   time.Duration `json:"latency"`
+	// Response is the wire format of the response, empty when the exchange failed.
+	Response []byte `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// recorder appends the exchanges with the upstreams to a fixture file, the queries of
+// naiveResolve as well as the ones of the DNSSEC validator.
+type recorder struct {
+	mutex sync.Mutex
+	file  *os.File
+	enc   *json.Encoder
+}
+
+func newRecorder(filename string) (*recorder, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (r *recorder) record(q dns.Question, recursion bool, net string, upstream string, res *dns.Msg, err error, latency time.Duration) {
+	rec := exchangeRecord{
+		Name:      q.Name,
+		Type:      dns.TypeToString[q.Qtype],
+		Class:     dns.ClassToString[q.Qclass],
+		Net:       net,
+		Recursion: recursion,
+		Upstream:  redactUpstream(upstream),
+		Latency:   latency,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if res != nil {
+		if wire, packErr := res.Pack(); packErr == nil {
+			rec.Response = wire
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.enc.Encode(rec); err != nil {
+		log.WithFields(logrus.Fields{
+			"op":   "record_exchange",
+			"file": r.file.Name(),
+		}).Error(err)
+	}
+}
+
+// exchange is exchange, recorded when r is not nil.
+// The exchanges cancelled by ctx are not recorded, the upstream didn't fail.
+func (r *recorder) exchange(ctx context.Context, req *dns.Msg, net string, upstream string) (*dns.Msg, error) {
+	start := time.Now()
+	res, err := exchange(ctx, req, net, upstream)
+	if r != nil && ctx.Err() == nil {
+		r.record(req.Question[0], req.RecursionDesired, net, upstream, res, err, time.Since(start))
+	}
+	return res, err
+}
+
+func (r *recorder) close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.file.Close()
+}
+
+// readExchangeRecords reads the fixture file, keeping the exchanges with `upstream` only if not empty.
+func readExchangeRecords(filename string, upstream string) ([]exchangeRecord, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []exchangeRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var rec exchangeRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return nil, Error("Invalid fixture record in " + filename + ": " + err.Error())
+		}
+		if upstream == "" || rec.Upstream == upstream {
+			records = append(records, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// replayUpstreamProvider answers from a fixture file, through a fake upstream on loopback.
+// The exchanges of a question are replayed in the recorded order with the recorded latency,
+// the last one is repeated. Failed exchanges are never answered, so the resolver times out.
+type replayUpstreamProvider struct {
+	server *loopback.Server
+
+	mutex   sync.Mutex
+	records map[string][]exchangeRecord
+}
+
+// newReplayUpstreamProvider replays the exchanges of the upstream described by
+// "fixture#upstream", where the upstream is optional and defaults to all of them.
+func newReplayUpstreamProvider(name string) (*replayUpstreamProvider, error) {
+	filename, upstream := name, ""
+	if i := strings.LastIndex(name, "#"); i >= 0 {
+		filename, upstream = name[:i], name[i+1:]
+	}
+	records, err := readExchangeRecords(filename, upstream)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, Error("No exchanges to replay in " + name)
+	}
+
+	provider := &replayUpstreamProvider{
+		records: make(map[string][]exchangeRecord),
+	}
+	for _, rec := range records {
+		key := replayKey(rec.Name, rec.Type, rec.Class, rec.Recursion)
+		provider.records[key] = append(provider.records[key], rec)
+	}
+
+	// the udp and tcp servers share the port, like a real upstream
+	if provider.server, err = loopback.Start(provider); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(logrus.Fields{
+		"op":        "replay",
+		"fixture":   filename,
+		"upstream":  upstream,
+		"exchanges": len(records),
+		"addr":      provider.server.Addr,
+	}).Info()
+	return provider, nil
+}
+
+func replayKey(name string, qtype string, qclass string, recursion bool) string {
+	key := strings.ToLower(name) + " " + qtype + " " + qclass
+	if recursion {
+		key += " +rd"
+	}
+	return key
+}
+
+func (provider *replayUpstreamProvider) GetUpstream() string {
+	return provider.server.Addr
+}
+
+// next pops the exchange to replay for the question.
+func (provider *replayUpstreamProvider) next(q dns.Question, recursion bool) (exchangeRecord, bool) {
+	key := replayKey(q.Name, dns.TypeToString[q.Qtype], dns.ClassToString[q.Qclass], recursion)
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	records := provider.records[key]
+	if len(records) == 0 {
+		return exchangeRecord{}, false
+	}
+	if len(records) > 1 {
+		provider.records[key] = records[1:]
+	}
+	return records[0], true
+}
+
+func (provider *replayUpstreamProvider) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 {
+		res := &dns.Msg{}
+		res.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(res)
+		return
+	}
+	q := req.Question[0]
+	rec, ok := provider.next(q, req.RecursionDesired)
+	if !ok {
+		log.WithFields(logrus.Fields{
+			"op":     "replay",
+			"domain": q.Name,
+			"type":   dns.TypeToString[q.Qtype],
+		}).Warn("No recorded exchange")
+		res := &dns.Msg{}
+		res.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(res)
+		return
+	}
+
+	time.Sleep(rec.Latency)
+	if len(rec.Response) == 0 {
+		return
+	}
+	res := &dns.Msg{}
+	if err := res.Unpack(rec.Response); err != nil {
+		log.WithFields(logrus.Fields{
+			"op":     "replay",
+			"domain": q.Name,
+		}).Error(err)
+		return
+	}
+	res.Id = req.Id
+	w.WriteMsg(res)
+}
+
+// Close stops the fake upstream.
+func (provider *replayUpstreamProvider) Close() {
+	provider.server.Close()
+}
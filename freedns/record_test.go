@@ -0,0 +1,143 @@
+package freedns
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/freedns/dnstest"
+	"github.com/xiangyu123/cosp_dns/whitedomain"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freedns_fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fixture := filepath.Join(dir, "exchanges.jsonl")
+
+	fast := dnstest.NewServer(dnstest.Sequence(dnstest.A("10.0.0.1"), dnstest.Delay(200*time.Millisecond, dnstest.A("10.0.0.9"))))
+	defer fast.Close()
+	clean := dnstest.NewServer(dnstest.A("10.0.0.2"))
+	defer clean.Close()
+	public := dnstest.NewServer(dnstest.Rcode(dns.RcodeNameError))
+	defer public.Close()
+
+	// record the incident
+	rec, err := newRecorder(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := newSpoofingProofResolver(&staticUpstreamProvider{fast.Addr}, &staticUpstreamProvider{clean.Addr}, &staticUpstreamProvider{public.Addr})
+	resolver.whiteDomains = whitedomain.MustCompile([]string{"corp.example"})
+	resolver.recorder = rec
+
+	questions := []dns.Question{
+		{Name: "www.corp.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: "www.corp.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: "nx.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	}
+	var recorded []*dns.Msg
+	for _, q := range questions {
+		res, _ := resolver.resolve(context.Background(), q, true, "udp")
+		recorded = append(recorded, res)
+	}
+	rec.close()
+
+	records, err := readExchangeRecords(fixture, fast.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1].Latency < 200*time.Millisecond {
+		t.Fatalf("the exchanges with the fast upstream should be recorded with their latency, got %+v", records)
+	}
+
+	// replay it offline
+	fast.Close()
+	clean.Close()
+	public.Close()
+	var providers []upstreamProvider
+	for _, upstream := range []string{fast.Addr, clean.Addr, public.Addr} {
+		provider, err := newUpstreamProvider("replay:" + fixture + "#" + upstream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer provider.(*replayUpstreamProvider).Close()
+		providers = append(providers, provider)
+	}
+	resolver = newSpoofingProofResolver(providers[0], providers[1], providers[2])
+	resolver.whiteDomains = whitedomain.MustCompile([]string{"corp.example"})
+
+	for i, q := range questions {
+		start := time.Now()
+		res, _ := resolver.resolve(context.Background(), q, true, "udp")
+		elapsed := time.Since(start)
+		if res.Rcode != recorded[i].Rcode || len(res.Answer) != len(recorded[i].Answer) {
+			t.Errorf("%s: replayed %v, recorded %v", q.Name, res, recorded[i])
+			continue
+		}
+		if len(res.Answer) > 0 && res.Answer[0].String() != recorded[i].Answer[0].String() {
+			t.Errorf("%s: replayed %v, recorded %v", q.Name, res.Answer, recorded[i].Answer)
+		}
+		if i == 1 && elapsed < 200*time.Millisecond {
+			t.Errorf("the recorded latency should be replayed, took %v", elapsed)
+		}
+	}
+}
+
+func TestRecordDNSSEC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freedns_fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fixture := filepath.Join(dir, "exchanges.jsonl")
+
+	upstream, anchors := newTestChain(t)
+	addr, shutdown := startTestUpstream(t, upstream)
+	defer shutdown()
+
+	rec, err := newRecorder(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := newSpoofingProofResolver(&staticUpstreamProvider{addr}, &staticUpstreamProvider{addr}, &staticUpstreamProvider{addr})
+	resolver.recorder = rec
+	resolver.validator = newDNSSECValidator(anchors, &staticUpstreamProvider{addr})
+	resolver.validator.recorder = rec
+
+	q := dns.Question{Name: "www.baidu.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if res, _ := resolver.resolve(context.Background(), q, true, "udp"); !res.AuthenticatedData {
+		t.Fatalf("unexpected answer %v", res)
+	}
+	rec.close()
+
+	records, err := readExchangeRecords(fixture, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := make(map[string]int)
+	for _, r := range records {
+		types[r.Type]++
+	}
+	if types["A"] == 0 || types["DNSKEY"] == 0 || types["DS"] == 0 {
+		t.Errorf("the answer and the queries of the validator should be recorded, got %v", types)
+	}
+}
+
+func TestInvalidReplayUpstream(t *testing.T) {
+	cases := []string{
+		"replay:/nonexistent.jsonl",
+		"replay:/dev/null",
+	}
+	for _, name := range cases {
+		if _, err := newUpstreamProvider(name); err == nil {
+			t.Errorf("Should not create provider for %s", name)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package freedns
+
+import (
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+type requestAction int
+
+const (
+	// requestResolve means the request is a well formed query we can resolve.
+	requestResolve requestAction = iota
+	// requestIgnore means the request must not be answered at all.
+	requestIgnore
+	// requestReject means the request is answered with an error rcode.
+	requestReject
+	// requestForward means the request is relayed as is to another server.
+	requestForward
+)
+
+// acceptMsg lets every message reach the handler, checkRequest decides how to handle it.
+// dns.DefaultMsgAcceptFunc would answer UPDATE with NOTIMP and reject the NOTIFY and
+// UPDATE requests carrying records, so they could never be forwarded.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	return dns.MsgAccept
+}
+
+// checkRequest decides how to handle a request before any upstream work,
+// returning the rcode for rejected requests and the server to forward to.
+func (s *Server) checkRequest(req *dns.Msg) (requestAction, int, string) {
+	// never answer responses, it could start a loop between two servers
+	if req.Response {
+		return requestIgnore, 0, ""
+	}
+
+	switch req.Opcode {
+	case dns.OpcodeQuery:
+	case dns.OpcodeNotify:
+		if s.config.NotifyUpstream != "" {
+			return requestForward, 0, s.config.NotifyUpstream
+		}
+		return requestReject, dns.RcodeNotImplemented, ""
+	case dns.OpcodeUpdate:
+		if s.config.UpdateUpstream != "" {
+			return requestForward, 0, s.config.UpdateUpstream
+		}
+		return requestReject, dns.RcodeNotImplemented, ""
+	default:
+		return requestReject, dns.RcodeNotImplemented, ""
+	}
+
+	if len(req.Question) != 1 {
+		return requestReject, dns.RcodeFormatError, ""
+	}
+
+	switch req.Question[0].Qclass {
+	case dns.ClassINET, dns.ClassCHAOS:
+	default:
+		return requestReject, dns.RcodeRefused, ""
+	}
+
+	return requestResolve, 0, ""
+}
+
+// forward relays the request to the upstream and returns its response.
+func forward(req *dns.Msg, net string, upstream string) *dns.Msg {
+	c := &dns.Client{Net: net}
+	res, _, err := c.Exchange(req.Copy(), upstream)
+	if err != nil || res == nil {
+		log.WithFields(logrus.Fields{
+			"op":       "forward",
+			"opcode":   dns.OpcodeToString[req.Opcode],
+			"upstream": upstream,
+		}).Error(err)
+		res = &dns.Msg{}
+		res.SetRcode(req, dns.RcodeServerFailure)
+	}
+	return res
+}
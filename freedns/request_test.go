@@ -0,0 +1,168 @@
+package freedns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestHandleRequestValidation(t *testing.T) {
+	upstream, shutdown := startTestUpstream(t, answerA("1.2.3.4"))
+	defer shutdown()
+	notified, shutdownNotified := startTestUpstream(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		res.Authoritative = true
+		w.WriteMsg(res)
+	}))
+	defer shutdownNotified()
+
+	s, err := NewServer(Config{
+		FastUpstream:   upstream,
+		CleanUpstream:  upstream,
+		PublicUpstream: upstream,
+		Listen:         "127.0.0.1:0",
+		NotifyUpstream: notified,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, _ := newListener(Listener{Addr: "127.0.0.1:0"}, nil, "udp")
+
+	query := func(name string, qclass uint16) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		req.Question[0].Qclass = qclass
+		return req
+	}
+
+	tests := []struct {
+		name     string
+		req      func() *dns.Msg
+		answered bool
+		rcode    int
+		check    func(t *testing.T, res *dns.Msg)
+	}{
+		{"query", func() *dns.Msg { return query("example.com.", dns.ClassINET) }, true, dns.RcodeSuccess, func(t *testing.T, res *dns.Msg) {
+			if len(res.Answer) != 1 {
+				t.Errorf("expect the upstream answer, got %v", res.Answer)
+			}
+		}},
+		{"chaos class", func() *dns.Msg { return query("version.bind.", dns.ClassCHAOS) }, true, dns.RcodeSuccess, nil},
+		{"hesiod class", func() *dns.Msg { return query("example.com.", dns.ClassHESIOD) }, true, dns.RcodeRefused, nil},
+		{"any class", func() *dns.Msg { return query("example.com.", dns.ClassANY) }, true, dns.RcodeRefused, nil},
+		{"no question", func() *dns.Msg {
+			req := query("example.com.", dns.ClassINET)
+			req.Question = nil
+			return req
+		}, true, dns.RcodeFormatError, nil},
+		{"two questions", func() *dns.Msg {
+			req := query("example.com.", dns.ClassINET)
+			req.Question = append(req.Question, dns.Question{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+			return req
+		}, true, dns.RcodeFormatError, nil},
+		{"response", func() *dns.Msg {
+			req := query("example.com.", dns.ClassINET)
+			req.Response = true
+			return req
+		}, false, 0, nil},
+		{"status opcode", func() *dns.Msg {
+			req := query("example.com.", dns.ClassINET)
+			req.Opcode = dns.OpcodeStatus
+			return req
+		}, true, dns.RcodeNotImplemented, nil},
+		{"update without upstream", func() *dns.Msg {
+			req := &dns.Msg{}
+			req.SetUpdate("example.com.")
+			return req
+		}, true, dns.RcodeNotImplemented, nil},
+		{"forwarded notify", func() *dns.Msg {
+			req := &dns.Msg{}
+			req.SetNotify("example.com.")
+			return req
+		}, true, dns.RcodeSuccess, func(t *testing.T, res *dns.Msg) {
+			if !res.Authoritative || res.Opcode != dns.OpcodeNotify {
+				t.Errorf("expect the response of the notify upstream, got %v", res)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req()
+			w := newTestResponseWriter("127.0.0.1", "udp")
+			s.handle(w, req, ln)
+
+			if !tt.answered {
+				if w.msg != nil {
+					t.Errorf("expect no answer, got %v", w.msg)
+				}
+				return
+			}
+			if w.msg == nil {
+				t.Fatalf("expect an answer")
+			}
+			if w.msg.Rcode != tt.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[w.msg.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if w.msg.Id != req.Id || !w.msg.Response {
+				t.Errorf("the answer should reply to the request")
+			}
+			if tt.check != nil {
+				tt.check(t, w.msg)
+			}
+		})
+	}
+}
+
+func TestForwardUpdateFromListener(t *testing.T) {
+	upstream, shutdown := startTestUpstream(t, answerA("1.2.3.4"))
+	defer shutdown()
+	updated, shutdownUpdated := startTestUpstream(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		res.Authoritative = len(req.Ns) == 2
+		w.WriteMsg(res)
+	}))
+	defer shutdownUpdated()
+
+	s, err := NewServer(Config{
+		FastUpstream:   upstream,
+		CleanUpstream:  upstream,
+		PublicUpstream: upstream,
+		Listen:         "127.0.0.1:0",
+		UpdateUpstream: updated,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{}, len(s.servers))
+	for _, server := range s.servers {
+		server.NotifyStartedFunc = func() { started <- struct{}{} }
+	}
+	go s.Run()
+	defer s.Shutdown()
+	for range s.servers {
+		<-started
+	}
+
+	for _, server := range s.servers {
+		addr := ""
+		if server.Net == "udp" {
+			addr = server.PacketConn.LocalAddr().String()
+		} else {
+			addr = server.Listener.Addr().String()
+		}
+		req := &dns.Msg{}
+		req.SetUpdate("example.com.")
+		req.Insert([]dns.RR{mustRR(t, "a.example.com. 300 IN A 10.0.0.1"), mustRR(t, "b.example.com. 300 IN A 10.0.0.2")})
+		c := &dns.Client{Net: server.Net}
+		res, _, err := c.Exchange(req, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Rcode != dns.RcodeSuccess || !res.Authoritative || res.Opcode != dns.OpcodeUpdate {
+			t.Errorf("%s: expect the response of the update upstream, got %v", server.Net, res)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package freedns
 
 import (
+	"context"
+	"net"
 	"strings"
 	"time"
 
@@ -14,6 +16,26 @@ type spoofingProofResolver struct {
 	fastUpstreamProvider   upstreamProvider
 	cleanUpstreamProvider  upstreamProvider
 	publicUpstreamProvider upstreamProvider
+
+	// whiteDomains are routed to the fast and clean upstreams, others to the public one.
+	whiteDomains *whitedomain.Rules
+	// ruleSets route the domains of the Clash and Surge rule sets before the other lists, nil when none.
+	ruleSets *ruleSets
+	// domainList routes the domains of the imported lists before whiteDomains, nil when none.
+	domainList domainList
+
+	// validator checks the DNSSEC signatures of upstream answers, nil disables validation.
+	validator *dnssecValidator
+
+	inflight *flightGroup
+	// recorder saves the upstream exchanges to a fixture file, nil disables recording.
+	recorder *recorder
+	// cache is the lazy cache of the answers, nil when disabled.
+	cache *dnsCache
+	// addressFilter is the AddressFilter of the view, the domains may override it.
+	addressFilter AddressFilter
+	// dns64 synthesizes the AAAA records for the view, nil disables it.
+	dns64 *dns64
 }
 
 func newSpoofingProofResolver(fastUpstreamProvider upstreamProvider, cleanUpstreamProvider upstreamProvider, publicUpstreamProvider upstreamProvider) *spoofingProofResolver {
@@ -21,11 +43,72 @@ func newSpoofingProofResolver(fastUpstreamProvider upstreamProvider, cleanUpstre
 		fastUpstreamProvider:   fastUpstreamProvider,
 		cleanUpstreamProvider:  cleanUpstreamProvider,
 		publicUpstreamProvider: publicUpstreamProvider,
+		whiteDomains:           builtinWhiteDomains,
+		inflight:               newFlightGroup(),
+	}
+}
+
+// builtinWhiteDomains are the rules of the built-in white domain list, compiled once.
+var builtinWhiteDomains = whitedomain.MustCompile(whitedomain.GetAllDomains())
+
+// The routes of the questions.
+const (
+	// routePTR sends the reverse lookups to the fast and clean upstreams.
+	routePTR = "ptr"
+	// routeWhite sends the white domains to the fast and clean upstreams.
+	routeWhite = "white"
+	// routePublic sends the other domains to the public upstream.
+	routePublic = "public"
+	// routeFast and routeClean send the domains of the rule sets to one upstream, see RulePolicies.
+	routeFast  = "fast"
+	routeClean = "clean"
+)
+
+// route tells which upstreams resolve the question.
+func (resolver *spoofingProofResolver) route(q dns.Question) string {
+	if q.Qtype == dns.TypePTR {
+		return routePTR
+	}
+	if route, found := resolver.ruleSets.match(q.Name); found {
+		return route
+	}
+	if white, found := resolver.domainList.match(q.Name); found {
+		if white {
+			return routeWhite
+		}
+		return routePublic
+	}
+	if resolver.whiteDomains.Match(q.Name) {
+		return routeWhite
+	}
+	return routePublic
+}
+
+// resovle returns the response and which upstream is used,
+// concurrent identical queries share the same upstream exchange.
+// It fails with SERVFAIL when ctx is done before the upstreams answer.
+func (resolver *spoofingProofResolver) resolve(ctx context.Context, q dns.Question, recursion bool, net string) (*dns.Msg, string) {
+	key := requestToString(q, recursion, net)
+	res, upstream, shared := resolver.inflight.do(ctx, key, func(ctx context.Context) (*dns.Msg, string) {
+		return resolver.resolveChain(ctx, q, recursion, net)
+	})
+	if res == nil {
+		// the caller gave up, the others may still get the answer
+		return &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}, upstream
 	}
+	if shared {
+		log.WithFields(logrus.Fields{
+			"op":       "resolve_coalesced",
+			"domain":   q.Name,
+			"upstream": upstream,
+		}).Debug()
+	}
+	// every client gets its own copy, to set its own message id
+	return res.Copy(), upstream
 }
 
-// resovle returns the response and which upstream is used
-func (resolver *spoofingProofResolver) resolve(q dns.Question, recursion bool, net string) (*dns.Msg, string) {
+// resolveUpstreams sends the query to the upstreams chosen by the routing rules.
+func (resolver *spoofingProofResolver) resolveUpstreams(ctx context.Context, q dns.Question, recursion bool, net string) (*dns.Msg, string) {
 	type result struct {
 		res *dns.Msg
 		err error
@@ -50,38 +133,42 @@ func (resolver *spoofingProofResolver) resolve(q dns.Question, recursion bool, n
 
 	// 1. detected the upstream based on query type and domain, finally we get the upstream dns server slice with its result channel
 	// 判断是否需要使用公网dns来解析或者直接转发到内网dns， 仅判断一次
-	reqDomain := q.Name
-	allDomains := whitedomain.GetAllDomains()
 
 	// 判断请求的类型，如果是PTR，就往多个upstream发送解析请求，然后将结果合并
 	// 如果是其他的类型，则先判断是否是白名单中的域名，如果是则转发请求到多个upstream,判断结果有没有数据，合并所有获取的结果
 	// 如果不是白名单中的域名，则直接转发给公网的dns
 	// 注意upstream和resChan的索引在每个对应的slice中需要一一对应
-	switch q.Qtype {
-	case dns.TypePTR:
+	switch resolver.route(q) {
+	case routePTR, routeWhite:
 		resChans = append(resChans, fastCh)
 		resChans = append(resChans, cleanCh)
 		upstreams = append(upstreams, fastUpstream)
 		upstreams = append(upstreams, cleanUpstream)
+	case routeFast:
+		resChans = append(resChans, fastCh)
+		upstreams = append(upstreams, fastUpstream)
+	case routeClean:
+		resChans = append(resChans, cleanCh)
+		upstreams = append(upstreams, cleanUpstream)
 	default:
-		if containsDomain(reqDomain, allDomains) {
-			resChans = append(resChans, fastCh)
-			resChans = append(resChans, cleanCh)
-			upstreams = append(upstreams, fastUpstream)
-			upstreams = append(upstreams, cleanUpstream)
-		} else {
-			resChans = append(resChans, publicCh)
-			upstreams = append(upstreams, publicUpstream)
-		}
+		resChans = append(resChans, publicCh)
+		upstreams = append(upstreams, publicUpstream)
 	}
 
 	Q := func(ch chan result, upstream string) {
 		logrus.WithFields(logrus.Fields{
 			"function": "Q",
-			"upstream": upstream,
+			"upstream": redactUpstream(upstream),
 			"chan":     ch,
 		}).Info()
-		res, err := naiveResolve(q, recursion, net, upstream)
+		var res *dns.Msg
+		var err error
+		// the validator records its own exchanges, its DS and DNSKEY queries included
+		if resolver.validator != nil {
+			res, err = resolver.validator.resolve(ctx, q, recursion, net, upstream)
+		} else {
+			res, err = resolver.recorder.exchange(ctx, newRequest(q, recursion), net, upstream)
+		}
 		if res == nil {
 			res = fail
 		}
@@ -109,6 +196,9 @@ func (resolver *spoofingProofResolver) resolve(q dns.Question, recursion bool, n
 	// think about it very carefully, give up fan-out
 	// upstream order same as channel order, so we can retrived the upstream by index
 	// if multi channel has data(all dns servers work), pick the first one.
+	// if no upstream has the domain, the first NXDOMAIN is the answer
+	var nxdomain *dns.Msg
+	var nxdomainUpstream string
 	for index, resChan := range resChans {
 		if resChan != nil {
 			r := <-resChan
@@ -116,12 +206,22 @@ func (resolver *spoofingProofResolver) resolve(q dns.Question, recursion bool, n
 			if r.res != nil && r.res.Rcode == dns.RcodeSuccess {
 				ck := containsRecord(r.res)
 				log.Println("ck is", ck)
-				return r.res, upstreams[index]
+				return r.res, redactUpstream(upstreams[index])
+			}
+			if r.res != nil && r.res.Rcode == dns.RcodeNameError && nxdomain == nil {
+				nxdomain, nxdomainUpstream = r.res, redactUpstream(upstreams[index])
 			}
 		}
 	}
+	if nxdomain != nil {
+		return nxdomain, nxdomainUpstream
+	}
 
-	failedUpstream := strings.Join(upstreams, ",")
+	redacted := make([]string, len(upstreams))
+	for i, upstream := range upstreams {
+		redacted[i] = redactUpstream(upstream)
+	}
+	failedUpstream := strings.Join(redacted, ",")
 	return fail, failedUpstream // return r.res, upstreams
 }
 
@@ -129,20 +229,45 @@ func naiveResolve(q dns.Question, recursion bool, net string, upstream string) (
 	// send to multiple upstream server, and check if has data
 	// wait all resovler's result, if both has nodata, just return ony, if one of resolver return data, return data
 	// if has multi data, merge the answers to ony and return to client
-	r := &dns.Msg{
+	return exchange(context.Background(), newRequest(q, recursion), net, upstream)
+}
+
+// newRequest returns the query of naiveResolve.
+func newRequest(q dns.Question, recursion bool) *dns.Msg {
+	return &dns.Msg{
 		MsgHdr: dns.MsgHdr{
 			Id:               dns.Id(),
 			RecursionDesired: recursion,
 		},
 		Question: []dns.Question{q},
 	}
-	c := &dns.Client{Net: net}
+}
 
-	res, _, err := c.Exchange(r, upstream)
+// exchange sends the prepared request `r` to the upstream and returns its response,
+// or the error of ctx when it is done first.
+// The options of the upstream choose its proxy and how it is dialed, see parseUpstream.
+func exchange(ctx context.Context, r *dns.Msg, net string, upstream string) (*dns.Msg, error) {
+	q := r.Question[0]
+
+	addr, options, proxy, err := parseUpstream(upstream)
+
+	var res *dns.Msg
+	switch {
+	case err != nil:
+	case proxy != nil:
+		res, err = exchangeViaProxy(ctx, r, net, addr, proxy, options)
+	default:
+		dialer, dialerErr := upstreamDialer(options, net)
+		if dialerErr != nil {
+			err = dialerErr
+			break
+		}
+		res, err = dialExchange(ctx, dialer, r, net, addr)
+	}
 	if err != nil {
 		log.WithFields(logrus.Fields{
 			"op":       "start_resolve",
-			"upstream": upstream,
+			"upstream": redactUpstream(upstream),
 			"domain":   q.Name,
 			"res":      res,
 		}).Error(err)
@@ -155,15 +280,59 @@ func naiveResolve(q dns.Question, recursion bool, net string, upstream string) (
 	return res, err
 }
 
-// containsDomain check if the request domain in white domains
-func containsDomain(reqHostRecord string, whiteDomains []string) bool {
-	reqHostRecord = strings.TrimRight(reqHostRecord, ".")
-	for _, domain := range whiteDomains {
-		if strings.HasSuffix(reqHostRecord, domain) {
-			return true
-		}
+// exchangeTimeout bounds the write and the read of an exchange, like the timeouts of dns.Client.
+const exchangeTimeout = 2 * time.Second
+
+// dialExchange is dns.Client.Exchange aborted when ctx is done. The ExchangeContext of miekg/dns
+// only honors the deadline of ctx, and replaces the dialer configured by the upstream options.
+func dialExchange(ctx context.Context, dialer *net.Dialer, r *dns.Msg, network string, addr string) (*dns.Msg, error) {
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	co := &dns.Conn{Conn: conn}
+	if opt := r.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		co.UDPSize = opt.UDPSize()
+	}
+	defer co.Close()
+	deadline := time.Now().Add(exchangeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	return exchangeConn(ctx, co, r, deadline)
+}
+
+// exchangeConn sends the request `r` on the connection and reads its response before the deadline.
+// The pending write or read is interrupted when ctx is done.
+func exchangeConn(ctx context.Context, co *dns.Conn, r *dns.Msg, deadline time.Time) (*dns.Msg, error) {
+	co.SetDeadline(deadline)
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				co.SetDeadline(time.Now())
+			case <-done:
+			}
+		}()
+	}
+	if err := co.WriteMsg(r); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	res, err := co.ReadMsg()
+	if err == nil && res.Id != r.Id {
+		err = dns.ErrId
+	}
+	return res, contextError(ctx, err)
+}
+
+// contextError returns the error of ctx instead of `err` when ctx is done, e.g. for the timeouts it caused.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
 	}
-	return false
+	return err
 }
 
 func containsRecord(res *dns.Msg) bool {
@@ -1,39 +1,82 @@
 package freedns
 
 import (
+	"context"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/freedns/dnstest"
+	"github.com/xiangyu123/cosp_dns/whitedomain"
 )
 
 func Test_spoofing_proof_resolver_resolve(t *testing.T) {
-	resolver := newSpoofingProofResolver(&staticUpstreamProvider{"114.114.114.114:53"}, &staticUpstreamProvider{"8.8.8.8:53"}, 1024)
+	fast := dnstest.NewServer(dnstest.A("10.0.0.1"))
+	defer fast.Close()
+	clean := dnstest.NewServer(dnstest.A("10.0.0.2"))
+	defer clean.Close()
+	public := dnstest.NewServer(dnstest.A("8.8.8.8"))
+	defer public.Close()
+
+	resolver := newSpoofingProofResolver(&staticUpstreamProvider{fast.Addr}, &staticUpstreamProvider{clean.Addr}, &staticUpstreamProvider{public.Addr})
+	resolver.whiteDomains = whitedomain.MustCompile([]string{"corp.example"})
 
 	tests := []struct {
+		name             string
 		domain           string
 		qtype            uint16
 		net              string
+		fast             dns.Handler
+		clean            dns.Handler
+		public           dns.Handler
+		expectedRcode    int
 		expectedUpstream string
+		expectedIP       string
 	}{
-		// expect 8.8.8.8 as the upstream b/c the resolver have
-		// no way to identify this is an China domain without A records
-		{"ustc.edu.cn.", dns.TypeMX, "udp", "8.8.8.8:53"},
-		{"ustc.edu.cn.", dns.TypeA, "udp", "114.114.114.114:53"},
-		// after querying the A record of ustc.edu.cn,
-		// the resolver should know this is an China domain
-		{"ustc.edu.cn.", dns.TypeMX, "udp", "114.114.114.114:53"},
-		{"google.com.", dns.TypeA, "udp", "8.8.8.8:53"},
-		{"mi.cn.", dns.TypeA, "udp", "114.114.114.114:53"},
-		{"xiaomi.com.", dns.TypeA, "udp", "114.114.114.114:53"},
-		{"youtube.com.", dns.TypeA, "udp", "8.8.8.8:53"},
-
-		// This fails just because the GitHub CI server has slow and unstable connection with the 114 server.
-		//{"www.tsinghua.edu.cn.", dns.TypeA, "tcp", "114.114.114.114:53"},
-		{"twitter.com.", dns.TypeA, "tcp", "8.8.8.8:53"},
+		{"white domains use the fast upstream", "www.corp.example.", dns.TypeA, "udp",
+			nil, nil, nil, dns.RcodeSuccess, fast.Addr, "10.0.0.1"},
+		{"white domains over tcp", "www.corp.example.", dns.TypeA, "tcp",
+			nil, nil, nil, dns.RcodeSuccess, fast.Addr, "10.0.0.1"},
+		{"other domains use the public upstream", "www.example.", dns.TypeA, "udp",
+			nil, nil, nil, dns.RcodeSuccess, public.Addr, "8.8.8.8"},
+		{"PTR uses the fast upstream", "1.0.0.10.in-addr.arpa.", dns.TypePTR, "udp",
+			nil, nil, nil, dns.RcodeSuccess, fast.Addr, ""},
+		{"fall back to the clean upstream on SERVFAIL", "www.corp.example.", dns.TypeA, "udp",
+			dnstest.Servfail(), nil, nil, dns.RcodeSuccess, clean.Addr, "10.0.0.2"},
+		{"fall back to the clean upstream on NXDOMAIN", "www.corp.example.", dns.TypeA, "udp",
+			dnstest.Rcode(dns.RcodeNameError), nil, nil, dns.RcodeSuccess, clean.Addr, "10.0.0.2"},
+		{"fall back to the clean upstream when the fast one is slow", "www.corp.example.", dns.TypeA, "udp",
+			dnstest.Drop(), nil, nil, dns.RcodeSuccess, clean.Addr, "10.0.0.2"},
+		{"NXDOMAIN when no upstream has the domain", "www.corp.example.", dns.TypeA, "udp",
+			dnstest.Servfail(), dnstest.Rcode(dns.RcodeNameError), nil, dns.RcodeNameError, clean.Addr, ""},
+		{"SERVFAIL when all the upstreams fail", "www.corp.example.", dns.TypeA, "udp",
+			dnstest.Servfail(), dnstest.Servfail(), nil, dns.RcodeServerFailure, fast.Addr + "," + clean.Addr, ""},
+		{"SERVFAIL when the upstream times out", "www.example.", dns.TypeA, "udp",
+			nil, nil, dnstest.Drop(), dns.RcodeServerFailure, public.Addr, ""},
+		{"truncated answers are passed to the client", "www.example.", dns.TypeA, "udp",
+			nil, nil, dnstest.Truncate(dnstest.A("8.8.8.8")), dns.RcodeSuccess, public.Addr, ""},
+		{"tcp gets the complete answer", "www.example.", dns.TypeA, "tcp",
+			nil, nil, dnstest.Truncate(dnstest.A("8.8.8.8")), dns.RcodeSuccess, public.Addr, "8.8.8.8"},
+		{"tcp is not poisoned", "www.example.", dns.TypeA, "tcp",
+			nil, nil, dnstest.Poison("6.6.6.6", dnstest.A("8.8.8.8")), dns.RcodeSuccess, public.Addr, "8.8.8.8"},
 	}
 	for _, tt := range tests {
-		t.Run(tt.domain, func(t *testing.T) {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, u := range []struct {
+				server  *dnstest.Server
+				handler dns.Handler
+				dflt    dns.Handler
+			}{
+				{fast, tt.fast, dnstest.A("10.0.0.1")},
+				{clean, tt.clean, dnstest.A("10.0.0.2")},
+				{public, tt.public, dnstest.A("8.8.8.8")},
+			} {
+				if u.handler == nil {
+					u.handler = u.dflt
+				}
+				u.server.SetHandler(u.handler)
+			}
+
 			q := dns.Question{
 				Name:   tt.domain,
 				Qtype:  tt.qtype,
@@ -41,16 +84,40 @@ func Test_spoofing_proof_resolver_resolve(t *testing.T) {
 			}
 
 			start := time.Now()
-			res, upstream := resolver.resolve(q, true, tt.net)
-			end := time.Now()
-			elapsed := end.Sub(start)
+			res, upstream := resolver.resolve(context.Background(), q, true, tt.net)
+			elapsed := time.Since(start)
+			if res.Rcode != tt.expectedRcode {
+				t.Errorf("spoofing_proof_resolver.resolve() rcode = %v, want %v", dns.RcodeToString[res.Rcode], dns.RcodeToString[tt.expectedRcode])
+			}
 			if upstream != tt.expectedUpstream {
 				t.Errorf("spoofing_proof_resolver.resolve() got1 = %v, want %v", upstream, tt.expectedUpstream)
 			}
-			if len(res.Answer) == 0 {
-				t.Errorf("Expect returning at least one answer")
+			if tt.expectedIP != "" && (len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != tt.expectedIP) {
+				t.Errorf("expect the answer %v, got %v", tt.expectedIP, res.Answer)
+			}
+			if elapsed > 2500*time.Millisecond {
+				t.Errorf("the resolution should time out, took %v", elapsed)
 			}
 			t.Logf("spoofing_proof_resolver.resolve() domain = %v, net = %v, elapsed = %v, record = %v", tt.domain, tt.net, elapsed, res)
 		})
 	}
 }
+
+func TestRouteWhiteDomains(t *testing.T) {
+	resolver := newSpoofingProofResolver(nil, nil, nil)
+	resolver.whiteDomains = whitedomain.MustCompile([]string{"corp.example", "@@dev.corp.example"})
+	for domain, want := range map[string]string{
+		"corp.example.":         routeWhite,
+		"www.corp.example.":     routeWhite,
+		"www.dev.corp.example.": routePublic,
+		"notcorp.example.":      routePublic,
+		"www.example.":          routePublic,
+	} {
+		if got := resolver.route(dns.Question{Name: domain, Qtype: dns.TypeA, Qclass: dns.ClassINET}); got != want {
+			t.Errorf("%s is routed to %s, want %s", domain, got, want)
+		}
+	}
+	if got := resolver.route(dns.Question{Name: "4.3.2.1.in-addr.arpa.", Qtype: dns.TypePTR, Qclass: dns.ClassINET}); got != routePTR {
+		t.Errorf("the reverse lookups are routed to %s", got)
+	}
+}
@@ -0,0 +1,175 @@
+package freedns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The errors of Resolver.Resolve.
+const (
+	// ErrInvalidRequest is returned for the requests which are not a query with a single question.
+	ErrInvalidRequest = Error("Invalid request: a query with a single question is expected")
+	// ErrUpstreamFailure is wrapped by ResolveError when no upstream could answer in time.
+	ErrUpstreamFailure = Error("The upstreams failed to answer")
+	// ErrDropped is wrapped by ResolveError when a stage of the chain dropped the query.
+	ErrDropped = Error("The query was dropped by the chain")
+)
+
+// ResolveError tells which question failed and which upstreams were tried.
+// It wraps ErrUpstreamFailure, ErrDropped, or the error of the context.
+type ResolveError struct {
+	Question  dns.Question
+	Upstreams []string
+	Err       error
+}
+
+func (e *ResolveError) Error() string {
+	return "Failed to resolve " + e.Question.Name + " " + dns.TypeToString[e.Question.Qtype] +
+		" with " + strings.Join(e.Upstreams, ",") + ": " + e.Err.Error()
+}
+
+func (e *ResolveError) Unwrap() error {
+	return e.Err
+}
+
+// Decision records how a query was resolved.
+type Decision struct {
+	// Route is why the upstreams were chosen: "ptr", "white" or "public",
+	// or "fast" or "clean" for the domains of the rule sets.
+	Route string
+	// Upstream answered the query, "cache" or "stale" for the cached answers.
+	Upstream string
+	Elapsed  time.Duration
+}
+
+// Resolver resolves in-process with the same routing, cache and validation as the Server,
+// configured by the same Config. The queries go through the chain of Config.Chain, without
+// the stages of the listeners: the views, the access control and the rate limits are not used.
+type Resolver struct {
+	server *Server
+}
+
+// NewResolver creates a resolver, which should be closed to save its cache file.
+func NewResolver(cfg Config) (*Resolver, error) {
+	s, err := NewServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{server: s}, nil
+}
+
+// Resolve answers the query `req`. NXDOMAIN and NODATA are answers, not errors:
+// the error is ErrInvalidRequest or a *ResolveError, with the Decision filled anyway.
+func (r *Resolver) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, Decision, error) {
+	if len(req.Question) != 1 || req.Opcode != dns.OpcodeQuery || req.Response {
+		return nil, Decision{}, ErrInvalidRequest
+	}
+	q := req.Question[0]
+	resolver := r.server.resolver
+	decision := Decision{Route: resolver.route(q)}
+
+	type result struct {
+		res      *dns.Msg
+		upstream string
+	}
+	start := time.Now()
+	ch := make(chan result, 1)
+	go func() {
+		res, upstream := r.handle(ctx, req, "udp")
+		if res != nil && res.Truncated {
+			res, upstream = r.handle(ctx, req, "tcp")
+		}
+		ch <- result{res, upstream}
+	}()
+
+	select {
+	case <-ctx.Done():
+		decision.Elapsed = time.Since(start)
+		return nil, decision, &ResolveError{Question: q, Err: ctx.Err()}
+	case out := <-ch:
+		decision.Upstream = out.upstream
+		decision.Elapsed = time.Since(start)
+		switch {
+		case ctx.Err() != nil:
+			// the upstreams failed because of ctx
+			return nil, decision, &ResolveError{Question: q, Err: ctx.Err()}
+		case out.res == nil:
+			return nil, decision, &ResolveError{Question: q, Err: ErrDropped}
+		case out.res.Rcode == dns.RcodeServerFailure:
+			err := &ResolveError{Question: q, Err: ErrUpstreamFailure}
+			if out.upstream != "" {
+				err.Upstreams = strings.Split(out.upstream, ",")
+			}
+			return nil, decision, err
+		}
+		return out.res, decision, nil
+	}
+}
+
+// handle runs the query through the chain of the in-process queries.
+func (r *Resolver) handle(ctx context.Context, req *dns.Msg, net string) (*dns.Msg, string) {
+	request := &Request{
+		Msg:      req,
+		Net:      net,
+		View:     "default",
+		resolver: r.server.resolver,
+	}
+	res := r.server.inProcessChain(ctx, request)
+	return res, request.Upstream
+}
+
+// Close saves the cache file if any.
+func (r *Resolver) Close() {
+	r.server.Shutdown()
+}
+
+// Dial is a Dial function of net.Resolver, which resolves through the Resolver without network:
+//
+//	&net.Resolver{PreferGo: true, Dial: resolver.Dial}
+func (r *Resolver) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go r.serveConn(ctx, server)
+	return client, nil
+}
+
+// serveConn answers the length prefixed queries of a stream connection, like dns over tcp.
+func (r *Resolver) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		wire := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, wire); err != nil {
+			return
+		}
+		req := &dns.Msg{}
+		if err := req.Unpack(wire); err != nil {
+			return
+		}
+
+		res, _, err := r.Resolve(ctx, req)
+		switch {
+		case err == ErrInvalidRequest:
+			res = &dns.Msg{}
+			res.SetRcode(req, dns.RcodeFormatError)
+		case err != nil:
+			res = &dns.Msg{}
+			res.SetRcode(req, dns.RcodeServerFailure)
+		}
+		if wire, err = res.Pack(); err != nil {
+			return
+		}
+		binary.BigEndian.PutUint16(length[:], uint16(len(wire)))
+		if _, err := conn.Write(append(length[:], wire...)); err != nil {
+			return
+		}
+	}
+}
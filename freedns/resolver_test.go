@@ -0,0 +1,175 @@
+package freedns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/freedns/dnstest"
+	"github.com/xiangyu123/cosp_dns/whitedomain"
+)
+
+func newTestResolver(t *testing.T, fast, clean, public *dnstest.Server) *Resolver {
+	r, err := NewResolver(Config{
+		FastUpstream:   fast.Addr,
+		CleanUpstream:  clean.Addr,
+		PublicUpstream: public.Addr,
+		Listen:         "127.0.0.1:0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.server.resolver.whiteDomains = whitedomain.MustCompile([]string{"corp.example"})
+	return r
+}
+
+func TestResolver(t *testing.T) {
+	fast := dnstest.NewServer(dnstest.A("10.0.0.1"))
+	defer fast.Close()
+	clean := dnstest.NewServer(dnstest.A("10.0.0.2"))
+	defer clean.Close()
+	public := dnstest.NewServer(dnstest.Records(
+		"example. 3600 IN SOA ns.example. admin.example. 1 7200 900 1209600 60",
+		"www.example. 300 IN A 8.8.8.8",
+	))
+	defer public.Close()
+	r := newTestResolver(t, fast, clean, public)
+	defer r.Close()
+
+	resolve := func(ctx context.Context, name string) (*dns.Msg, Decision, error) {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		return r.Resolve(ctx, req)
+	}
+
+	res, decision, err := resolve(context.Background(), "www.corp.example.")
+	if err != nil || len(res.Answer) != 1 || decision.Route != routeWhite || decision.Upstream != fast.Addr {
+		t.Errorf("unexpected answer %v, decision %+v, error %v", res, decision, err)
+	}
+
+	res, decision, err = resolve(context.Background(), "nx.example.")
+	if err != nil || res.Rcode != dns.RcodeNameError || decision.Route != routePublic || decision.Upstream != public.Addr {
+		t.Errorf("NXDOMAIN should be an answer, got %v, decision %+v, error %v", res, decision, err)
+	}
+
+	fast.SetHandler(dnstest.Servfail())
+	clean.SetHandler(dnstest.Servfail())
+	_, _, err = resolve(context.Background(), "www.corp.example.")
+	var resolveErr *ResolveError
+	if !errors.Is(err, ErrUpstreamFailure) || !errors.As(err, &resolveErr) || len(resolveErr.Upstreams) != 2 {
+		t.Errorf("the failure of the upstreams should be a ResolveError, got %v", err)
+	}
+
+	fast.SetHandler(dnstest.Drop())
+	clean.SetHandler(dnstest.Drop())
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err = resolve(ctx, "slow.corp.example.")
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Errorf("the context should cancel the resolution, got %v after %v", err, time.Since(start))
+	}
+
+	req := &dns.Msg{}
+	if _, _, err := r.Resolve(context.Background(), req); err != ErrInvalidRequest {
+		t.Errorf("requests without question should be invalid, got %v", err)
+	}
+}
+
+func TestResolverCancelled(t *testing.T) {
+	slow := dnstest.NewServer(dnstest.Delay(time.Second, dnstest.A("10.0.0.1")))
+	defer slow.Close()
+	r := newTestResolver(t, slow, slow, slow)
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := &dns.Msg{}
+	req.SetQuestion("www.corp.example.", dns.TypeA)
+	start := time.Now()
+	if _, _, err := r.Resolve(ctx, req); !errors.Is(err, context.Canceled) || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("the cancelled context should fail the resolution, got %v after %v", err, time.Since(start))
+	}
+
+	// the exchanges are aborted instead of waiting for the upstreams
+	q := dns.Question{Name: "www.corp.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	start = time.Now()
+	res, _ := r.server.resolver.resolveUpstreams(ctx, q, true, "udp")
+	if res.Rcode != dns.RcodeServerFailure || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("the exchanges should be aborted, got %v after %v", res, time.Since(start))
+	}
+
+	// the cancelled query is not cached as a failure
+	res, _, err := r.Resolve(context.Background(), req)
+	if err != nil || len(res.Answer) != 1 {
+		t.Errorf("unexpected answer %v, error %v", res, err)
+	}
+}
+
+func TestResolverDial(t *testing.T) {
+	fast := dnstest.NewServer(dnstest.A("10.0.0.1"))
+	defer fast.Close()
+	clean := dnstest.NewServer(dnstest.A("10.0.0.2"))
+	defer clean.Close()
+	public := dnstest.NewServer(dnstest.A("8.8.8.8"))
+	defer public.Close()
+	r := newTestResolver(t, fast, clean, public)
+	defer r.Close()
+
+	goResolver := &net.Resolver{PreferGo: true, Dial: r.Dial}
+	tests := map[string]string{
+		"www.corp.example.": "10.0.0.1",
+		"www.example.":      "8.8.8.8",
+	}
+	for name, want := range tests {
+		addrs, err := goResolver.LookupHost(context.Background(), name)
+		if err != nil || len(addrs) != 1 || addrs[0] != want {
+			t.Errorf("LookupHost(%q) = %v, %v, want %s", name, addrs, err, want)
+		}
+	}
+}
+
+func TestResolverChain(t *testing.T) {
+	upstream := dnstest.NewServer(dnstest.A("5.6.7.8"))
+	defer upstream.Close()
+	r, err := NewResolver(Config{
+		FastUpstream:   upstream.Addr,
+		CleanUpstream:  upstream.Addr,
+		PublicUpstream: upstream.Addr,
+		Listen:         "127.0.0.1:0",
+		// the stages of the listeners are skipped
+		ACL:   &ACL{Deny: []string{"0.0.0.0/0", "::/0"}},
+		Chain: []string{"acl", "ratelimit", "view", "drop", "local", "resolve"},
+		Plugins: map[string]Handler{
+			"local": localRecords{"printer.lan.": "192.168.1.9"},
+			"drop": HandlerFunc(func(ctx context.Context, req *Request, next Next) *dns.Msg {
+				if req.Msg.Question[0].Name == "dropped.example." {
+					return nil
+				}
+				return next(ctx, req)
+			}),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	resolve := func(name string) (*dns.Msg, Decision, error) {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		return r.Resolve(context.Background(), req)
+	}
+	if res, decision, err := resolve("printer.lan."); err != nil || len(res.Answer) != 1 || decision.Upstream != "local" {
+		t.Errorf("the local plugin should answer, got %v, decision %+v, error %v", res, decision, err)
+	}
+	if res, decision, err := resolve("www.example."); err != nil || len(res.Answer) != 1 || decision.Upstream != upstream.Addr {
+		t.Errorf("the other names should be resolved, got %v, decision %+v, error %v", res, decision, err)
+	}
+	if _, _, err := resolve("dropped.example."); !errors.Is(err, ErrDropped) {
+		t.Errorf("the dropped queries should fail with ErrDropped, got %v", err)
+	}
+}
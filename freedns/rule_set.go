@@ -0,0 +1,187 @@
+package freedns
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xiangyu123/cosp_dns/whitedomain"
+)
+
+// RuleSet routes the domains of a Clash or Surge rule set, see whitedomain.ParseRuleSet.
+type RuleSet struct {
+	// File is a Clash rule provider, a Clash config with its rules or a Surge rule set.
+	File string
+	// Policy is the policy of the rules without one, e.g. "PROXY" for a rule provider.
+	Policy string
+}
+
+// DefaultRulePolicies maps the usual policies of the rule sets to the upstreams.
+var DefaultRulePolicies = map[string]string{
+	"DIRECT": routeFast,
+	"PROXY":  routeClean,
+}
+
+// ruleSetRule is the route of a rule, index is its order in the rule sets.
+type ruleSetRule struct {
+	index int
+	route string
+}
+
+type keywordRoute struct {
+	keyword string
+	ruleSetRule
+}
+
+type regexpRoute struct {
+	re *regexp.Regexp
+	ruleSetRule
+}
+
+// ruleSets routes the domains like Clash and Surge: the first rule matching a domain wins.
+// The DOMAIN and DOMAIN-SUFFIX rules are indexed, so only the keyword and regexp rules are scanned.
+type ruleSets struct {
+	full     map[string]ruleSetRule
+	suffixes map[string]ruleSetRule
+	keywords []keywordRoute
+	regexps  []regexpRoute
+}
+
+// loadRuleSets parses Config.RuleSets, the rules of the policies which are not mapped to
+// an upstream and the rules which can't route domains, like IP-CIDR, are skipped with a warning.
+func loadRuleSets(cfg Config, stats *counters) (*ruleSets, error) {
+	if len(cfg.RuleSets) == 0 {
+		return nil, nil
+	}
+	policies := cfg.RulePolicies
+	if policies == nil {
+		policies = DefaultRulePolicies
+	}
+	for policy, route := range policies {
+		switch route {
+		case routeFast, routeClean, routeWhite, routePublic:
+		default:
+			return nil, Error("Invalid upstream " + route + " of the policy " + policy)
+		}
+	}
+
+	r := &ruleSets{
+		full:     make(map[string]ruleSetRule),
+		suffixes: make(map[string]ruleSetRule),
+	}
+	index := 0
+	for _, rs := range cfg.RuleSets {
+		set, err := whitedomain.LoadRuleSetFile(rs.File)
+		if err != nil {
+			return nil, err
+		}
+		parsed, skipped := 0, set.Skipped
+		unmapped := make(map[string]int)
+		for _, rule := range set.Rules {
+			policy := rule.Policy
+			if policy == "" {
+				policy = rs.Policy
+			}
+			route, ok := policies[policy]
+			if !ok {
+				unmapped[policy]++
+				skipped++
+				continue
+			}
+			if err := r.add(rule, ruleSetRule{index, route}); err != nil {
+				return nil, err
+			}
+			index++
+			parsed++
+		}
+
+		for policy, n := range unmapped {
+			log.WithFields(logrus.Fields{
+				"op":     "load_rule_set",
+				"file":   rs.File,
+				"policy": policy,
+				"rules":  n,
+			}).Warn("No upstream for the policy, its rules are skipped")
+		}
+		for typ, n := range set.Ignored {
+			skipped += n
+			log.WithFields(logrus.Fields{
+				"op":    "load_rule_set",
+				"file":  rs.File,
+				"type":  typ,
+				"rules": n,
+			}).Warn("The rules can't route domains, they are ignored")
+		}
+		stats.add("rule_set_parsed", uint64(parsed))
+		stats.add("rule_set_skipped", uint64(skipped))
+		log.WithFields(logrus.Fields{
+			"op":      "load_rule_set",
+			"file":    rs.File,
+			"parsed":  parsed,
+			"skipped": skipped,
+		}).Info()
+	}
+	return r, nil
+}
+
+func (r *ruleSets) add(rule whitedomain.Rule, route ruleSetRule) error {
+	switch rule.Type {
+	case whitedomain.RuleDomain:
+		if _, ok := r.full[rule.Value]; !ok {
+			r.full[rule.Value] = route
+		}
+	case whitedomain.RuleDomainSuffix:
+		if _, ok := r.suffixes[rule.Value]; !ok {
+			r.suffixes[rule.Value] = route
+		}
+	case whitedomain.RuleDomainKeyword:
+		r.keywords = append(r.keywords, keywordRoute{rule.Value, route})
+	case whitedomain.RuleDomainRegex:
+		re, err := regexp.Compile("(?i)" + rule.Value)
+		if err != nil {
+			return err
+		}
+		r.regexps = append(r.regexps, regexpRoute{re, route})
+	}
+	return nil
+}
+
+// match returns the route of the first rule matching the domain.
+func (r *ruleSets) match(name string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	best, found := r.full[name]
+	for suffix := name; ; {
+		if rule, ok := r.suffixes[suffix]; ok && (!found || rule.index < best.index) {
+			best, found = rule, true
+		}
+		i := strings.Index(suffix, ".")
+		if i < 0 {
+			break
+		}
+		suffix = suffix[i+1:]
+	}
+	// the keyword and regexp rules are in order, the scans stop at the best rule found
+	for _, k := range r.keywords {
+		if found && k.index > best.index {
+			break
+		}
+		if strings.Contains(name, k.keyword) {
+			best, found = k.ruleSetRule, true
+			break
+		}
+	}
+	for _, re := range r.regexps {
+		if found && re.index > best.index {
+			break
+		}
+		if re.re.MatchString(name) {
+			best, found = re.ruleSetRule, true
+			break
+		}
+	}
+	return best.route, found
+}
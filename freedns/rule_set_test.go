@@ -0,0 +1,161 @@
+package freedns
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/freedns/dnstest"
+)
+
+// writeTestRuleSets writes a Clash config and a rule provider of the PROXY policy to dir.
+func writeTestRuleSets(t *testing.T, dir string) []RuleSet {
+	clash := filepath.Join(dir, "config.yaml")
+	err := ioutil.WriteFile(clash, []byte(`rules:
+  - DOMAIN,www.google.cn,DIRECT
+  - DOMAIN-KEYWORD,google,PROXY
+  - DOMAIN-SUFFIX,google.cn,DIRECT
+  - DOMAIN-SUFFIX,cn.bing.com,DIRECT
+  - DOMAIN-SUFFIX,bing.com,PROXY
+  - DOMAIN-SUFFIX,ads.example,REJECT
+  - IP-CIDR,1.0.0.0/8,DIRECT
+  - MATCH,PROXY
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := filepath.Join(dir, "proxy.yaml")
+	err = ioutil.WriteFile(provider, []byte(`payload:
+  - '+.github.com'
+  - DOMAIN-SUFFIX,corp.example
+  - DOMAIN-REGEX,^cdn\d+\.bing\.com$
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []RuleSet{{File: clash}, {File: provider, Policy: "PROXY"}}
+}
+
+func TestRuleSets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freedns_rule_set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stats := newCounters()
+	r, err := loadRuleSets(Config{RuleSets: writeTestRuleSets(t, dir)}, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stats.snapshot(); got["rule_set_parsed"] != 8 || got["rule_set_skipped"] != 3 {
+		t.Errorf("unexpected counters %v", got)
+	}
+
+	resolver := newSpoofingProofResolver(nil, nil, nil)
+	resolver.ruleSets = r
+	tests := []struct {
+		name  string
+		route string
+	}{
+		// the first matching rule wins, whatever its type
+		{"www.google.cn.", routeFast},
+		{"google.cn.", routeClean},
+		{"maps.google.cn.", routeClean},
+		{"cn.bing.com.", routeFast},
+		{"www.cn.bing.com.", routeFast},
+		{"www.bing.com.", routeClean},
+		{"cdn1.bing.com.", routeClean},
+		{"GitHub.com.", routeClean},
+		// the rule sets come before the white domains
+		{"www.corp.example.", routeClean},
+		// the other policies are skipped
+		{"ads.example.", routePublic},
+		{"baidu.com.", routeWhite},
+	}
+	for _, tt := range tests {
+		if got := resolver.route(dns.Question{Name: tt.name, Qtype: dns.TypeA, Qclass: dns.ClassINET}); got != tt.route {
+			t.Errorf("%s is routed to %s, want %s", tt.name, got, tt.route)
+		}
+	}
+
+	r, err = loadRuleSets(Config{
+		RuleSets:     []RuleSet{{File: filepath.Join(dir, "config.yaml")}},
+		RulePolicies: map[string]string{"DIRECT": routeWhite, "REJECT": routePublic},
+	}, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route, _ := r.match("www.google.cn."); route != routeWhite {
+		t.Errorf("DIRECT should be routed to %s, got %s", routeWhite, route)
+	}
+	if _, found := r.match("www.bing.com."); found {
+		t.Errorf("the rules of the unmapped policies should be skipped")
+	}
+	if route, _ := r.match("ads.example."); route != routePublic {
+		t.Errorf("REJECT should be routed to %s, got %s", routePublic, route)
+	}
+}
+
+func TestInvalidRuleSets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freedns_rule_set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ruleSets := writeTestRuleSets(t, dir)
+
+	for _, cfg := range []Config{
+		{RuleSets: []RuleSet{{File: filepath.Join(dir, "missing.yaml")}}},
+		{RuleSets: ruleSets, RulePolicies: map[string]string{"DIRECT": "proxy"}},
+	} {
+		if _, err := loadRuleSets(cfg, newCounters()); err == nil {
+			t.Errorf("should not load the rule sets of %+v", cfg)
+		}
+	}
+	if r, err := loadRuleSets(Config{}, newCounters()); r != nil || err != nil {
+		t.Errorf("no rule set should be loaded, got %v, %v", r, err)
+	}
+}
+
+func TestRuleSetUpstreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "freedns_rule_set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fast := dnstest.NewServer(dnstest.A("10.0.0.1"))
+	defer fast.Close()
+	clean := dnstest.NewServer(dnstest.A("10.0.0.2"))
+	defer clean.Close()
+	public := dnstest.NewServer(dnstest.A("10.0.0.3"))
+	defer public.Close()
+	r, err := NewResolver(Config{
+		FastUpstream:   fast.Addr,
+		CleanUpstream:  clean.Addr,
+		PublicUpstream: public.Addr,
+		Listen:         "127.0.0.1:0",
+		RuleSets:       writeTestRuleSets(t, dir),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for name, upstream := range map[string]string{
+		"www.google.cn.":  fast.Addr,
+		"www.github.com.": clean.Addr,
+		"www.example.":    public.Addr,
+	} {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		_, decision, err := r.Resolve(context.Background(), req)
+		if err != nil || decision.Upstream != upstream {
+			t.Errorf("%s: decision %+v, error %v, want upstream %s", name, decision, err, upstream)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package freedns
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// staleTTL is the TTL of the stale records sent to the clients (RFC 8767 suggests 30 seconds).
+const staleTTL = 30
+
+// staleRecheck is how long stale answers are served right away after
+// the upstreams failed, before the client waits for them again.
+const staleRecheck = 30 * time.Second
+
+// staleFailures remembers the questions whose upstreams recently failed.
+type staleFailures struct {
+	mutex  sync.Mutex
+	failed map[string]time.Time
+}
+
+func newStaleFailures() *staleFailures {
+	return &staleFailures{
+		failed: make(map[string]time.Time),
+	}
+}
+
+func (f *staleFailures) recent(key string, now time.Time) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	at, ok := f.failed[key]
+	if ok && now.Sub(at) >= staleRecheck {
+		delete(f.failed, key)
+		return false
+	}
+	return ok
+}
+
+func (f *staleFailures) mark(key string, now time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.failed) >= maxBuckets {
+		for k, at := range f.failed {
+			if now.Sub(at) >= staleRecheck {
+				delete(f.failed, k)
+			}
+		}
+	}
+	f.failed[key] = now
+}
+
+func (f *staleFailures) clear(key string) {
+	f.mutex.Lock()
+	delete(f.failed, key)
+	f.mutex.Unlock()
+}
+
+// lookupCache returns the cached answer of the question, or nil if it has to be resolved.
+// Expired answers are only used by serve-stale, when the upstreams can't answer in time.
+func (s *Server) lookupCache(resolver *spoofingProofResolver, q dns.Question, recursion bool, net string) (*dns.Msg, string) {
+	cached, needUpdate, staleFor := resolver.cache.lookupStale(q, recursion, net)
+	if cached == nil {
+		return nil, ""
+	}
+	if cached.Rcode == dns.RcodeServerFailure {
+		// failures are never served stale
+		if staleFor >= 0 {
+			return nil, ""
+		}
+		s.countCacheHit(cached)
+		return cached, "cache"
+	}
+	if staleFor < 0 || !s.config.ServeStale {
+		s.countCacheHit(cached)
+		if needUpdate {
+			go s.refresh(resolver, q, recursion, net)
+		}
+		return cached, "cache"
+	}
+	if staleFor > s.config.StaleWindow {
+		return nil, ""
+	}
+	return s.resolveOrStale(resolver, q, recursion, net, cached)
+}
+
+// resolveOrStale resolves the question, and falls back to the stale answer when the upstreams
+// fail or are slower than StaleAnswerTimeout. The resolution goes on in the background to update the cache.
+func (s *Server) resolveOrStale(resolver *spoofingProofResolver, q dns.Question, recursion bool, net string, stale *dns.Msg) (*dns.Msg, string) {
+	type result struct {
+		res      *dns.Msg
+		upstream string
+	}
+
+	key := requestToString(q, recursion, net)
+	ch := make(chan result, 1)
+	go func() {
+		res, upstream := resolver.resolve(context.Background(), q, recursion, net)
+		if res.Rcode != dns.RcodeServerFailure {
+			s.store(resolver.cache, q, recursion, res, net)
+			s.staleFailures.clear(key)
+		} else {
+			s.staleFailures.mark(key, time.Now())
+		}
+		ch <- result{res, upstream}
+	}()
+
+	if !s.staleFailures.recent(key, time.Now()) {
+		timer := time.NewTimer(s.config.StaleAnswerTimeout)
+		defer timer.Stop()
+		select {
+		case r := <-ch:
+			if r.res.Rcode != dns.RcodeServerFailure {
+				return r.res, r.upstream
+			}
+		case <-timer.C:
+		}
+	}
+
+	setTTL(stale, staleTTL)
+	s.stats.inc("stale_served")
+	log.WithFields(logrus.Fields{
+		"op":     "serve_stale",
+		"domain": q.Name,
+		"type":   dns.TypeToString[q.Qtype],
+	}).Warn()
+	return stale, "stale"
+}
+
+// setTTL sets the TTL of all the records of `res`.
+func setTTL(res *dns.Msg, ttl uint32) {
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package freedns
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	upstreamUp int32 = iota
+	upstreamFailing
+	upstreamSlow
+)
+
+func TestServeStale(t *testing.T) {
+	var mode int32
+	addr, shutdown := startTestUpstream(t, dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		switch atomic.LoadInt32(&mode) {
+		case upstreamFailing:
+			res := &dns.Msg{}
+			res.SetRcode(req, dns.RcodeServerFailure)
+			w.WriteMsg(res)
+			return
+		case upstreamSlow:
+			time.Sleep(300 * time.Millisecond)
+		}
+		answerA("5.6.7.8")(w, req)
+	}))
+	defer shutdown()
+
+	s, err := NewServer(Config{
+		FastUpstream:       addr,
+		CleanUpstream:      addr,
+		PublicUpstream:     addr,
+		Listen:             "127.0.0.1:0",
+		Cache:              true,
+		ServeStale:         true,
+		StaleWindow:        time.Hour,
+		StaleAnswerTimeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, _ := newListener(Listener{Addr: "127.0.0.1:0"}, nil, "udp")
+
+	expire := func(name string, ago time.Duration) {
+		q := dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		reply := newCachedReply(t, name, "60")
+		reply.RecursionDesired = true
+		s.resolver.cache.put(requestToString(q, true, "udp"), cacheEntry{putin: time.Now().Add(-60*time.Second - ago), reply: reply})
+	}
+	query := func(name string) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, dns.TypeA)
+		w := newTestResponseWriter("127.0.0.1", "udp")
+		s.handle(w, req, ln)
+		return w.msg
+	}
+	assertAnswer := func(res *dns.Msg, ip string, ttl uint32) {
+		t.Helper()
+		if res == nil || res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 {
+			t.Fatalf("unexpected response %v", res)
+		}
+		a := res.Answer[0].(*dns.A)
+		if a.A.String() != ip || a.Hdr.Ttl != ttl {
+			t.Errorf("got %s with ttl %d, want %s with ttl %d", a.A, a.Hdr.Ttl, ip, ttl)
+		}
+	}
+
+	// the upstream answers in time, the stale entry is replaced
+	expire("up.example.", time.Minute)
+	assertAnswer(query("up.example."), "5.6.7.8", 300)
+
+	// the upstream fails
+	atomic.StoreInt32(&mode, upstreamFailing)
+	expire("failing.example.", time.Minute)
+	assertAnswer(query("failing.example."), "1.2.3.4", staleTTL)
+	start := time.Now()
+	assertAnswer(query("failing.example."), "1.2.3.4", staleTTL)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("stale answers should be served right away after a failure, took %v", elapsed)
+	}
+
+	// entries expired beyond the stale window are not served
+	expire("ancient.example.", 2*time.Hour)
+	if res := query("ancient.example."); res.Rcode != dns.RcodeServerFailure {
+		t.Errorf("entries beyond the stale window should not be served, got %v", res)
+	}
+
+	// the upstream is too slow, the stale answer is served and the cache updated in the background
+	atomic.StoreInt32(&mode, upstreamSlow)
+	expire("slow.example.", time.Minute)
+	assertAnswer(query("slow.example."), "1.2.3.4", staleTTL)
+	time.Sleep(400 * time.Millisecond)
+	assertAnswer(query("slow.example."), "5.6.7.8", 300)
+
+	if served := s.Stats()["stale_served"]; served != 3 {
+		t.Errorf("stale answers should be counted, got %d", served)
+	}
+}
@@ -0,0 +1,35 @@
+package freedns
+
+import "sync"
+
+// counters is a set of named monotonic counters.
+type counters struct {
+	mutex  sync.Mutex
+	values map[string]uint64
+}
+
+func newCounters() *counters {
+	return &counters{
+		values: make(map[string]uint64),
+	}
+}
+
+func (c *counters) inc(name string) {
+	c.add(name, 1)
+}
+
+func (c *counters) add(name string, delta uint64) {
+	c.mutex.Lock()
+	c.values[name] += delta
+	c.mutex.Unlock()
+}
+
+func (c *counters) snapshot() map[string]uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	values := make(map[string]uint64, len(c.values))
+	for name, value := range c.values {
+		values[name] = value
+	}
+	return values
+}
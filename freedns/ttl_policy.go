@@ -0,0 +1,55 @@
+package freedns
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TTLPolicy clamps the TTLs of the positive answers.
+type TTLPolicy struct {
+	// MinTTL and MaxTTL clamp how long the answers stay in the cache, zero means no limit.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// RewriteClientTTL sends the clamped TTLs to the clients as well,
+	// otherwise they see the TTLs published by the domain.
+	RewriteClientTTL bool
+}
+
+func (p TTLPolicy) clamp(ttl uint32) uint32 {
+	if min := uint32(p.MinTTL.Seconds()); ttl < min {
+		ttl = min
+	}
+	if max := uint32(p.MaxTTL.Seconds()); max > 0 && ttl > max {
+		ttl = max
+	}
+	return ttl
+}
+
+// clampTTLs rewrites the TTLs of the records of `res` in place.
+func (p TTLPolicy) clampTTLs(res *dns.Msg) {
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = p.clamp(rr.Header().Ttl)
+			}
+		}
+	}
+}
+
+// ttlPolicy returns the policy of the domain: the override of its longest
+// matching suffix in Config.DomainTTLPolicies, or the global one.
+func (s *Server) ttlPolicy(name string) TTLPolicy {
+	name = strings.ToLower(strings.TrimRight(name, "."))
+	for {
+		if policy, ok := s.config.DomainTTLPolicies[name]; ok {
+			return policy
+		}
+		i := strings.Index(name, ".")
+		if i < 0 {
+			return s.config.TTLPolicy
+		}
+		name = name[i+1:]
+	}
+}
@@ -0,0 +1,104 @@
+package freedns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTTLPolicyClamp(t *testing.T) {
+	policy := TTLPolicy{MinTTL: time.Minute, MaxTTL: time.Hour}
+	tests := []struct {
+		ttl  uint32
+		want uint32
+	}{
+		{0, 60},
+		{5, 60},
+		{300, 300},
+		{86400, 3600},
+	}
+	for _, tt := range tests {
+		if got := policy.clamp(tt.ttl); got != tt.want {
+			t.Errorf("clamp(%d) = %d, want %d", tt.ttl, got, tt.want)
+		}
+	}
+	if got := (TTLPolicy{}).clamp(86400); got != 86400 {
+		t.Errorf("the zero policy should not clamp, got %d", got)
+	}
+}
+
+func TestDomainTTLPolicy(t *testing.T) {
+	s := &Server{config: Config{
+		TTLPolicy: TTLPolicy{MaxTTL: time.Hour},
+		DomainTTLPolicies: map[string]TTLPolicy{
+			"corp.example":     {MinTTL: time.Minute},
+			"api.corp.example": {MinTTL: 5 * time.Minute},
+		},
+	}}
+	tests := []struct {
+		name string
+		want TTLPolicy
+	}{
+		{"www.example.", TTLPolicy{MaxTTL: time.Hour}},
+		{"corp.example.", TTLPolicy{MinTTL: time.Minute}},
+		{"HOST.Corp.Example.", TTLPolicy{MinTTL: time.Minute}},
+		{"v1.api.corp.example.", TTLPolicy{MinTTL: 5 * time.Minute}},
+		{"notcorp.example.", TTLPolicy{MaxTTL: time.Hour}},
+	}
+	for _, tt := range tests {
+		if got := s.ttlPolicy(tt.name); got != tt.want {
+			t.Errorf("ttlPolicy(%q) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTTLPolicyCaching(t *testing.T) {
+	addr, shutdown := startTestUpstream(t, answerA("5.6.7.8"))
+	defer shutdown()
+
+	s, err := NewServer(Config{
+		FastUpstream:   addr,
+		CleanUpstream:  addr,
+		PublicUpstream: addr,
+		Listen:         "127.0.0.1:0",
+		Cache:          true,
+		TTLPolicy:      TTLPolicy{MaxTTL: time.Minute},
+		DomainTTLPolicies: map[string]TTLPolicy{
+			"rewrite.example": {MaxTTL: time.Minute, RewriteClientTTL: true},
+			"long.example":    {MinTTL: time.Hour},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, _ := newListener(Listener{Addr: "127.0.0.1:0"}, nil, "udp")
+
+	tests := []struct {
+		name      string
+		clientTTL uint32
+		lifetime  uint32
+	}{
+		// the client sees the published TTL, the cache keeps the answer for a minute
+		{"www.example.", 300, 60},
+		{"www.rewrite.example.", 60, 60},
+		{"www.long.example.", 300, 3600},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(tt.name, dns.TypeA)
+		w := newTestResponseWriter("127.0.0.1", "udp")
+		s.handle(w, req, ln)
+		if len(w.msg.Answer) != 1 || w.msg.Answer[0].Header().Ttl != tt.clientTTL {
+			t.Errorf("%s: the client should see ttl %d, got %v", tt.name, tt.clientTTL, w.msg.Answer)
+		}
+
+		entry, ok := s.resolver.cache.get(requestToString(req.Question[0], true, "udp"))
+		if !ok {
+			t.Fatalf("%s: the answer should be cached", tt.name)
+		}
+		if ttl, _ := entry.lifetime(); ttl != tt.lifetime {
+			t.Errorf("%s: the cache lifetime should be %d, got %d", tt.name, tt.lifetime, ttl)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package freedns
 
 import (
 	"os"
+	"strings"
 	"sync"
 
 	"github.com/fsnotify/fsnotify"
@@ -111,8 +112,29 @@ func newResolvconfUpstreamProvider(filename string) (*resolvconfUpstreamProvider
 // Possible name values are:
 // IP address (with optional port) :: use this IP as static upstream
 // Filename :: parse the file as resolv.conf, read upstreams from the file (monitor file change)
+// replay:fixture#upstream :: answer with the exchanges of the upstream recorded in the fixture file
+//
+// The IP addresses accept options, e.g. 8.8.8.8:53?proxy=socks5://127.0.0.1:1080
+// reaches the upstream through a SOCKS5 proxy (http:// for HTTP CONNECT proxies),
+// and 8.8.8.8:53?iface=tun0&mark=0x10 through the VPN link (see upstreamDialer).
 func newUpstreamProvider(name string) (upstreamProvider, error) {
-	if addr, err := normalizeDnsAddress(name); err == nil {
+	if strings.HasPrefix(name, "replay:") {
+		return newReplayUpstreamProvider(strings.TrimPrefix(name, "replay:"))
+	}
+	host, options, err := splitUpstream(name)
+	if err != nil {
+		return nil, err
+	}
+	if addr, err := normalizeDnsAddress(host); err == nil {
+		if _, err := parseProxy(options); err != nil {
+			return nil, err
+		}
+		if _, err := upstreamDialer(options, "udp"); err != nil {
+			return nil, err
+		}
+		if len(options) > 0 {
+			addr += "?" + options.Encode()
+		}
 		return &staticUpstreamProvider{
 			upstream: addr,
 		}, nil
@@ -0,0 +1,135 @@
+package freedns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/xiangyu123/cosp_dns/whitedomain"
+)
+
+// View routes the queries of a group of clients with its own white domains and upstreams.
+// A client belongs to the first view it matches by CIDR, listener or interface.
+type View struct {
+	Name string
+
+	// ClientCIDRs matches the source address of the clients.
+	ClientCIDRs []string
+	// Listeners matches the name of the listener which received the query.
+	Listeners []string
+	// Interfaces matches the clients on the subnets attached to these network interfaces.
+	Interfaces []string
+
+	// WhiteDomains replaces the built-in white domain list for the view, with the rules of
+	// whitedomain.Compile, e.g. "full:api.example.com" or "@@pan.baidu.com".
+	// Leaving it empty routes every query to the public upstream.
+	WhiteDomains []string
+
+	// The upstreams of the view, empty ones default to the upstreams of Config.
+	FastUpstream   string
+	CleanUpstream  string
+	PublicUpstream string
+
+	// AddressFilter replaces the one of Config for the view, e.g. FilterAAAA for the networks without IPv6.
+	AddressFilter AddressFilter
+	// DNS64 replaces the one of Config for the view, e.g. for an IPv6-only network behind NAT64.
+	DNS64 *DNS64
+}
+
+type view struct {
+	name      string
+	cidrs     []*net.IPNet
+	listeners map[string]bool
+	resolver  *spoofingProofResolver
+}
+
+func newView(cfg View, defaults Config) (*view, error) {
+	cidrs, err := parseCIDRs(cfg.ClientCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range cfg.Interfaces {
+		ifaceNets, err := interfaceNets(name)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, ifaceNets...)
+	}
+
+	listeners := make(map[string]bool)
+	for _, name := range cfg.Listeners {
+		listeners[name] = true
+	}
+
+	upstreams := []string{cfg.FastUpstream, cfg.CleanUpstream, cfg.PublicUpstream}
+	for i, fallback := range []string{defaults.FastUpstream, defaults.CleanUpstream, defaults.PublicUpstream} {
+		if upstreams[i] == "" {
+			upstreams[i] = fallback
+		}
+	}
+	providers := make([]upstreamProvider, len(upstreams))
+	for i, upstream := range upstreams {
+		if providers[i], err = newUpstreamProvider(upstream); err != nil {
+			return nil, err
+		}
+	}
+
+	resolver := newSpoofingProofResolver(providers[0], providers[1], providers[2])
+	if resolver.whiteDomains, err = whitedomain.Compile(cfg.WhiteDomains); err != nil {
+		return nil, err
+	}
+	resolver.addressFilter = cfg.AddressFilter
+	if resolver.addressFilter == "" {
+		resolver.addressFilter = defaults.AddressFilter
+	}
+	dns64 := cfg.DNS64
+	if dns64 == nil {
+		dns64 = defaults.DNS64
+	}
+	if resolver.dns64, err = newDNS64(dns64); err != nil {
+		return nil, err
+	}
+
+	return &view{
+		name:      cfg.Name,
+		cidrs:     cidrs,
+		listeners: listeners,
+		resolver:  resolver,
+	}, nil
+}
+
+func (v *view) matches(ip net.IP, ln *listener) bool {
+	if ln != nil && v.listeners[ln.name] {
+		return true
+	}
+	return ip != nil && containsIP(v.cidrs, ip)
+}
+
+// interfaceNets returns the subnets attached to a network interface.
+func interfaceNets(name string) ([]*net.IPNet, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, Error("Invalid interface " + name + ": " + err.Error())
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var nets []*net.IPNet
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok {
+			nets = append(nets, &net.IPNet{IP: n.IP.Mask(n.Mask), Mask: n.Mask})
+		}
+	}
+	return nets, nil
+}
+
+// selectView returns the view of the client, or nil for the default one.
+func (s *Server) selectView(w dns.ResponseWriter, ln *listener) *view {
+	ip := clientIP(w.RemoteAddr())
+	for _, v := range s.views {
+		if v.matches(ip, ln) {
+			return v
+		}
+	}
+	return nil
+}
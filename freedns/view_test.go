@@ -0,0 +1,105 @@
+package freedns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// answerA answers every A question with the same address.
+func answerA(ip string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		q := req.Question[0]
+		if q.Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(q.Name + " 300 IN A " + ip)
+			res.Answer = append(res.Answer, rr)
+		}
+		w.WriteMsg(res)
+	}
+}
+
+func TestViews(t *testing.T) {
+	office, shutdownOffice := startTestUpstream(t, answerA("10.0.0.1"))
+	defer shutdownOffice()
+	idc, shutdownIDC := startTestUpstream(t, answerA("10.0.0.2"))
+	defer shutdownIDC()
+	public, shutdownPublic := startTestUpstream(t, answerA("1.1.1.1"))
+	defer shutdownPublic()
+
+	s, err := NewServer(Config{
+		FastUpstream:   office,
+		CleanUpstream:  office,
+		PublicUpstream: public,
+		Listen:         "127.0.0.1:0",
+		Views: []View{
+			{
+				Name:         "vpn",
+				ClientCIDRs:  []string{"172.16.0.0/12"},
+				WhiteDomains: []string{"corp.example"},
+				FastUpstream: idc, CleanUpstream: idc,
+			},
+			{
+				Name:      "guest",
+				Listeners: []string{"guest"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lan, _ := newListener(Listener{Name: "lan", Addr: "127.0.0.1:0"}, nil, "udp")
+	guest, _ := newListener(Listener{Name: "guest", Addr: "127.0.0.1:0"}, nil, "udp")
+
+	tests := []struct {
+		client string
+		ln     *listener
+		domain string
+		want   string
+	}{
+		{"192.168.1.10", lan, "www.baidu.com.", "10.0.0.1"},
+		{"192.168.1.10", lan, "git.corp.example.", "1.1.1.1"},
+		{"172.16.3.4", lan, "git.corp.example.", "10.0.0.2"},
+		{"172.16.3.4", lan, "www.baidu.com.", "1.1.1.1"},
+		{"192.168.1.10", guest, "www.baidu.com.", "1.1.1.1"},
+		// CIDR and listener views are evaluated in order
+		{"172.16.3.4", guest, "git.corp.example.", "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion(tt.domain, dns.TypeA)
+		w := newTestResponseWriter(tt.client, "udp")
+		s.handle(w, req, tt.ln)
+
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Errorf("%s from %s@%s: unexpected response %v", tt.domain, tt.client, tt.ln.name, w.msg)
+			continue
+		}
+		if got := w.msg.Answer[0].(*dns.A).A.String(); got != tt.want {
+			t.Errorf("%s from %s@%s: got %s, want %s", tt.domain, tt.client, tt.ln.name, got, tt.want)
+		}
+	}
+}
+
+func TestInvalidView(t *testing.T) {
+	_, err := NewServer(Config{
+		FastUpstream:   "127.0.0.1",
+		CleanUpstream:  "127.0.0.1",
+		PublicUpstream: "127.0.0.1",
+		Views:          []View{{Name: "broken", Interfaces: []string{"no-such-interface0"}}},
+	})
+	if err == nil {
+		t.Errorf("views on missing interfaces should be rejected")
+	}
+
+	_, err = NewServer(Config{
+		FastUpstream:   "127.0.0.1",
+		CleanUpstream:  "127.0.0.1",
+		PublicUpstream: "127.0.0.1",
+		Views:          []View{{Name: "broken", WhiteDomains: []string{"regexp:("}}},
+	})
+	if err == nil {
+		t.Errorf("views with invalid white domain rules should be rejected")
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	_ "net/http/pprof"
 
@@ -23,24 +25,114 @@ func main() {
 		publicUpstream string
 		listen         string
 		logLevel       string
-		// cache         bool
+		dnssec         bool
+		allow          string
+		deny           string
+		qps            float64
+		rrl            float64
+		cache          bool
+		cacheFile      string
+		prefetch       bool
+		serveStale     bool
+		minTTL         time.Duration
+		maxTTL         time.Duration
+		record         string
+		chain          string
+		ipsets         string
+		addressFilter  string
+		dns64          string
+		geoip          string
+		geoipFilter    bool
+		domainLists    string
+		ruleSets       string
 	)
 
 	flag.StringVar(&fastUpstream, "f", "114.114.114.114:53", "The first-local recursion DNS upstream, ip:port")
 	flag.StringVar(&cleanUpstream, "c", "8.8.8.8:53", "The second-local recursion DNS upstream., ip:port")
 	flag.StringVar(&publicUpstream, "p", "8.8.8.8:53", "The public-remote recursion DNS upstream., ip:port")
 	flag.StringVar(&listen, "l", "0.0.0.0:53", "Listening address.")
-	// flag.BoolVar(&cache, "cache", true, "Enable cache.")
+	flag.BoolVar(&cache, "cache", true, "Enable cache.")
+	flag.StringVar(&cacheFile, "cache-file", "", "Keep the cache in this file across restarts.")
+	flag.BoolVar(&prefetch, "prefetch", false, "Refresh popular cached answers before they expire.")
+	flag.BoolVar(&serveStale, "serve-stale", false, "Answer with expired cached answers when the upstreams fail.")
+	flag.DurationVar(&minTTL, "min-ttl", 0, "Keep the cached answers at least this long.")
+	flag.DurationVar(&maxTTL, "max-ttl", 0, "Keep the cached answers at most this long, 0 is unlimited.")
+	flag.StringVar(&record, "record", "", "Record the upstream exchanges to this fixture file, replay them with replay:file#upstream.")
+	flag.StringVar(&chain, "chain", "", "Comma separated stages handling the queries, defaults to "+strings.Join(freedns.DefaultChain, ",")+".")
+	flag.StringVar(&ipsets, "ipset", "", "Comma separated sets receiving the addresses of the white domains, e.g. ipset:gfw,nftset:inet#fw#gfw.")
+	flag.StringVar(&addressFilter, "address-filter", "", "Answer NODATA instead of some addresses: aaaa, aaaa-if-a, a or a-if-aaaa.")
+	flag.StringVar(&dns64, "dns64", "", "Synthesize AAAA records with this NAT64 prefix, e.g. 64:ff9b::/96.")
+	flag.StringVar(&geoip, "geoip", "", "Comma separated MaxMind DB files sorting the answers by the location of the client.")
+	flag.BoolVar(&geoipFilter, "geoip-filter", false, "Only answer the addresses closest to the client, with -geoip.")
+	flag.StringVar(&domainLists, "domain-list", "", "Comma separated gfwlist, dnsmasq-china-list or plain domain list files routing the domains.")
+	flag.StringVar(&ruleSets, "rule-set", "", "Comma separated Clash or Surge rule sets routing the domains, file or file#POLICY for the rules without policy, DIRECT goes to -f and PROXY to -c.")
 	flag.StringVar(&logLevel, "log-level", "", "Set log level: info/warn/error.")
+	flag.BoolVar(&dnssec, "dnssec", false, "Validate answers with DNSSEC.")
+	flag.StringVar(&allow, "allow", "", "Comma separated CIDRs allowed to query, empty allows all.")
+	flag.StringVar(&deny, "deny", "", "Comma separated CIDRs refused.")
+	flag.Float64Var(&qps, "qps", 0, "Queries per second allowed for each client prefix, 0 is unlimited.")
+	flag.Float64Var(&rrl, "rrl", 0, "Identical udp responses per second sent to each client prefix, 0 is unlimited.")
 
 	flag.Parse()
 
+	var acl *freedns.ACL
+	if allow != "" || deny != "" {
+		acl = &freedns.ACL{
+			Allow: splitList(allow),
+			Deny:  splitList(deny),
+		}
+	}
+
+	var rateLimit *freedns.RateLimit
+	if qps > 0 || rrl > 0 {
+		rateLimit = &freedns.RateLimit{
+			QPS:                qps,
+			ResponsesPerSecond: rrl,
+			Slip:               2,
+		}
+	}
+
+	var dns64Config *freedns.DNS64
+	if dns64 != "" {
+		dns64Config = &freedns.DNS64{Prefix: dns64}
+	}
+
+	var geoipConfig *freedns.GeoIP
+	if geoip != "" {
+		geoipConfig = &freedns.GeoIP{Files: splitList(geoip), Filter: geoipFilter}
+	}
+
+	var ruleSetConfigs []freedns.RuleSet
+	for _, item := range splitList(ruleSets) {
+		rs := freedns.RuleSet{File: item}
+		if i := strings.LastIndex(item, "#"); i >= 0 {
+			rs = freedns.RuleSet{File: item[:i], Policy: item[i+1:]}
+		}
+		ruleSetConfigs = append(ruleSetConfigs, rs)
+	}
+
 	s, err := freedns.NewServer(freedns.Config{
 		FastUpstream:   fastUpstream,
 		CleanUpstream:  cleanUpstream,
 		PublicUpstream: publicUpstream,
 		Listen:         listen,
 		LogLevel:       logLevel,
+		DNSSEC:         dnssec,
+		ACL:            acl,
+		RateLimit:      rateLimit,
+		Cache:          cache,
+		CacheFile:      cacheFile,
+		Prefetch:       prefetch,
+		ServeStale:     serveStale,
+		TTLPolicy:      freedns.TTLPolicy{MinTTL: minTTL, MaxTTL: maxTTL},
+		RecordFile:     record,
+		Chain:          splitList(chain),
+		WhiteIPSets:    splitList(ipsets),
+		AddressFilter:  freedns.AddressFilter(addressFilter),
+		DNS64:          dns64Config,
+		GeoIP:          geoipConfig,
+		DomainLists:    splitList(domainLists),
+		RuleSets:       ruleSetConfigs,
 	})
 	if err != nil {
 		log.Fatalln(err)
@@ -50,3 +142,14 @@ func main() {
 	log.Fatalln(s.Run())
 	os.Exit(-1)
 }
+
+// splitList splits a comma separated flag value, ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
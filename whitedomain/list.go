@@ -0,0 +1,231 @@
+package whitedomain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// Format is the format of a domain list.
+type Format string
+
+// The formats of the domain lists.
+const (
+	// FormatPlain lists a domain per line, like the built-in list.
+	FormatPlain Format = "plain"
+	// FormatDnsmasq is the format of dnsmasq-china-list, e.g. "server=/baidu.com/114.114.114.114".
+	FormatDnsmasq Format = "dnsmasq"
+	// FormatGFWList is the AdBlock syntax of gfwlist, usually encoded in base64.
+	FormatGFWList Format = "gfwlist"
+)
+
+// List is a parsed domain list.
+type List struct {
+	Format Format
+	// White are the domains resolved by the upstreams in China: the domains of the plain
+	// lists and of dnsmasq-china-list, and the exceptions ("@@") of gfwlist.
+	White []string
+	// Blocked are the domains blocked in China, the rules of gfwlist.
+	Blocked []string
+	// Parsed and Skipped count the rules which were understood, and those which were not,
+	// e.g. the regular expressions and the URL rules of gfwlist. Comments are not counted.
+	Parsed  int
+	Skipped int
+}
+
+// LoadFile parses the domain list file, see Parse.
+func LoadFile(file string) (*List, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseBytes(buf), nil
+}
+
+// Parse parses a domain list in any of the formats, which is detected. The base64
+// encoded gfwlist is decoded.
+func Parse(r io.Reader) (*List, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return parseBytes(buf), nil
+}
+
+func parseBytes(buf []byte) *List {
+	if decoded, ok := decodeBase64(buf); ok && detectFormat(decoded) == FormatGFWList {
+		buf = decoded
+	}
+	list := &List{Format: detectFormat(buf)}
+
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch list.Format {
+		case FormatGFWList:
+			list.parseGFWList(line)
+		case FormatDnsmasq:
+			list.parseDnsmasq(line)
+		default:
+			list.parsePlain(line)
+		}
+	}
+	return list
+}
+
+// decodeBase64 decodes the base64 lists, which are split in lines.
+func decodeBase64(buf []byte) ([]byte, bool) {
+	compact := bytes.Join(bytes.Fields(buf), nil)
+	if len(compact) == 0 {
+		return nil, false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(compact))
+	if err != nil {
+		return nil, false
+	}
+	return decoded, true
+}
+
+func detectFormat(buf []byte) Format {
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "[AutoProxy"), strings.HasPrefix(line, "||"),
+			strings.HasPrefix(line, "@@"), strings.HasPrefix(line, "|"), strings.HasPrefix(line, "!"):
+			return FormatGFWList
+		case strings.HasPrefix(line, "server=/"):
+			return FormatDnsmasq
+		}
+	}
+	return FormatPlain
+}
+
+func (l *List) parsePlain(line string) {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	if domain, ok := normalizeDomain(line); ok {
+		l.White = append(l.White, domain)
+		l.Parsed++
+	} else {
+		l.Skipped++
+	}
+}
+
+// parseDnsmasq parses the "server=/domain/.../upstream" lines, the other options are skipped.
+func (l *List) parseDnsmasq(line string) {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return
+	}
+	if !strings.HasPrefix(line, "server=/") {
+		l.Skipped++
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(line, "server="), "/")
+	// "", domains..., upstream
+	if len(parts) < 3 {
+		l.Skipped++
+		return
+	}
+	for _, name := range parts[1 : len(parts)-1] {
+		if domain, ok := normalizeDomain(name); ok {
+			l.White = append(l.White, domain)
+			l.Parsed++
+		} else {
+			l.Skipped++
+		}
+	}
+}
+
+// parseGFWList parses a rule of gfwlist. Only the rules blocking whole domains can be
+// used for DNS: "||domain", "|http://domain/", ".domain" and "domain", and their
+// exceptions prefixed by "@@". The regular expressions and the URL rules are skipped.
+func (l *List) parseGFWList(line string) {
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return
+	}
+	rule := line
+	exception := strings.HasPrefix(rule, "@@")
+	rule = strings.TrimPrefix(rule, "@@")
+
+	var host string
+	switch {
+	case strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/"):
+		// a regular expression
+	case strings.HasPrefix(rule, "||"):
+		host = hostOfRule(strings.TrimPrefix(rule, "||"))
+	case strings.HasPrefix(rule, "|"):
+		rule = strings.TrimPrefix(rule, "|")
+		if i := strings.Index(rule, "://"); i >= 0 {
+			host = hostOfRule(rule[i+3:])
+		}
+	case strings.Contains(rule, "://"):
+		host = hostOfRule(rule[strings.Index(rule, "://")+3:])
+	default:
+		host = hostOfRule(strings.TrimPrefix(rule, "."))
+	}
+
+	domain, ok := normalizeDomain(host)
+	if !ok {
+		l.Skipped++
+		return
+	}
+	if exception {
+		l.White = append(l.White, domain)
+	} else {
+		l.Blocked = append(l.Blocked, domain)
+	}
+	l.Parsed++
+}
+
+// hostOfRule returns the host of a rule matching a whole domain, e.g. "example.com^" or
+// "example.com/", and an empty string for the rules matching some URLs only.
+func hostOfRule(rule string) string {
+	rule = strings.TrimSuffix(rule, "^")
+	if i := strings.Index(rule, "/"); i >= 0 {
+		if rule[i+1:] != "" {
+			return ""
+		}
+		rule = rule[:i]
+	}
+	if host, _, err := net.SplitHostPort(rule); err == nil {
+		rule = host
+	}
+	return rule
+}
+
+// normalizeDomain lowercases the domain, and tells whether it is a valid domain name
+// with two labels at least. The IP addresses and the wildcards are not domains.
+func normalizeDomain(s string) (string, bool) {
+	domain := strings.ToLower(strings.Trim(s, "."))
+	if !strings.Contains(domain, ".") || len(domain) > 253 || net.ParseIP(domain) != nil {
+		return "", false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return "", false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", false
+			}
+		}
+	}
+	return domain, true
+}
+
+// normalizeRuleDomain is normalizeDomain allowing the top-level domains in the suffix rules, e.g. "cn".
+func normalizeRuleDomain(s string) (string, bool) {
+	domain := strings.ToLower(strings.Trim(s, "."))
+	if _, ok := normalizeDomain(domain + ".test"); !ok {
+		return "", false
+	}
+	return domain, true
+}
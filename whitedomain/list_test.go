@@ -0,0 +1,120 @@
+package whitedomain
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePlain(t *testing.T) {
+	list, err := Parse(strings.NewReader("# china domains\nbaidu.com\n\nQQ.com.\nlocalhost\n1.2.3.4\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Format != FormatPlain {
+		t.Errorf("format = %s, want plain", list.Format)
+	}
+	if want := []string{"baidu.com", "qq.com"}; !reflect.DeepEqual(list.White, want) {
+		t.Errorf("white = %v, want %v", list.White, want)
+	}
+	if list.Parsed != 2 || list.Skipped != 2 {
+		t.Errorf("parsed %d, skipped %d, want 2 and 2", list.Parsed, list.Skipped)
+	}
+}
+
+func TestParseDnsmasq(t *testing.T) {
+	list, err := Parse(strings.NewReader(`# accelerated-domains.china.conf
+server=/baidu.com/114.114.114.114
+server=/qq.com/weixin.qq.com/114.114.114.114
+server=/invalid domain/114.114.114.114
+ipset=/taobao.com/china
+server=114.114.114.114
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Format != FormatDnsmasq {
+		t.Errorf("format = %s, want dnsmasq", list.Format)
+	}
+	if want := []string{"baidu.com", "qq.com", "weixin.qq.com"}; !reflect.DeepEqual(list.White, want) {
+		t.Errorf("white = %v, want %v", list.White, want)
+	}
+	if list.Parsed != 3 || list.Skipped != 3 {
+		t.Errorf("parsed %d, skipped %d, want 3 and 3", list.Parsed, list.Skipped)
+	}
+}
+
+const testGFWList = `[AutoProxy 0.2.9]
+! Checksum: abc
+! comment
+||google.com
+||youtube.com^
+|http://example.org
+|https://www.example.net/
+|http://example.info/path
+.twitter.com
+facebook.com
+example.io/page
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+*.wildcard.com
+@@||cn.google.com
+@@|http://www.example.org
+`
+
+func TestParseGFWList(t *testing.T) {
+	for _, encoded := range []bool{false, true} {
+		text := testGFWList
+		if encoded {
+			// gfwlist.txt is base64 encoded in lines of 64 characters
+			b := base64.StdEncoding.EncodeToString([]byte(text))
+			var lines []string
+			for len(b) > 64 {
+				lines = append(lines, b[:64])
+				b = b[64:]
+			}
+			text = strings.Join(append(lines, b), "\n") + "\n"
+		}
+		list, err := Parse(strings.NewReader(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list.Format != FormatGFWList {
+			t.Errorf("format = %s, want gfwlist", list.Format)
+		}
+		blocked := []string{"google.com", "youtube.com", "example.org", "www.example.net", "twitter.com", "facebook.com"}
+		if !reflect.DeepEqual(list.Blocked, blocked) {
+			t.Errorf("blocked = %v, want %v", list.Blocked, blocked)
+		}
+		if white := []string{"cn.google.com", "www.example.org"}; !reflect.DeepEqual(list.White, white) {
+			t.Errorf("white = %v, want %v", list.White, white)
+		}
+		if list.Parsed != 8 || list.Skipped != 4 {
+			t.Errorf("parsed %d, skipped %d, want 8 and 4", list.Parsed, list.Skipped)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whitedomain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "gfwlist.txt")
+	ioutil.WriteFile(file, []byte(base64.StdEncoding.EncodeToString([]byte(testGFWList))), 0644)
+	list, err := LoadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Format != FormatGFWList || len(list.Blocked) == 0 {
+		t.Errorf("unexpected list %+v", list)
+	}
+	if _, err := LoadFile(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Errorf("should not load a missing file")
+	}
+}
@@ -0,0 +1,161 @@
+package whitedomain
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The prefixes of the rules, a rule without prefix is a suffix rule.
+const (
+	// PrefixFull matches the domain only, e.g. "full:api.example.com".
+	PrefixFull = "full:"
+	// PrefixDomain matches the domain and its subdomains, e.g. "domain:example.com" or "example.com".
+	PrefixDomain = "domain:"
+	// PrefixKeyword matches the domains containing the keyword, e.g. "keyword:google".
+	PrefixKeyword = "keyword:"
+	// PrefixRegexp matches the domains, without the trailing dot, with the regular expression,
+	// e.g. `regexp:^cdn\d+\.example\.com$`.
+	PrefixRegexp = "regexp:"
+	// PrefixException turns any rule into an exception, e.g. "@@pan.baidu.com" or "@@keyword:ads".
+	PrefixException = "@@"
+)
+
+type keywordRule struct {
+	keyword   string
+	exception bool
+}
+
+type regexpRule struct {
+	re        *regexp.Regexp
+	exception bool
+}
+
+// Rules matches the domains with compiled rules. Whether a domain matches is decided by
+// the first kind of rules matching it, in this order:
+//
+//  1. the full rules,
+//  2. the suffix rules, the longest suffix wins,
+//  3. the keyword rules,
+//  4. the regexp rules.
+//
+// An exception wins over a rule of the same kind, e.g. "baidu.com" and "@@pan.baidu.com" match
+// baidu.com and www.baidu.com but not pan.baidu.com, and "@@keyword:ads" doesn't exclude
+// ads.baidu.com from "baidu.com" since the suffix rules come first.
+// The matching is case insensitive. The nil Rules match nothing.
+type Rules struct {
+	// full and suffixes map the domains to whether their rule is an exception.
+	full     map[string]bool
+	suffixes map[string]bool
+	keywords []keywordRule
+	regexps  []regexpRule
+}
+
+// Compile compiles the rules, the empty ones and the comments starting with "#" are ignored.
+func Compile(rules []string) (*Rules, error) {
+	r := &Rules{
+		full:     make(map[string]bool),
+		suffixes: make(map[string]bool),
+	}
+	for _, rule := range rules {
+		if err := r.add(strings.TrimSpace(rule)); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// MustCompile is like Compile but panics on invalid rules, for the built-in lists.
+func MustCompile(rules []string) *Rules {
+	r, err := Compile(rules)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func (r *Rules) add(rule string) error {
+	if rule == "" || strings.HasPrefix(rule, "#") {
+		return nil
+	}
+	value := rule
+	exception := strings.HasPrefix(value, PrefixException)
+	value = strings.TrimPrefix(value, PrefixException)
+
+	switch {
+	case strings.HasPrefix(value, PrefixFull):
+		domain, ok := normalizeDomain(strings.TrimPrefix(value, PrefixFull))
+		if !ok {
+			return fmt.Errorf("invalid domain rule %q", rule)
+		}
+		mergeException(r.full, domain, exception)
+	case strings.HasPrefix(value, PrefixKeyword):
+		keyword := strings.ToLower(strings.TrimPrefix(value, PrefixKeyword))
+		if keyword == "" {
+			return fmt.Errorf("invalid domain rule %q", rule)
+		}
+		r.keywords = append(r.keywords, keywordRule{keyword, exception})
+	case strings.HasPrefix(value, PrefixRegexp):
+		re, err := regexp.Compile("(?i)" + strings.TrimPrefix(value, PrefixRegexp))
+		if err != nil {
+			return fmt.Errorf("invalid domain rule %q: %v", rule, err)
+		}
+		r.regexps = append(r.regexps, regexpRule{re, exception})
+	default:
+		domain, ok := normalizeRuleDomain(strings.TrimPrefix(value, PrefixDomain))
+		if !ok {
+			return fmt.Errorf("invalid domain rule %q", rule)
+		}
+		mergeException(r.suffixes, domain, exception)
+	}
+	return nil
+}
+
+// mergeException records the domain rule, an exception wins over a rule of the same domain.
+func mergeException(m map[string]bool, domain string, exception bool) {
+	m[domain] = m[domain] || exception
+}
+
+// Match tells whether the domain, with or without the trailing dot, matches the rules.
+func (r *Rules) Match(name string) bool {
+	if r == nil {
+		return false
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if exception, ok := r.full[name]; ok {
+		return !exception
+	}
+	for suffix := name; ; {
+		if exception, ok := r.suffixes[suffix]; ok {
+			return !exception
+		}
+		i := strings.Index(suffix, ".")
+		if i < 0 {
+			break
+		}
+		suffix = suffix[i+1:]
+	}
+
+	matched := false
+	for _, k := range r.keywords {
+		if strings.Contains(name, k.keyword) {
+			if k.exception {
+				return false
+			}
+			matched = true
+		}
+	}
+	if matched {
+		return true
+	}
+	for _, re := range r.regexps {
+		if re.re.MatchString(name) {
+			if re.exception {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
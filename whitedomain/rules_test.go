@@ -0,0 +1,110 @@
+package whitedomain
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRulesPrecedence(t *testing.T) {
+	rules := MustCompile([]string{
+		"# the white domains",
+		"",
+		"baidu.com",
+		"@@pan.baidu.com",
+		"domain:yun.pan.baidu.com",
+		"full:api.example.com",
+		"@@full:www.qq.com",
+		"qq.com",
+		"keyword:taobao",
+		"@@keyword:taobao-ads",
+		`regexp:^cdn\d+\.example\.net$`,
+		`@@regexp:^cdn9\d*\.`,
+		"@@keyword:jd",
+		"jd.com",
+		"cn",
+		"@@full:example.cn",
+	})
+	tests := map[string]bool{
+		// suffix rules match the domain and its subdomains, on label boundaries
+		"baidu.com.":      true,
+		"www.baidu.com":   true,
+		"notbaidu.com":    false,
+		"WWW.BAIDU.COM.":  true,
+		"pan.baidu.com":   false,
+		"a.pan.baidu.com": false,
+		// the longest suffix wins
+		"yun.pan.baidu.com":   true,
+		"a.yun.pan.baidu.com": true,
+		// full rules match the domain only, and come first
+		"api.example.com":     true,
+		"www.api.example.com": false,
+		"example.com":         false,
+		"www.qq.com":          false,
+		"mail.qq.com":         true,
+		"example.cn":          false,
+		"www.example.cn":      true,
+		// keyword rules, the exceptions win among them
+		"www.taobao.com": true,
+		"taobao-ads.com": false,
+		"www.jd.hk":      false,
+		// the suffix rules come before the keyword exceptions
+		"www.jd.com": true,
+		// regexp rules, the exceptions win among them
+		"cdn1.example.net":  true,
+		"cdn12.example.net": true,
+		"cdn9.example.net":  false,
+		"cdn.example.net":   false,
+		"example.org":       false,
+	}
+	for domain, want := range tests {
+		if got := rules.Match(domain); got != want {
+			t.Errorf("Match(%q) = %v, want %v", domain, got, want)
+		}
+	}
+}
+
+func TestNilRules(t *testing.T) {
+	var rules *Rules
+	if rules.Match("baidu.com") {
+		t.Errorf("the nil rules should match nothing")
+	}
+	if empty := MustCompile(nil); empty.Match("baidu.com") {
+		t.Errorf("the empty rules should match nothing")
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, rule := range []string{
+		"full:",
+		"full:com",
+		"keyword:",
+		"regexp:(",
+		"domain:invalid domain",
+		"@@",
+		"a..b",
+	} {
+		if _, err := Compile([]string{rule}); err == nil {
+			t.Errorf("%q should be rejected", rule)
+		}
+	}
+}
+
+func TestBuiltinRules(t *testing.T) {
+	if _, err := Compile(GetAllDomains()); err != nil {
+		t.Errorf("the built-in list is invalid: %v", err)
+	}
+}
+
+func BenchmarkRulesMatch(b *testing.B) {
+	var list []string
+	for i := 0; i < 10000; i++ {
+		list = append(list, fmt.Sprintf("domain%d.example.com", i))
+	}
+	list = append(list, "keyword:google", `regexp:^cdn\d+\.example\.net$`)
+	rules := MustCompile(list)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rules.Match("www.domain9999.example.com.")
+		rules.Match("cdn12.example.net.")
+	}
+}
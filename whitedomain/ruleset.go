@@ -0,0 +1,189 @@
+package whitedomain
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// The types of the Clash and Surge rules which can route domains.
+const (
+	RuleDomain        = "DOMAIN"
+	RuleDomainSuffix  = "DOMAIN-SUFFIX"
+	RuleDomainKeyword = "DOMAIN-KEYWORD"
+	// RuleDomainRegex is a rule of Clash.Meta.
+	RuleDomainRegex = "DOMAIN-REGEX"
+)
+
+// Rule is a domain rule of a rule set.
+type Rule struct {
+	// Type is RuleDomain, RuleDomainSuffix, RuleDomainKeyword or RuleDomainRegex.
+	Type  string
+	Value string
+	// Policy is the third field of the rule, e.g. "DIRECT" or "PROXY", empty in the rule providers.
+	Policy string
+}
+
+// RuleSet is a parsed Clash or Surge rule set, the rules are in their order.
+type RuleSet struct {
+	Rules []Rule
+	// Ignored counts the rules which can't route domains by their type, e.g. IP-CIDR, GEOIP or MATCH.
+	Ignored map[string]int
+	// Skipped counts the invalid rules.
+	Skipped int
+}
+
+// LoadRuleSetFile parses the rule set file, see ParseRuleSet.
+func LoadRuleSetFile(file string) (*RuleSet, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseRuleSet(buf), nil
+}
+
+// ParseRuleSet parses the rules of a Clash rule provider, in YAML ("payload:") or text, of
+// the "rules:" of a Clash config, or of a Surge rule set. The payloads of the providers with
+// the domain behavior are supported too: "+.example.com" matches example.com and its subdomains,
+// ".example.com" its subdomains, "*.example.com" one level of subdomains, and "example.com" itself.
+// The YAML lists must use the block style, one "- rule" per line.
+func ParseRuleSet(r io.Reader) (*RuleSet, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return parseRuleSet(buf), nil
+}
+
+// ruleOptions are the options which may follow the value in the rule sets, they are not policies.
+var ruleOptions = map[string]bool{
+	"no-resolve":        true,
+	"extended-matching": true,
+	"force-remote-dns":  true,
+	"pre-matching":      true,
+}
+
+var yamlRulesKey = regexp.MustCompile(`^(payload|rules)\s*:\s*$`)
+
+func parseRuleSet(buf []byte) *RuleSet {
+	set := &RuleSet{Ignored: make(map[string]int)}
+	yaml := false
+	for _, line := range bytes.Split(buf, []byte("\n")) {
+		if yamlRulesKey.Match(bytes.TrimRight(line, " \t\r")) {
+			yaml = true
+			break
+		}
+	}
+
+	inList := !yaml
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		raw := strings.TrimRight(scanner.Text(), " \t\r")
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if yaml {
+			// a key at the top level starts or ends the list
+			if raw[0] != ' ' && raw[0] != '\t' && raw[0] != '-' {
+				inList = yamlRulesKey.MatchString(raw)
+				continue
+			}
+			if !inList || !strings.HasPrefix(line, "-") {
+				continue
+			}
+			line = unquoteYAML(strings.TrimSpace(strings.TrimPrefix(line, "-")))
+		}
+		if inList {
+			set.parseRule(line)
+		}
+	}
+	return set
+}
+
+// unquoteYAML removes the quotes and the trailing comment of a YAML scalar.
+func unquoteYAML(s string) string {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') {
+		if end := strings.IndexByte(s[1:], s[0]); end >= 0 {
+			return s[1 : end+1]
+		}
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	return s
+}
+
+func (set *RuleSet) parseRule(line string) {
+	fields := strings.Split(line, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	if len(fields) == 1 {
+		set.parseDomainBehavior(fields[0])
+		return
+	}
+
+	rule := Rule{Type: strings.ToUpper(fields[0]), Value: fields[1]}
+	if len(fields) > 2 && !ruleOptions[strings.ToLower(fields[2])] {
+		rule.Policy = fields[2]
+	}
+	switch rule.Type {
+	case RuleDomain, RuleDomainSuffix:
+		domain, ok := normalizeRuleDomain(rule.Value)
+		if !ok {
+			set.Skipped++
+			return
+		}
+		rule.Value = domain
+	case RuleDomainKeyword:
+		if rule.Value == "" {
+			set.Skipped++
+			return
+		}
+		rule.Value = strings.ToLower(rule.Value)
+	case RuleDomainRegex:
+		if _, err := regexp.Compile(rule.Value); err != nil {
+			set.Skipped++
+			return
+		}
+	default:
+		set.Ignored[rule.Type]++
+		return
+	}
+	set.Rules = append(set.Rules, rule)
+}
+
+// parseDomainBehavior parses an entry of a rule provider with the domain behavior.
+func (set *RuleSet) parseDomainBehavior(entry string) {
+	var rule Rule
+	switch {
+	case strings.HasPrefix(entry, "+."):
+		rule = Rule{Type: RuleDomainSuffix, Value: entry[2:]}
+	case strings.HasPrefix(entry, "."):
+		rule = Rule{Type: RuleDomainRegex, Value: entry[1:]}
+	case strings.HasPrefix(entry, "*."):
+		rule = Rule{Type: RuleDomainRegex, Value: entry[2:]}
+	default:
+		rule = Rule{Type: RuleDomain, Value: entry}
+	}
+	domain, ok := normalizeRuleDomain(rule.Value)
+	if !ok {
+		set.Skipped++
+		return
+	}
+	rule.Value = domain
+	if rule.Type == RuleDomainRegex {
+		// one label or more for ".", exactly one for "*."
+		label := `.+`
+		if strings.HasPrefix(entry, "*.") {
+			label = `[^.]+`
+		}
+		rule.Value = `^` + label + `\.` + regexp.QuoteMeta(domain) + `$`
+	}
+	set.Rules = append(set.Rules, rule)
+}
@@ -0,0 +1,142 @@
+package whitedomain
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRuleSetProvider(t *testing.T) {
+	set, err := ParseRuleSet(strings.NewReader(`# a Clash rule provider
+payload:
+  - DOMAIN-SUFFIX,Google.com
+  - 'DOMAIN,api.example.com'
+  - "DOMAIN-KEYWORD,YouTube" # comment
+  - DOMAIN-REGEX,^cdn\d+\.example\.net$
+  - IP-CIDR,1.0.0.0/8,no-resolve
+  - IP-CIDR6,2001:db8::/32
+  - DOMAIN-SUFFIX,invalid domain
+  - DOMAIN-REGEX,(
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{RuleDomainSuffix, "google.com", ""},
+		{RuleDomain, "api.example.com", ""},
+		{RuleDomainKeyword, "youtube", ""},
+		{RuleDomainRegex, `^cdn\d+\.example\.net$`, ""},
+	}
+	if !reflect.DeepEqual(set.Rules, want) {
+		t.Errorf("rules = %v, want %v", set.Rules, want)
+	}
+	if ignored := map[string]int{"IP-CIDR": 1, "IP-CIDR6": 1}; !reflect.DeepEqual(set.Ignored, ignored) {
+		t.Errorf("ignored = %v, want %v", set.Ignored, ignored)
+	}
+	if set.Skipped != 2 {
+		t.Errorf("skipped = %d, want 2", set.Skipped)
+	}
+}
+
+func TestParseRuleSetDomainBehavior(t *testing.T) {
+	set, err := ParseRuleSet(strings.NewReader(`payload:
+  - '+.google.com'
+  - '.example.com'
+  - '*.example.org'
+  - 'example.net'
+  - '+.'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{RuleDomainSuffix, "google.com", ""},
+		{RuleDomainRegex, `^.+\.example\.com$`, ""},
+		{RuleDomainRegex, `^[^.]+\.example\.org$`, ""},
+		{RuleDomain, "example.net", ""},
+	}
+	if !reflect.DeepEqual(set.Rules, want) {
+		t.Errorf("rules = %v, want %v", set.Rules, want)
+	}
+	if set.Skipped != 1 {
+		t.Errorf("skipped = %d, want 1", set.Skipped)
+	}
+}
+
+func TestParseRuleSetClashConfig(t *testing.T) {
+	set, err := ParseRuleSet(strings.NewReader(`port: 7890
+proxies:
+  - name: proxy
+    type: ss
+rules:
+  - DOMAIN-SUFFIX,baidu.com,DIRECT
+  - DOMAIN-KEYWORD,google,Proxy Group
+  - GEOIP,CN,DIRECT
+  - MATCH,PROXY
+dns:
+  nameserver:
+    - DOMAIN,ignored.example,DIRECT
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{RuleDomainSuffix, "baidu.com", "DIRECT"},
+		{RuleDomainKeyword, "google", "Proxy Group"},
+	}
+	if !reflect.DeepEqual(set.Rules, want) {
+		t.Errorf("rules = %v, want %v", set.Rules, want)
+	}
+	if ignored := map[string]int{"GEOIP": 1, "MATCH": 1}; !reflect.DeepEqual(set.Ignored, ignored) {
+		t.Errorf("ignored = %v, want %v", set.Ignored, ignored)
+	}
+}
+
+func TestParseRuleSetSurge(t *testing.T) {
+	set, err := ParseRuleSet(strings.NewReader(`# Surge rule set
+// comment
+DOMAIN-SUFFIX,apple.com
+DOMAIN,www.icloud.com,extended-matching
+DOMAIN-SUFFIX,qq.com,DIRECT
+IP-CIDR,17.0.0.0/8,no-resolve
+USER-AGENT,App*
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{
+		{RuleDomainSuffix, "apple.com", ""},
+		{RuleDomain, "www.icloud.com", ""},
+		{RuleDomainSuffix, "qq.com", "DIRECT"},
+	}
+	if !reflect.DeepEqual(set.Rules, want) {
+		t.Errorf("rules = %v, want %v", set.Rules, want)
+	}
+	if ignored := map[string]int{"IP-CIDR": 1, "USER-AGENT": 1}; !reflect.DeepEqual(set.Ignored, ignored) {
+		t.Errorf("ignored = %v, want %v", set.Ignored, ignored)
+	}
+}
+
+func TestLoadRuleSetFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whitedomain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "direct.list")
+	ioutil.WriteFile(file, []byte("DOMAIN-SUFFIX,baidu.com\r\n"), 0644)
+	set, err := LoadRuleSetFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Rule{{RuleDomainSuffix, "baidu.com", ""}}; !reflect.DeepEqual(set.Rules, want) {
+		t.Errorf("rules = %v, want %v", set.Rules, want)
+	}
+	if _, err := LoadRuleSetFile(filepath.Join(dir, "missing.list")); err == nil {
+		t.Errorf("should not load a missing file")
+	}
+}